@@ -0,0 +1,602 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Alert rules come in two kinds. A threshold rule compares a metric against a
+// value: "lifetime", "score", "component.<name>.percent",
+// "component.<name>.remaining" or "rate.<event>" (events per 100 miles over
+// WindowMs). A rate_change rule fires when an event's rate per 100 miles over
+// the latest WindowMs is at least Factor times the rate over the window before.
+
+const (
+	alertThreshold  = "threshold"
+	alertRateChange = "rate_change"
+	alertInterval   = 10 * time.Second
+	alertHistoryMs  = 30 * 24 * 60 * 60 * 1000
+	alertMilesEvery = 10 * 60 * 1000
+	alertKeepMs     = 30 * 24 * 60 * 60 * 1000 // how long acknowledged alerts are kept
+	alertsPerTenant = 1000
+	weekMs          = 7 * 24 * 60 * 60 * 1000
+)
+
+type AlertRule struct {
+	Name       string  `json:"name"`
+	Type       string  `json:"type"`
+	Metric     string  `json:"metric,omitempty"`
+	Op         string  `json:"op,omitempty"`
+	Threshold  float64 `json:"threshold,omitempty"`
+	Event      string  `json:"event,omitempty"`
+	WindowMs   uint64  `json:"windowMs,omitempty"`
+	Factor     float64 `json:"factor,omitempty"`
+	MinEvents  int     `json:"minEvents,omitempty"`
+	CooldownMs uint64  `json:"cooldownMs"`
+	Severity   string  `json:"severity"`
+}
+
+type Alert struct {
+	ID           int     `json:"id"`
+	Rule         string  `json:"rule"`
+	CarID        string  `json:"carId"`
+	ApmID        string  `json:"apmId"`
+	Severity     string  `json:"severity"`
+	Message      string  `json:"message"`
+	Value        float64 `json:"value"`
+	Ts           uint64  `json:"ts"`
+	Acknowledged bool    `json:"acknowledged"`
+	AckBy        string  `json:"ackBy,omitempty"`
+	AckTs        uint64  `json:"ackTs,omitempty"`
+	tenant       string
+}
+
+type eventMark struct {
+	ts    uint64
+	event string
+}
+
+type milesMark struct {
+	ts    uint64
+	miles float64
+}
+
+type alertHistory struct {
+	events    []eventMark
+	miles     []milesMark
+	lastTs    uint64
+	lastMiles float64
+	lastFired map[string]uint64
+}
+
+var (
+	defaultAlertRules = []AlertRule{
+		{
+			Name:       "brakes_low",
+			Type:       alertThreshold,
+			Metric:     "component.brakes.percent",
+			Op:         "<",
+			Threshold:  10,
+			CooldownMs: 24 * 60 * 60 * 1000,
+			Severity:   "warning",
+		},
+		{
+			Name:       "hard_brakes_tripled",
+			Type:       alertRateChange,
+			Event:      "hardBreak",
+			WindowMs:   weekMs,
+			Factor:     3,
+			MinEvents:  3,
+			CooldownMs: weekMs,
+			Severity:   "warning",
+		},
+	}
+
+	alertHistoryMap   = make(map[vehicleKey]*alertHistory)
+	alertHistoryMutex = &sync.Mutex{}
+	alerts            []*Alert
+	alertsMutex       = &sync.Mutex{}
+	alertSeq          = 0
+)
+
+// prepareAlertRules checks component metrics against the tenant's components.
+// A default rule for a component the tenant does not have is dropped; an
+// explicit one is an error.
+func prepareAlertRules(rules []AlertRule, components map[string]ComponentConfig) ([]AlertRule, error) {
+	if rules == nil {
+		var kept []AlertRule
+		for _, r := range defaultAlertRules {
+			if name, isComponent := alertComponent(r.Metric); !isComponent || components[name].Budget > 0 {
+				kept = append(kept, r)
+			}
+		}
+		return kept, nil
+	}
+	seen := make(map[string]bool)
+	for i := range rules {
+		r := &rules[i]
+		if r.Name == "" || seen[r.Name] {
+			return nil, fmt.Errorf("alert rules need unique names")
+		}
+		seen[r.Name] = true
+		if r.Severity == "" {
+			r.Severity = "warning"
+		}
+		switch r.Type {
+		case alertThreshold:
+			if r.Op != "<" && r.Op != ">" {
+				return nil, fmt.Errorf("alert %q: op must be < or >", r.Name)
+			}
+			if !validAlertMetric(r.Metric) {
+				return nil, fmt.Errorf("alert %q: unknown metric %q", r.Name, r.Metric)
+			}
+			if name, isComponent := alertComponent(r.Metric); isComponent && components[name].Budget <= 0 {
+				return nil, fmt.Errorf("alert %q: unknown component %q", r.Name, name)
+			}
+		case alertRateChange:
+			if r.Event == "" || r.Factor <= 0 {
+				return nil, fmt.Errorf("alert %q: rate_change needs an event and a positive factor", r.Name)
+			}
+		default:
+			return nil, fmt.Errorf("alert %q: unknown type %q", r.Name, r.Type)
+		}
+		if r.WindowMs == 0 {
+			r.WindowMs = weekMs
+		}
+	}
+	return rules, nil
+}
+
+func validAlertMetric(metric string) bool {
+	parts := strings.Split(metric, ".")
+	switch {
+	case metric == "lifetime" || metric == "score":
+		return true
+	case len(parts) == 2 && parts[0] == "rate":
+		return true
+	case len(parts) == 3 && parts[0] == "component":
+		return parts[2] == "percent" || parts[2] == "remaining"
+	}
+	return false
+}
+
+func alertComponent(metric string) (string, bool) {
+	parts := strings.Split(metric, ".")
+	if len(parts) == 3 && parts[0] == "component" {
+		return parts[1], true
+	}
+	return "", false
+}
+
+func historyFor(k vehicleKey) *alertHistory {
+	h, found := alertHistoryMap[k]
+	if !found {
+		h = &alertHistory{lastFired: make(map[string]uint64)}
+		alertHistoryMap[k] = h
+	}
+	return h
+}
+
+func trackAlertMiles(t *Tenant, msg EdisonMessage) {
+	alertHistoryMutex.Lock()
+	defer alertHistoryMutex.Unlock()
+	h := historyFor(t.key(msg.ID))
+	if msg.Timestamp > h.lastTs {
+		h.lastTs = msg.Timestamp
+	}
+	h.lastMiles = msg.Miles
+	if n := len(h.miles); n == 0 || msg.Timestamp >= h.miles[n-1].ts+alertMilesEvery {
+		h.miles = append(h.miles, milesMark{msg.Timestamp, msg.Miles})
+	}
+	for len(h.miles) > 1 && h.lastTs > h.miles[0].ts+alertHistoryMs {
+		h.miles = h.miles[1:]
+	}
+}
+
+func logAlertEvent(t *Tenant, carId string, ts uint64, event string) {
+	alertHistoryMutex.Lock()
+	defer alertHistoryMutex.Unlock()
+	h := historyFor(t.key(carId))
+	h.events = append(h.events, eventMark{ts, event})
+	for len(h.events) > 0 && ts > h.events[0].ts+alertHistoryMs {
+		h.events = h.events[1:]
+	}
+}
+
+// rate returns the events per 100 miles, and the raw count, over [from, to).
+func (h *alertHistory) rate(event string, from uint64, to uint64) (float64, int) {
+	n := 0
+	for _, e := range h.events {
+		if e.event == event && e.ts >= from && e.ts < to {
+			n++
+		}
+	}
+	miles := h.milesAt(to) - h.milesAt(from)
+	if miles <= 0 {
+		return 0, n
+	}
+	return float64(n) / miles * 100, n
+}
+
+func (h *alertHistory) milesAt(ts uint64) float64 {
+	if ts >= h.lastTs {
+		return h.lastMiles
+	}
+	miles := 0.0
+	for _, m := range h.miles {
+		if m.ts > ts {
+			if miles == 0 {
+				return m.miles
+			}
+			break
+		}
+		miles = m.miles
+	}
+	return miles
+}
+
+// metricValue reports false for a component the tenant no longer has.
+func metricValue(t *Tenant, carId string, metric string, h *alertHistory, windowMs uint64) (float64, bool) {
+	parts := strings.Split(metric, ".")
+	switch {
+	case metric == "lifetime":
+		return lifetimeFor(t, carId).Value, true
+	case metric == "score":
+		return vehicleScore(t, carId), true
+	case parts[0] == "rate":
+		alertHistoryMutex.Lock()
+		defer alertHistoryMutex.Unlock()
+		from := uint64(0)
+		if h.lastTs > windowMs {
+			from = h.lastTs - windowMs
+		}
+		rate, _ := h.rate(parts[1], from, h.lastTs+1)
+		return rate, true
+	}
+	life, found := componentLives(t, carId)[parts[1]]
+	if !found {
+		return 0, false
+	}
+	if parts[2] == "percent" {
+		return life.Percent, true
+	}
+	return life.Remaining, true
+}
+
+func evaluateAlerts() {
+	pruneAlerts(nowMs())
+	for _, t := range tenants {
+		rules := t.currentRules().alerts
+		for _, carId := range t.registry.ids() {
+			evaluateVehicleAlerts(t, carId, rules)
+		}
+	}
+}
+
+func evaluateVehicleAlerts(t *Tenant, carId string, rules []AlertRule) {
+	for _, r := range rules {
+		alertHistoryMutex.Lock()
+		h := historyFor(t.key(carId))
+		now := h.lastTs
+		last, fired := h.lastFired[r.Name]
+		alertHistoryMutex.Unlock()
+		if fired && now-last < r.CooldownMs {
+			continue
+		}
+
+		value, message, hit := checkAlertRule(t, carId, r, h, now)
+		if !hit {
+			continue
+		}
+		alertHistoryMutex.Lock()
+		h.lastFired[r.Name] = now
+		alertHistoryMutex.Unlock()
+		raiseAlert(t, carId, r, value, message, now)
+	}
+}
+
+func checkAlertRule(t *Tenant, carId string, r AlertRule, h *alertHistory, now uint64) (float64, string, bool) {
+	if r.Type == alertThreshold {
+		value, found := metricValue(t, carId, r.Metric, h, r.WindowMs)
+		if !found {
+			return 0, "", false
+		}
+		return value, fmt.Sprintf("%s is %.1f (%s %v)", r.Metric, value, r.Op, r.Threshold), compare(value, r.Op, r.Threshold)
+	}
+
+	if now < 2*r.WindowMs {
+		return 0, "", false
+	}
+	alertHistoryMutex.Lock()
+	current, n := h.rate(r.Event, now-r.WindowMs, now+1)
+	previous, _ := h.rate(r.Event, now-2*r.WindowMs, now-r.WindowMs)
+	alertHistoryMutex.Unlock()
+	if n < r.MinEvents || previous <= 0 || current < r.Factor*previous {
+		return 0, "", false
+	}
+	ratio := current / previous
+	return ratio, fmt.Sprintf("%s per 100 miles rose %.1fx (%.1f to %.1f)", r.Event, ratio, previous, current), true
+}
+
+func compare(value float64, op string, threshold float64) bool {
+	if op == "<" {
+		return value < threshold
+	}
+	return value > threshold
+}
+
+func raiseAlert(t *Tenant, carId string, r AlertRule, value float64, message string, ts uint64) {
+	apmId := t.registry.apmId(carId)
+
+	alertsMutex.Lock()
+	alertSeq++
+	a := &Alert{
+		ID:       alertSeq,
+		Rule:     r.Name,
+		CarID:    carId,
+		ApmID:    apmId,
+		Severity: r.Severity,
+		Message:  message,
+		Value:    value,
+		Ts:       ts,
+		tenant:   t.ID,
+	}
+	alerts = append(alerts, a)
+	pruneAlertsLocked(nowMs())
+	payload, err := json.Marshal(map[string]interface{}{"alert": a})
+	alertsMutex.Unlock()
+	if err != nil {
+		fmt.Println("ERROR: could not marshal alert")
+		return
+	}
+	broadcast(t, string(payload))
+	notifyWebhooks(t, payload)
+}
+
+func pruneAlerts(now uint64) {
+	alertsMutex.Lock()
+	pruneAlertsLocked(now)
+	alertsMutex.Unlock()
+}
+
+// pruneAlertsLocked drops acknowledged alerts older than alertKeepMs, then each
+// tenant's oldest alerts beyond alertsPerTenant. alertsMutex must be held.
+func pruneAlertsLocked(now uint64) {
+	kept := alerts[:0]
+	counts := make(map[string]int)
+	for _, a := range alerts {
+		if a.Acknowledged && now > a.Ts+alertKeepMs {
+			continue
+		}
+		kept = append(kept, a)
+		counts[a.tenant]++
+	}
+	n := len(kept)
+	kept = kept[:0]
+	for _, a := range alerts[:n] {
+		if counts[a.tenant] > alertsPerTenant {
+			counts[a.tenant]--
+			continue
+		}
+		kept = append(kept, a)
+	}
+	for i := len(kept); i < len(alerts); i++ {
+		alerts[i] = nil
+	}
+	alerts = kept
+}
+
+func watchAlerts() {
+	ticker := time.NewTicker(alertInterval)
+	for range ticker.C {
+		evaluateAlerts()
+	}
+}
+
+// listAlerts serves GET /alerts (optionally ?carId=&unacknowledged=true) and
+// POST /alerts/{id}/ack, for the tenant's vehicles only.
+func listAlerts(w http.ResponseWriter, r *http.Request, t *Tenant) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/alerts"), "/"), "/")
+	if len(parts) == 2 && parts[1] == "ack" {
+		ackAlert(w, r, t, parts[0])
+		return
+	}
+	if parts[0] != "" {
+		w.WriteHeader(404)
+		return
+	}
+
+	carId := r.URL.Query().Get("carId")
+	unacked := r.URL.Query().Get("unacknowledged") == "true"
+	alertsMutex.Lock()
+	out := []Alert{}
+	for _, a := range alerts {
+		if (carId == "" || a.CarID == carId) && (!unacked || !a.Acknowledged) && a.tenant == t.ID {
+			out = append(out, *a)
+		}
+	}
+	alertsMutex.Unlock()
+	sort.Sort(alertsByID(out))
+	writeJSON(w, out)
+}
+
+type alertsByID []Alert
+
+func (a alertsByID) Len() int           { return len(a) }
+func (a alertsByID) Less(i, j int) bool { return a[i].ID < a[j].ID }
+func (a alertsByID) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+func ackAlert(w http.ResponseWriter, r *http.Request, t *Tenant, idStr string) {
+	if r.Method != "POST" {
+		w.WriteHeader(405)
+		return
+	}
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	var body struct {
+		By string `json:"by"`
+	}
+	if data, err := ioutil.ReadAll(r.Body); err == nil && len(data) > 0 {
+		if err = json.Unmarshal(data, &body); err != nil {
+			w.WriteHeader(400)
+			return
+		}
+	}
+
+	alertsMutex.Lock()
+	var acked *Alert
+	for _, a := range alerts {
+		if a.ID == id && a.tenant == t.ID {
+			a.Acknowledged = true
+			a.AckBy = body.By
+			a.AckTs = uint64(time.Now().UnixNano() / int64(time.Millisecond))
+			copied := *a
+			acked = &copied
+		}
+	}
+	alertsMutex.Unlock()
+	if acked == nil {
+		w.WriteHeader(404)
+		return
+	}
+	if payload, err := json.Marshal(map[string]interface{}{"alertAck": acked}); err == nil {
+		broadcast(t, string(payload))
+	}
+	writeJSON(w, acked)
+}
+
+func clearAlerts(t *Tenant) {
+	alertHistoryMutex.Lock()
+	for k := range alertHistoryMap {
+		if k.tenant == t.ID {
+			delete(alertHistoryMap, k)
+		}
+	}
+	alertHistoryMutex.Unlock()
+	alertsMutex.Lock()
+	kept := alerts[:0]
+	for _, a := range alerts {
+		if a.tenant != t.ID {
+			kept = append(kept, a)
+		}
+	}
+	for i := len(kept); i < len(alerts); i++ {
+		alerts[i] = nil
+	}
+	alerts = kept
+	alertsMutex.Unlock()
+}
+
+type AlertEvent struct {
+	Ts    uint64 `json:"ts"`
+	Event string `json:"event"`
+}
+
+type AlertMiles struct {
+	Ts    uint64  `json:"ts"`
+	Miles float64 `json:"miles"`
+}
+
+// AlertHistory is what alert rules remember about a vehicle, as kept in a
+// snapshot.
+type AlertHistory struct {
+	Events    []AlertEvent      `json:"events"`
+	Miles     []AlertMiles      `json:"miles"`
+	LastTs    uint64            `json:"lastTs"`
+	LastMiles float64           `json:"lastMiles"`
+	LastFired map[string]uint64 `json:"lastFired"`
+}
+
+func alertHistories(t *Tenant) map[string]AlertHistory {
+	alertHistoryMutex.Lock()
+	defer alertHistoryMutex.Unlock()
+	out := make(map[string]AlertHistory)
+	for k, h := range alertHistoryMap {
+		if k.tenant != t.ID {
+			continue
+		}
+		s := AlertHistory{LastTs: h.lastTs, LastMiles: h.lastMiles, LastFired: make(map[string]uint64)}
+		for _, e := range h.events {
+			s.Events = append(s.Events, AlertEvent{e.ts, e.event})
+		}
+		for _, m := range h.miles {
+			s.Miles = append(s.Miles, AlertMiles{m.ts, m.miles})
+		}
+		for name, ts := range h.lastFired {
+			s.LastFired[name] = ts
+		}
+		out[k.device] = s
+	}
+	return out
+}
+
+func restoreAlertHistories(t *Tenant, histories map[string]AlertHistory) {
+	alertHistoryMutex.Lock()
+	defer alertHistoryMutex.Unlock()
+	for carId, s := range histories {
+		h := &alertHistory{lastTs: s.LastTs, lastMiles: s.LastMiles, lastFired: make(map[string]uint64)}
+		for _, e := range s.Events {
+			h.events = append(h.events, eventMark{e.Ts, e.Event})
+		}
+		for _, m := range s.Miles {
+			h.miles = append(h.miles, milesMark{m.Ts, m.Miles})
+		}
+		for name, ts := range s.LastFired {
+			h.lastFired[name] = ts
+		}
+		alertHistoryMap[t.key(carId)] = h
+	}
+}
+
+func tenantAlerts(t *Tenant) []Alert {
+	alertsMutex.Lock()
+	defer alertsMutex.Unlock()
+	out := []Alert{}
+	for _, a := range alerts {
+		if a.tenant == t.ID {
+			out = append(out, *a)
+		}
+	}
+	return out
+}
+
+// restoreAlerts keeps alerts in ID order, as raiseAlert appends them.
+func restoreAlerts(t *Tenant, restored []Alert) {
+	alertsMutex.Lock()
+	defer alertsMutex.Unlock()
+	for i := range restored {
+		a := restored[i]
+		a.tenant = t.ID
+		alerts = append(alerts, &a)
+	}
+	sort.Sort(alertPtrsByID(alerts))
+}
+
+type alertPtrsByID []*Alert
+
+func (a alertPtrsByID) Len() int           { return len(a) }
+func (a alertPtrsByID) Less(i, j int) bool { return a[i].ID < a[j].ID }
+func (a alertPtrsByID) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+func currentAlertSeq() int {
+	alertsMutex.Lock()
+	defer alertsMutex.Unlock()
+	return alertSeq
+}
+
+func restoreAlertSeq(seq int) {
+	alertsMutex.Lock()
+	alertSeq = seq
+	alertsMutex.Unlock()
+}
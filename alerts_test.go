@@ -0,0 +1,72 @@
+package main
+
+import "testing"
+
+func TestPrepareAlertRulesChecksComponents(t *testing.T) {
+	components := map[string]ComponentConfig{"tires": {Budget: 100}}
+
+	rules, err := prepareAlertRules(nil, components)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range rules {
+		if r.Name == "brakes_low" {
+			t.Fatalf("default rule for brakes should be dropped without a brakes component")
+		}
+	}
+	if len(rules) != len(defaultAlertRules)-1 {
+		t.Fatalf("only the brakes rule should be dropped, got %+v", rules)
+	}
+
+	if _, err := prepareAlertRules([]AlertRule{{Name: "tires_low", Type: alertThreshold, Metric: "component.tires.percent", Op: "<", Threshold: 10}}, components); err != nil {
+		t.Fatalf("rule for a configured component: %v", err)
+	}
+	if _, err := prepareAlertRules([]AlertRule{{Name: "brakes_low", Type: alertThreshold, Metric: "component.brakes.percent", Op: "<", Threshold: 10}}, components); err == nil {
+		t.Fatalf("explicit rule for an unknown component should be refused")
+	}
+}
+
+func TestMetricValueSkipsMissingComponent(t *testing.T) {
+	tenant := newTenant(&Tenant{ID: "alerts-missing"})
+	h := &alertHistory{lastFired: make(map[string]uint64)}
+	if _, found := metricValue(tenant, "car1", "component.brakes.percent", h, weekMs); !found {
+		t.Fatalf("brakes is a default component")
+	}
+	if _, found := metricValue(tenant, "car1", "component.wipers.percent", h, weekMs); found {
+		t.Fatalf("wipers is not a component")
+	}
+	r := AlertRule{Name: "wipers_low", Type: alertThreshold, Metric: "component.wipers.percent", Op: "<", Threshold: 10}
+	if _, _, hit := checkAlertRule(tenant, "car1", r, h, 0); hit {
+		t.Fatalf("a rule for a missing component should not fire")
+	}
+}
+
+func TestPruneAlerts(t *testing.T) {
+	saved := alerts
+	defer func() { alerts = saved }()
+
+	now := uint64(alertKeepMs + 1000)
+	alerts = []*Alert{
+		{ID: 1, tenant: "a", Ts: 0, Acknowledged: true},
+		{ID: 2, tenant: "a", Ts: 0},
+		{ID: 3, tenant: "a", Ts: now, Acknowledged: true},
+	}
+	for i := 0; i < alertsPerTenant; i++ {
+		alerts = append(alerts, &Alert{ID: 4 + i, tenant: "b", Ts: now})
+	}
+	alerts = append(alerts, &Alert{ID: 4 + alertsPerTenant, tenant: "b", Ts: now})
+
+	pruneAlerts(now)
+	counts := make(map[string]int)
+	ids := make(map[int]bool)
+	for _, a := range alerts {
+		counts[a.tenant]++
+		ids[a.ID] = true
+	}
+	if ids[1] || !ids[2] || !ids[3] {
+		t.Fatalf("only the old acknowledged alert should go, kept 1:%v 2:%v 3:%v", ids[1], ids[2], ids[3])
+	}
+	if counts["b"] != alertsPerTenant || ids[4] || !ids[4+alertsPerTenant] {
+		t.Fatalf("tenant b should keep its newest %d alerts, kept %d", alertsPerTenant, counts["b"])
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+)
+
+// The anomaly detector learns each vehicle's own baseline as an exponentially
+// weighted mean and variance per axis, and flags readings that sit more than
+// Sigma standard deviations away from it. Flagged readings are kept out of the
+// baseline so a burst of anomalies does not drag it along.
+
+const anomalyEvent = "anomaly"
+
+type AnomalyConfig struct {
+	Enabled    bool    `json:"enabled"`
+	Sigma      float64 `json:"sigma"`
+	Alpha      float64 `json:"alpha"`
+	Warmup     int     `json:"warmup"`
+	MinStdDev  float64 `json:"minStdDev"`
+	CooldownMs uint64  `json:"cooldownMs"`
+	Tag        string  `json:"tag"`
+}
+
+type anomalyStats struct {
+	samples   int
+	mean      vec3
+	variance  vec3
+	lastFired uint64
+}
+
+var (
+	defaultAnomalyConfig = AnomalyConfig{
+		Sigma:      4,
+		Alpha:      0.01,
+		Warmup:     200,
+		MinStdDev:  0.02,
+		CooldownMs: 5000,
+		Tag:        "Tag_Anomaly_1",
+	}
+
+	anomalyMap      = make(map[vehicleKey]*anomalyStats)
+	anomalyMapMutex = &sync.Mutex{}
+)
+
+func prepareAnomalyConfig(config *AnomalyConfig) (AnomalyConfig, error) {
+	if config == nil {
+		return defaultAnomalyConfig, nil
+	}
+	c := *config
+	if c.Sigma <= 0 {
+		return c, fmt.Errorf("anomaly sigma must be positive")
+	}
+	if c.Alpha <= 0 || c.Alpha >= 1 {
+		return c, fmt.Errorf("anomaly alpha must be between 0 and 1")
+	}
+	if c.Tag == "" {
+		c.Tag = defaultAnomalyConfig.Tag
+	}
+	return c, nil
+}
+
+func anomalyTag(t *Tenant) string {
+	return t.currentRules().anomaly.Tag
+}
+
+// detectAnomaly updates the vehicle's baseline and reports the largest
+// per-axis deviation, in standard deviations, when it is anomalous.
+func detectAnomaly(t *Tenant, msg EdisonMessage) (float64, bool) {
+	config := t.currentRules().anomaly
+	if !config.Enabled {
+		return 0, false
+	}
+
+	anomalyMapMutex.Lock()
+	defer anomalyMapMutex.Unlock()
+	s, found := anomalyMap[t.key(msg.ID)]
+	if !found {
+		s = &anomalyStats{}
+		anomalyMap[t.key(msg.ID)] = s
+	}
+
+	v := vec3{msg.X, msg.Y, msg.Z}
+	if s.samples == 0 {
+		s.mean = v
+		s.samples++
+		return 0, false
+	}
+
+	score := 0.0
+	for k := range v {
+		std := math.Max(math.Sqrt(s.variance[k]), config.MinStdDev)
+		score = math.Max(score, math.Abs(v[k]-s.mean[k])/std)
+	}
+
+	if s.samples >= config.Warmup && score > config.Sigma {
+		if s.lastFired != 0 && msg.Timestamp < s.lastFired+config.CooldownMs {
+			return 0, false
+		}
+		s.lastFired = msg.Timestamp
+		return score, true
+	}
+
+	s.samples++
+	for k := range v {
+		d := v[k] - s.mean[k]
+		s.mean[k] += config.Alpha * d
+		s.variance[k] = (1 - config.Alpha) * (s.variance[k] + config.Alpha*d*d)
+	}
+	return 0, false
+}
+
+func clearAnomalies(t *Tenant) {
+	anomalyMapMutex.Lock()
+	for k := range anomalyMap {
+		if k.tenant == t.ID {
+			delete(anomalyMap, k)
+		}
+	}
+	anomalyMapMutex.Unlock()
+}
+
+type AnomalyBaseline struct {
+	Samples   int    `json:"samples"`
+	Mean      vec3   `json:"mean"`
+	Variance  vec3   `json:"variance"`
+	LastFired uint64 `json:"lastFired"`
+}
+
+func anomalyBaselines(t *Tenant) map[string]AnomalyBaseline {
+	anomalyMapMutex.Lock()
+	defer anomalyMapMutex.Unlock()
+	out := make(map[string]AnomalyBaseline)
+	for k, s := range anomalyMap {
+		if k.tenant == t.ID {
+			out[k.device] = AnomalyBaseline{s.samples, s.mean, s.variance, s.lastFired}
+		}
+	}
+	return out
+}
+
+func restoreAnomalies(t *Tenant, baselines map[string]AnomalyBaseline) {
+	anomalyMapMutex.Lock()
+	defer anomalyMapMutex.Unlock()
+	for carId, b := range baselines {
+		anomalyMap[t.key(carId)] = &anomalyStats{b.Samples, b.Mean, b.Variance, b.LastFired}
+	}
+}
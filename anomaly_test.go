@@ -0,0 +1,94 @@
+package main
+
+import "testing"
+
+func anomalyTenant(t *testing.T, id string) *Tenant {
+	tenant := newTenant(&Tenant{ID: id})
+	rules, err := compileRules(RuleConfig{Anomaly: &AnomalyConfig{
+		Enabled:    true,
+		Sigma:      4,
+		Alpha:      0.1,
+		Warmup:     20,
+		MinStdDev:  0.05,
+		CooldownMs: 5000,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenant.setRules(rules)
+	return tenant
+}
+
+// warmUp feeds n readings alternating around zero from ts, so the baseline
+// settles with a small spread.
+func warmUp(tenant *Tenant, ts uint64, n int) uint64 {
+	for i := 0; i < n; i++ {
+		x := 0.01
+		if i%2 == 1 {
+			x = -0.01
+		}
+		detectAnomaly(tenant, EdisonMessage{ID: "car1", Timestamp: ts, X: x})
+		ts += 100
+	}
+	return ts
+}
+
+func spike(tenant *Tenant, ts uint64, x float64) bool {
+	_, fired := detectAnomaly(tenant, EdisonMessage{ID: "car1", Timestamp: ts, X: x})
+	return fired
+}
+
+func TestAnomalyWaitsForWarmup(t *testing.T) {
+	tenant := anomalyTenant(t, "anomaly-warmup")
+	defer clearAnomalies(tenant)
+
+	ts := warmUp(tenant, 1000, 10)
+	if spike(tenant, ts, 5) {
+		t.Fatalf("a spike during warmup should not fire")
+	}
+	ts = warmUp(tenant, ts+100, 40)
+	if !spike(tenant, ts, 5) {
+		t.Fatalf("a spike after warmup should fire")
+	}
+}
+
+func TestAnomalyThreshold(t *testing.T) {
+	tenant := anomalyTenant(t, "anomaly-threshold")
+	defer clearAnomalies(tenant)
+
+	// The spread is below MinStdDev, so Sigma 4 puts the threshold at 0.2.
+	ts := warmUp(tenant, 1000, 100)
+	if spike(tenant, ts, 0.15) {
+		t.Fatalf("a reading inside the threshold should not fire")
+	}
+	score, fired := detectAnomaly(tenant, EdisonMessage{ID: "car1", Timestamp: ts + 100, X: 0.3})
+	if !fired || score <= 4 {
+		t.Fatalf("a reading past the threshold should fire, got %v %v", score, fired)
+	}
+
+	// The flagged reading stays out of the baseline.
+	before := anomalyBaselines(tenant)["car1"]
+	spike(tenant, ts+10000, 5)
+	if after := anomalyBaselines(tenant)["car1"]; after.Mean != before.Mean || after.Samples != before.Samples {
+		t.Fatalf("an anomaly moved the baseline from %+v to %+v", before, after)
+	}
+}
+
+func TestAnomalyCooldown(t *testing.T) {
+	tenant := anomalyTenant(t, "anomaly-cooldown")
+	defer clearAnomalies(tenant)
+
+	ts := warmUp(tenant, 1000, 100)
+	if !spike(tenant, ts, 5) {
+		t.Fatalf("the first spike should fire")
+	}
+	if spike(tenant, ts+4999, 5) {
+		t.Fatalf("a spike inside the cooldown should not fire")
+	}
+	if spike(tenant, ts-1000, 5) {
+		t.Fatalf("a late spike should not fire again")
+	}
+	if !spike(tenant, ts+5000, 5) {
+		t.Fatalf("a spike after the cooldown should fire")
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// The asset pool comes from the "assets" section of the rules file, as a list
+// of IDs, a file with one ID per line, or both. Vehicles are bound to the
+// first free asset when they first report and keep that binding across /clear
+// and restarts until it is explicitly unbound or moved. A vehicle that reports
+// while the pool is exhausted joins a queue and gets the next asset to free up.
+
+type AssetConfig struct {
+	IDs  []string `json:"ids,omitempty"`
+	File string   `json:"file,omitempty"`
+}
+
+type AssetBinding struct {
+	ApmID string `json:"apmId"`
+	CarID string `json:"carId"`
+	Name  string `json:"name,omitempty"`
+}
+
+type AssetPool struct {
+	Assets       []AssetBinding `json:"assets"`
+	Unconfigured []AssetBinding `json:"unconfigured"`
+	Free         int            `json:"free"`
+	Waiting      []string       `json:"waiting"`
+}
+
+type assetRequest struct {
+	CarID string `json:"carId"`
+	ApmID string `json:"apmId"`
+}
+
+var (
+	defaultAssetIds       = []string{"320I-UID1", "320I-UID2", "320I-UID3", "320I-UID4", "320I-UID5", "320I-UID6", "320I-UID7", "320I-UID8", "320I-UID9", "320I-UID10", "320I-UID11", "320I-UID12"}
+	errAssetPoolExhausted = errors.New("asset pool exhausted")
+)
+
+func prepareAssetConfig(config *AssetConfig) ([]string, error) {
+	if config == nil {
+		return defaultAssetIds, nil
+	}
+	ids := append([]string(nil), config.IDs...)
+	if config.File != "" {
+		data, err := ioutil.ReadFile(config.File)
+		if err != nil {
+			return nil, fmt.Errorf("asset file: %v", err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				ids = append(ids, line)
+			}
+		}
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("asset pool is empty")
+	}
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		if strings.TrimSpace(id) == "" {
+			return nil, fmt.Errorf("asset IDs cannot be blank")
+		}
+		if seen[id] {
+			return nil, fmt.Errorf("asset %q is listed twice", id)
+		}
+		seen[id] = true
+	}
+	return ids, nil
+}
+
+// The methods below ending in Locked expect r.mu to be held for writing.
+
+func (r *VehicleRegistry) nextFreeLocked() string {
+	for _, asset := range r.assets {
+		if _, taken := r.owners[asset]; !taken {
+			return asset
+		}
+	}
+	return ""
+}
+
+func (r *VehicleRegistry) setApmIdLocked(device string, asset string) {
+	if rec := r.vehicles[device]; rec != nil {
+		rec.mu.Lock()
+		rec.v.ApmID = asset
+		rec.mu.Unlock()
+	}
+}
+
+func (r *VehicleRegistry) bindLocked(device string, asset string) {
+	r.bindings[device] = asset
+	r.owners[asset] = device
+	r.dequeueLocked(device)
+	r.setApmIdLocked(device, asset)
+}
+
+func (r *VehicleRegistry) unbindLocked(device string) string {
+	asset := r.bindings[device]
+	delete(r.bindings, device)
+	delete(r.owners, asset)
+	r.setApmIdLocked(device, "")
+	return asset
+}
+
+func (r *VehicleRegistry) dequeueLocked(device string) bool {
+	for i, id := range r.waiting {
+		if id == device {
+			r.waiting = append(r.waiting[:i], r.waiting[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// assignLocked binds a vehicle to the next free asset, or queues it.
+func (r *VehicleRegistry) assignLocked(device string) error {
+	asset := r.nextFreeLocked()
+	if asset == "" {
+		r.dequeueLocked(device)
+		r.waiting = append(r.waiting, device)
+		return errAssetPoolExhausted
+	}
+	r.bindLocked(device, asset)
+	return nil
+}
+
+func (r *VehicleRegistry) drainWaitingLocked() {
+	for len(r.waiting) > 0 {
+		asset := r.nextFreeLocked()
+		if asset == "" {
+			return
+		}
+		device := r.waiting[0]
+		r.bindLocked(device, asset)
+		fmt.Printf("bound waiting vehicle %s to %s\n", device, asset)
+	}
+}
+
+func (r *VehicleRegistry) knownAssetLocked(asset string) bool {
+	for _, a := range r.assets {
+		if a == asset {
+			return true
+		}
+	}
+	return false
+}
+
+// setAssets replaces the configured pool. Existing bindings are kept even when
+// their asset is no longer configured, so nothing moves under a vehicle
+// without an explicit rebind.
+func (r *VehicleRegistry) setAssets(ids []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.assets = append([]string(nil), ids...)
+	for asset, device := range r.owners {
+		if !r.knownAssetLocked(asset) {
+			fmt.Printf("ERROR: asset %s bound to %s is no longer in the pool\n", asset, device)
+		}
+	}
+	r.drainWaitingLocked()
+}
+
+// reconcileAssets replaces the pool with a synced catalogue. Unlike setAssets
+// it moves vehicles off assets the catalogue no longer has, onto a free asset
+// or to the back of the queue, once waiting vehicles have been served. It
+// reports whether any binding changed.
+func (r *VehicleRegistry) reconcileAssets(ids []string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.assets = append([]string(nil), ids...)
+	changed := len(r.waiting) > 0
+	r.drainWaitingLocked()
+	for _, device := range sortedKeys(r.bindings) {
+		asset := r.bindings[device]
+		if r.knownAssetLocked(asset) {
+			continue
+		}
+		changed = true
+		r.unbindLocked(device)
+		if err := r.assignLocked(device); err != nil {
+			fmt.Printf("ERROR: asset %s bound to %s is gone from the catalogue, %v, %s is waiting\n", asset, device, err, device)
+		} else {
+			fmt.Printf("asset %s bound to %s is gone from the catalogue, moved it to %s\n", asset, device, r.bindings[device])
+		}
+	}
+	return changed
+}
+
+// bind binds an unbound vehicle to the given asset, or to the next free one
+// when asset is empty. A vehicle that cannot get an asset is queued.
+func (r *VehicleRegistry) bind(device string, asset string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if current, bound := r.bindings[device]; bound {
+		return current, fmt.Errorf("%s is already bound to %s, rebind it instead", device, current)
+	}
+	if asset == "" {
+		if err := r.assignLocked(device); err != nil {
+			return "", fmt.Errorf("%v, %s is waiting at position %d", err, device, len(r.waiting))
+		}
+		return r.bindings[device], nil
+	}
+	if err := r.checkAssetLocked(asset); err != nil {
+		return "", err
+	}
+	r.bindLocked(device, asset)
+	return asset, nil
+}
+
+func (r *VehicleRegistry) checkAssetLocked(asset string) error {
+	if !r.knownAssetLocked(asset) {
+		return fmt.Errorf("asset %s is not in the pool", asset)
+	}
+	if owner, taken := r.owners[asset]; taken {
+		return fmt.Errorf("asset %s is bound to %s", asset, owner)
+	}
+	return nil
+}
+
+// unbind frees a vehicle's asset, handing it to the first waiting vehicle, or
+// takes the vehicle out of the waiting queue.
+func (r *VehicleRegistry) unbind(device string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, bound := r.bindings[device]; !bound {
+		if r.dequeueLocked(device) {
+			return "", nil
+		}
+		return "", fmt.Errorf("%s is not bound", device)
+	}
+	asset := r.unbindLocked(device)
+	r.drainWaitingLocked()
+	return asset, nil
+}
+
+// rebind moves a bound vehicle to another asset, or to the next free one when
+// asset is empty. Its old asset goes to the first waiting vehicle.
+func (r *VehicleRegistry) rebind(device string, asset string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	current, bound := r.bindings[device]
+	if !bound {
+		return "", fmt.Errorf("%s is not bound, bind it instead", device)
+	}
+	if asset == current {
+		return current, nil
+	}
+	if asset == "" {
+		if asset = r.nextFreeLocked(); asset == "" {
+			return current, errAssetPoolExhausted
+		}
+	} else if err := r.checkAssetLocked(asset); err != nil {
+		return current, err
+	}
+	r.unbindLocked(device)
+	r.bindLocked(device, asset)
+	r.drainWaitingLocked()
+	return asset, nil
+}
+
+func (r *VehicleRegistry) pool() AssetPool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	p := AssetPool{
+		Assets:       []AssetBinding{},
+		Unconfigured: []AssetBinding{},
+		Waiting:      append([]string{}, r.waiting...),
+	}
+	for _, asset := range r.assets {
+		p.Assets = append(p.Assets, AssetBinding{ApmID: asset, CarID: r.owners[asset]})
+		if r.owners[asset] == "" {
+			p.Free++
+		}
+	}
+	for _, device := range sortedKeys(r.bindings) {
+		if asset := r.bindings[device]; !r.knownAssetLocked(asset) {
+			p.Unconfigured = append(p.Unconfigured, AssetBinding{ApmID: asset, CarID: device})
+		}
+	}
+	return p
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// namedPool is the tenant's pool with names from its asset catalogue.
+func (t *Tenant) namedPool() AssetPool {
+	p := t.registry.pool()
+	for i := range p.Assets {
+		if a, found := t.catalogAsset(p.Assets[i].ApmID); found {
+			p.Assets[i].Name = a.Name
+		}
+	}
+	return p
+}
+
+// assets serves GET /assets, GET /assets/catalog, POST /assets/sync and
+// POST /assets/{bind,unbind,rebind} with a {"carId", "apmId"} body.
+func assets(w http.ResponseWriter, r *http.Request, t *Tenant) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/assets"), "/")
+	switch action {
+	case "":
+		writeJSON(w, t.namedPool())
+		return
+	case "catalog":
+		writeJSON(w, t.currentCatalog())
+		return
+	}
+	if r.Method != "POST" {
+		w.WriteHeader(405)
+		return
+	}
+	if action == "sync" {
+		if t.AssetServiceURL == "" {
+			w.WriteHeader(409)
+			io.WriteString(w, "no asset service configured")
+			return
+		}
+		if err := t.syncAssets(); err != nil {
+			w.WriteHeader(502)
+			io.WriteString(w, err.Error())
+			return
+		}
+		writeJSON(w, t.namedPool())
+		return
+	}
+
+	var req assetRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &req)
+	}
+	if err != nil || req.CarID == "" {
+		w.WriteHeader(400)
+		io.WriteString(w, "body must be {\"carId\": ..., \"apmId\": ...}")
+		return
+	}
+	var asset string
+	switch action {
+	case "bind":
+		asset, err = t.registry.bind(req.CarID, req.ApmID)
+	case "unbind":
+		asset, err = t.registry.unbind(req.CarID)
+	case "rebind":
+		asset, err = t.registry.rebind(req.CarID, req.ApmID)
+	default:
+		w.WriteHeader(404)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(409)
+		io.WriteString(w, err.Error())
+		return
+	}
+	if err = saveSnapshot(); err != nil {
+		fmt.Println("ERROR: could not save snapshot after asset change:", err)
+	}
+	writeJSON(w, AssetBinding{ApmID: asset, CarID: req.CarID})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func observeAll(r *VehicleRegistry, ids ...string) []error {
+	var errs []error
+	for _, id := range ids {
+		errs = append(errs, r.observe(EdisonMessage{ID: id, Timestamp: 1}))
+	}
+	return errs
+}
+
+func TestObserveQueuesWhenPoolIsExhausted(t *testing.T) {
+	r := newVehicleRegistry([]string{"A1", "A2"})
+	errs := observeAll(r, "car1", "car2", "car3")
+	if errs[0] != nil || errs[1] != nil {
+		t.Fatalf("first two vehicles should be bound, got %v", errs)
+	}
+	if errs[2] != errAssetPoolExhausted {
+		t.Fatalf("third vehicle should be queued, got %v", errs[2])
+	}
+	if err := r.observe(EdisonMessage{ID: "car3", Timestamp: 2}); err != errAssetPoolExhausted {
+		t.Fatalf("queued vehicle should keep reporting exhaustion, got %v", err)
+	}
+	p := r.pool()
+	if p.Free != 0 || !reflect.DeepEqual(p.Waiting, []string{"car3"}) {
+		t.Fatalf("unexpected pool %+v", p)
+	}
+	if r.apmId("car1") != "A1" || r.apmId("car2") != "A2" || r.apmId("car3") != "" {
+		t.Fatalf("unexpected bindings %q %q %q", r.apmId("car1"), r.apmId("car2"), r.apmId("car3"))
+	}
+}
+
+func TestUnbindHandsAssetToWaitingVehicle(t *testing.T) {
+	r := newVehicleRegistry([]string{"A1"})
+	observeAll(r, "car1", "car2", "car3")
+
+	asset, err := r.unbind("car1")
+	if err != nil || asset != "A1" {
+		t.Fatalf("unbind car1: %q %v", asset, err)
+	}
+	if r.apmId("car2") != "A1" || r.apmId("car1") != "" {
+		t.Fatalf("A1 should have gone to car2, car1=%q car2=%q", r.apmId("car1"), r.apmId("car2"))
+	}
+	if err := r.observe(EdisonMessage{ID: "car2", Timestamp: 2}); err != nil {
+		t.Fatalf("car2 is bound now, got %v", err)
+	}
+	if p := r.pool(); !reflect.DeepEqual(p.Waiting, []string{"car3"}) {
+		t.Fatalf("car3 should still be waiting, got %v", p.Waiting)
+	}
+
+	if _, err := r.unbind("car3"); err != nil {
+		t.Fatalf("unbind of a waiting vehicle should dequeue it, got %v", err)
+	}
+	if p := r.pool(); len(p.Waiting) != 0 {
+		t.Fatalf("queue should be empty, got %v", p.Waiting)
+	}
+	if _, err := r.unbind("car3"); err == nil {
+		t.Fatalf("unbind of an unknown binding should fail")
+	}
+}
+
+func TestBind(t *testing.T) {
+	r := newVehicleRegistry([]string{"A1", "A2"})
+	observeAll(r, "car1")
+
+	if _, err := r.bind("car1", ""); err == nil {
+		t.Fatalf("bind of a bound vehicle should fail")
+	}
+	if _, err := r.bind("car2", "A1"); err == nil {
+		t.Fatalf("bind to a taken asset should fail")
+	}
+	if _, err := r.bind("car2", "B9"); err == nil {
+		t.Fatalf("bind to an unknown asset should fail")
+	}
+	if asset, err := r.bind("car2", ""); err != nil || asset != "A2" {
+		t.Fatalf("bind car2: %q %v", asset, err)
+	}
+	if _, err := r.bind("car3", ""); err == nil {
+		t.Fatalf("bind with no free asset should fail")
+	}
+	if p := r.pool(); !reflect.DeepEqual(p.Waiting, []string{"car3"}) {
+		t.Fatalf("car3 should be waiting, got %v", p.Waiting)
+	}
+}
+
+func TestRebind(t *testing.T) {
+	r := newVehicleRegistry([]string{"A1", "A2", "A3"})
+	observeAll(r, "car1", "car2")
+
+	if asset, err := r.rebind("car1", ""); err != nil || asset != "A3" {
+		t.Fatalf("rebind car1 to the next free asset: %q %v", asset, err)
+	}
+	if asset, err := r.rebind("car2", "A3"); err == nil {
+		t.Fatalf("rebind to a taken asset should fail, got %q", asset)
+	}
+	if asset, err := r.rebind("car2", "A1"); err != nil || asset != "A1" {
+		t.Fatalf("rebind car2 to the freed A1: %q %v", asset, err)
+	}
+	if asset, err := r.rebind("car2", "A1"); err != nil || asset != "A1" {
+		t.Fatalf("rebind to the current asset is a no-op: %q %v", asset, err)
+	}
+	if _, err := r.rebind("car3", ""); err == nil {
+		t.Fatalf("rebind of an unbound vehicle should fail")
+	}
+
+	// A2 was freed by the moves; the next two vehicles take it and queue.
+	errs := observeAll(r, "car3", "car4")
+	if errs[0] != nil || r.apmId("car3") != "A2" || errs[1] != errAssetPoolExhausted {
+		t.Fatalf("car3 should take A2 and car4 queue: %v %q", errs, r.apmId("car3"))
+	}
+	if asset, err := r.rebind("car1", ""); err != errAssetPoolExhausted || asset != "A3" {
+		t.Fatalf("rebind with no free asset should keep A3: %q %v", asset, err)
+	}
+
+	// Growing the pool serves the queue before anything else.
+	r.setAssets([]string{"A1", "A2", "A3", "A4"})
+	if r.apmId("car4") != "A4" {
+		t.Fatalf("car4 should take A4, got %q", r.apmId("car4"))
+	}
+	if err := r.observe(EdisonMessage{ID: "car4", Timestamp: 2}); err != nil {
+		t.Fatalf("car4 is bound now, got %v", err)
+	}
+}
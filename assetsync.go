@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A tenant with an asset service URL (ASSET_SERVICE_URL for the default
+// tenant) pulls its asset catalogue from that APM-style service on startup
+// and every ASSET_SYNC_INTERVAL, and it replaces the pool from the rules file.
+// The service answers GET with a JSON array of assets, or a page holding them
+// in "content"; pages are followed with ?page=N until one says it is the last,
+// through "last" or "totalPages" with "number" (or "page"). Each asset's
+// sourceKey is the ID vehicles are bound to. Until the first sync succeeds the
+// configured pool is used.
+//
+// FAKE_ASSET_SERVICE=<addr> starts a stand-in service on that address for
+// tests. It serves FAKE_ASSET_FILE, or the default pool, on /assets, and a PUT
+// there replaces what it serves.
+
+type Asset struct {
+	SourceKey   string                 `json:"sourceKey"`
+	Name        string                 `json:"name,omitempty"`
+	Description string                 `json:"description,omitempty"`
+	URI         string                 `json:"uri,omitempty"`
+	Attributes  map[string]interface{} `json:"attributes,omitempty"`
+}
+
+type AssetCatalog struct {
+	Source   string  `json:"source"`
+	SyncedAt int64   `json:"syncedAt"`
+	Error    string  `json:"error,omitempty"`
+	Assets   []Asset `json:"assets"`
+}
+
+var (
+	assetSyncInterval = envDuration("ASSET_SYNC_INTERVAL", 5*time.Minute)
+	assetClient       = &http.Client{Timeout: 10 * time.Second}
+
+	fakeAssets      []Asset
+	fakeAssetsMutex = &sync.Mutex{}
+)
+
+const assetMaxPages = 1000
+
+// assetPage is one page of a paged catalogue. The paging fields are pointers
+// so a service that leaves them out is read as serving a single page.
+type assetPage struct {
+	Content    []Asset `json:"content"`
+	Last       *bool   `json:"last"`
+	TotalPages *int    `json:"totalPages"`
+	Number     *int    `json:"number"`
+	Page       *int    `json:"page"`
+}
+
+func (p assetPage) more() bool {
+	if p.Last != nil {
+		return !*p.Last
+	}
+	number := p.Number
+	if number == nil {
+		number = p.Page
+	}
+	return p.TotalPages != nil && number != nil && *number+1 < *p.TotalPages
+}
+
+// fetchAssets reads every page of the catalogue. Any page failing fails the
+// whole sync, so a partial catalogue is never reconciled against.
+func fetchAssets(t *Tenant) ([]Asset, error) {
+	var assets []Asset
+	for page := 0; page < assetMaxPages; page++ {
+		body, err := fetchAssetPage(t, page)
+		if err != nil {
+			return nil, err
+		}
+		content, more, err := parseAssetPage(body)
+		if err != nil {
+			return nil, err
+		}
+		assets = append(assets, content...)
+		if !more {
+			return checkAssets(assets)
+		}
+		if len(content) == 0 {
+			return nil, fmt.Errorf("asset page %d is empty but not the last", page)
+		}
+	}
+	return nil, fmt.Errorf("asset catalogue runs past %d pages", assetMaxPages)
+}
+
+func fetchAssetPage(t *Tenant, page int) ([]byte, error) {
+	u, err := url.Parse(t.AssetServiceURL)
+	if err != nil {
+		return nil, err
+	}
+	if page > 0 {
+		q := u.Query()
+		q.Set("page", strconv.Itoa(page))
+		u.RawQuery = q.Encode()
+	}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("authorization", t.Token)
+	req.Header.Add("tenant", t.APMTenant)
+	req.Header.Add("accept", "application/json")
+
+	res, err := assetClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode > 299 {
+		return nil, fmt.Errorf("bad status code %d", res.StatusCode)
+	}
+	return body, nil
+}
+
+// parseAssetPage reads a plain array of assets or one page of them, and
+// reports whether more pages follow.
+func parseAssetPage(body []byte) ([]Asset, bool, error) {
+	var assets []Asset
+	err := json.Unmarshal(body, &assets)
+	if err == nil {
+		return assets, false, nil
+	}
+	var page assetPage
+	if json.Unmarshal(body, &page) != nil {
+		return nil, false, fmt.Errorf("could not parse assets: %v", err)
+	}
+	return page.Content, page.more(), nil
+}
+
+func parseAssets(body []byte) ([]Asset, error) {
+	assets, more, err := parseAssetPage(body)
+	if err != nil {
+		return nil, err
+	}
+	if more {
+		return nil, fmt.Errorf("assets are paged, only one page given")
+	}
+	return checkAssets(assets)
+}
+
+func checkAssets(assets []Asset) ([]Asset, error) {
+	if len(assets) == 0 {
+		return nil, fmt.Errorf("no assets returned")
+	}
+	seen := make(map[string]bool)
+	for _, a := range assets {
+		if a.SourceKey == "" {
+			return nil, fmt.Errorf("asset %q has no sourceKey", a.URI)
+		}
+		if seen[a.SourceKey] {
+			return nil, fmt.Errorf("asset %q is listed twice", a.SourceKey)
+		}
+		seen[a.SourceKey] = true
+	}
+	return assets, nil
+}
+
+// syncAssets pulls the catalogue and reconciles the pool against it. A failed
+// sync keeps the previous catalogue.
+func (t *Tenant) syncAssets() error {
+	assets, err := fetchAssets(t)
+	t.catalogMutex.Lock()
+	if err != nil {
+		t.catalog.Error = err.Error()
+		t.catalogMutex.Unlock()
+		return err
+	}
+	t.catalog = AssetCatalog{Source: t.AssetServiceURL, SyncedAt: time.Now().Unix() * 1000, Assets: assets}
+	t.catalogMutex.Unlock()
+
+	ids := make([]string, len(assets))
+	for i, a := range assets {
+		ids[i] = a.SourceKey
+	}
+	if t.registry.reconcileAssets(ids) {
+		if err := saveSnapshot(); err != nil {
+			fmt.Println("ERROR: could not save snapshot after asset sync:", err)
+		}
+	}
+	fmt.Printf("synced %d assets for %s from %s\n", len(assets), t.ID, t.AssetServiceURL)
+	return nil
+}
+
+// syncAllAssets syncs every tenant that has an asset service.
+func syncAllAssets() {
+	for _, t := range tenants {
+		if t.AssetServiceURL == "" {
+			continue
+		}
+		if err := t.syncAssets(); err != nil {
+			fmt.Printf("ERROR: could not sync assets for %s: %v\n", t.ID, err)
+		}
+	}
+}
+
+func syncAssetsPeriodically() {
+	for range time.Tick(assetSyncInterval) {
+		syncAllAssets()
+	}
+}
+
+// catalogSynced reports whether the pool comes from the asset service, in
+// which case the rules file no longer sets it.
+func (t *Tenant) catalogSynced() bool {
+	t.catalogMutex.RLock()
+	defer t.catalogMutex.RUnlock()
+	return t.catalog.SyncedAt > 0
+}
+
+func (t *Tenant) currentCatalog() AssetCatalog {
+	t.catalogMutex.RLock()
+	defer t.catalogMutex.RUnlock()
+	return t.catalog
+}
+
+func (t *Tenant) catalogAsset(id string) (Asset, bool) {
+	t.catalogMutex.RLock()
+	defer t.catalogMutex.RUnlock()
+	for _, a := range t.catalog.Assets {
+		if a.SourceKey == id {
+			return a, true
+		}
+	}
+	return Asset{}, false
+}
+
+// startFakeAssets listens before returning so a sync straight after it
+// finds the fake service up.
+func startFakeAssets(addr string) error {
+	fakeAssets = make([]Asset, len(defaultAssetIds))
+	for i, id := range defaultAssetIds {
+		fakeAssets[i] = Asset{SourceKey: id, Name: id, URI: "/assets/" + id}
+	}
+	if file := os.Getenv("FAKE_ASSET_FILE"); file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err == nil {
+			fakeAssets, err = parseAssets(data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/assets", fakeAssetService)
+	fmt.Println("serving fake asset service on", listener.Addr())
+	go http.Serve(listener, mux)
+	return nil
+}
+
+func fakeAssetService(w http.ResponseWriter, r *http.Request) {
+	fakeAssetsMutex.Lock()
+	defer fakeAssetsMutex.Unlock()
+	if r.Method == "PUT" {
+		body, err := ioutil.ReadAll(r.Body)
+		var assets []Asset
+		if err == nil {
+			assets, err = parseAssets(body)
+		}
+		if err != nil {
+			w.WriteHeader(400)
+			io.WriteString(w, err.Error())
+			return
+		}
+		fakeAssets = assets
+	}
+	writeJSON(w, fakeAssets)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func fakeAssetServer(assets ...string) *httptest.Server {
+	fakeAssetsMutex.Lock()
+	fakeAssets = nil
+	for _, id := range assets {
+		fakeAssets = append(fakeAssets, Asset{SourceKey: id, Name: "name " + id})
+	}
+	fakeAssetsMutex.Unlock()
+	return httptest.NewServer(http.HandlerFunc(fakeAssetService))
+}
+
+func catalogIds(c AssetCatalog) []string {
+	var ids []string
+	for _, a := range c.Assets {
+		ids = append(ids, a.SourceKey)
+	}
+	return ids
+}
+
+func TestSyncAssetsReplacesPool(t *testing.T) {
+	srv := fakeAssetServer("S1", "S2")
+	defer srv.Close()
+	tenant := newTenant(&Tenant{ID: "sync", AssetServiceURL: srv.URL})
+
+	if tenant.catalogSynced() {
+		t.Fatalf("a new tenant should not be synced")
+	}
+	if err := tenant.syncAssets(); err != nil {
+		t.Fatal(err)
+	}
+	if !tenant.catalogSynced() {
+		t.Fatalf("tenant should be synced")
+	}
+	if ids := catalogIds(tenant.currentCatalog()); !reflect.DeepEqual(ids, []string{"S1", "S2"}) {
+		t.Fatalf("unexpected catalogue %v", ids)
+	}
+	tenant.registry.observe(EdisonMessage{ID: "car1", Timestamp: 1})
+	if apmId := tenant.registry.apmId("car1"); apmId != "S1" {
+		t.Fatalf("car1 should be bound from the catalogue, got %q", apmId)
+	}
+	if p := tenant.namedPool(); p.Assets[0].Name != "name S1" {
+		t.Fatalf("pool should carry catalogue names, got %+v", p.Assets)
+	}
+
+	// The rules file no longer sets the pool once synced.
+	tenant.setRules(tenantRules{pool: []string{"R1"}})
+	if p := tenant.registry.pool(); len(p.Assets) != 2 || p.Assets[0].ApmID != "S1" {
+		t.Fatalf("rules reload should leave the synced pool, got %+v", p.Assets)
+	}
+}
+
+func TestSyncAssetsReadsContentPage(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"content": [{"sourceKey": "P1", "name": "one"}, {"sourceKey": "P2"}], "totalElements": 2}`)
+	}))
+	defer srv.Close()
+	tenant := newTenant(&Tenant{ID: "page", AssetServiceURL: srv.URL})
+
+	if err := tenant.syncAssets(); err != nil {
+		t.Fatal(err)
+	}
+	if ids := catalogIds(tenant.currentCatalog()); !reflect.DeepEqual(ids, []string{"P1", "P2"}) {
+		t.Fatalf("unexpected catalogue %v", ids)
+	}
+}
+
+// pagedAssetServer serves pages as given, picked by the page query parameter;
+// a page of "" fails.
+func pagedAssetServer(pages ...string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if n >= len(pages) || pages[n] == "" {
+			w.WriteHeader(500)
+			return
+		}
+		io.WriteString(w, pages[n])
+	}))
+}
+
+func TestSyncAssetsFollowsPages(t *testing.T) {
+	for _, pages := range [][]string{
+		{`{"content": [{"sourceKey": "P1"}, {"sourceKey": "P2"}], "last": false}`, `{"content": [{"sourceKey": "P3"}], "last": true}`},
+		{`{"content": [{"sourceKey": "P1"}, {"sourceKey": "P2"}], "totalPages": 2, "number": 0}`, `{"content": [{"sourceKey": "P3"}], "totalPages": 2, "number": 1}`},
+		{`{"content": [{"sourceKey": "P1"}, {"sourceKey": "P2"}], "totalPages": 2, "page": 0}`, `{"content": [{"sourceKey": "P3"}], "totalPages": 2, "page": 1}`},
+	} {
+		srv := pagedAssetServer(pages...)
+		tenant := newTenant(&Tenant{ID: "paged", AssetServiceURL: srv.URL + "/assets?size=2"})
+		if err := tenant.syncAssets(); err != nil {
+			t.Fatal(err)
+		}
+		if ids := catalogIds(tenant.currentCatalog()); !reflect.DeepEqual(ids, []string{"P1", "P2", "P3"}) {
+			t.Fatalf("expected both pages in the catalogue, got %v", ids)
+		}
+		for _, id := range []string{"car1", "car2", "car3"} {
+			tenant.registry.observe(EdisonMessage{ID: id, Timestamp: 1})
+		}
+
+		// A second sync must not take the assets on page 2 for removed.
+		if err := tenant.syncAssets(); err != nil {
+			t.Fatal(err)
+		}
+		if apmId := tenant.registry.apmId("car3"); apmId != "P3" {
+			t.Fatalf("car3 should keep its asset from page 2, got %q", apmId)
+		}
+		srv.Close()
+	}
+}
+
+func TestSyncAssetsFailsOnMissingPage(t *testing.T) {
+	srv := pagedAssetServer(`{"content": [{"sourceKey": "P1"}, {"sourceKey": "P2"}], "last": true}`)
+	tenant := newTenant(&Tenant{ID: "paged-fail", AssetServiceURL: srv.URL})
+	if err := tenant.syncAssets(); err != nil {
+		t.Fatal(err)
+	}
+	tenant.registry.observe(EdisonMessage{ID: "car2", Timestamp: 1})
+	tenant.registry.observe(EdisonMessage{ID: "car1", Timestamp: 1})
+	srv.Close()
+
+	broken := pagedAssetServer(`{"content": [{"sourceKey": "P1"}], "last": false}`, "")
+	defer broken.Close()
+	tenant.AssetServiceURL = broken.URL
+	if err := tenant.syncAssets(); err == nil {
+		t.Fatalf("a sync missing its second page should fail")
+	}
+	if apmId := tenant.registry.apmId("car1"); apmId != "P2" {
+		t.Fatalf("a failed sync should leave bindings alone, car1 has %q", apmId)
+	}
+	if ids := catalogIds(tenant.currentCatalog()); !reflect.DeepEqual(ids, []string{"P1", "P2"}) {
+		t.Fatalf("a failed sync should keep the catalogue, got %v", ids)
+	}
+}
+
+func TestFailedSyncKeepsCatalogue(t *testing.T) {
+	srv := fakeAssetServer("S1", "S2")
+	tenant := newTenant(&Tenant{ID: "fail", AssetServiceURL: srv.URL})
+	if err := tenant.syncAssets(); err != nil {
+		t.Fatal(err)
+	}
+	srv.Close()
+
+	if err := tenant.syncAssets(); err == nil {
+		t.Fatalf("sync against a closed service should fail")
+	}
+	c := tenant.currentCatalog()
+	if ids := catalogIds(c); !reflect.DeepEqual(ids, []string{"S1", "S2"}) {
+		t.Fatalf("failed sync should keep the catalogue, got %v", ids)
+	}
+	if c.Error == "" {
+		t.Fatalf("failed sync should record its error")
+	}
+	if p := tenant.registry.pool(); len(p.Assets) != 2 {
+		t.Fatalf("failed sync should keep the pool, got %+v", p.Assets)
+	}
+
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `[{"sourceKey": "S1"}, {"sourceKey": "S1"}]`)
+	}))
+	defer bad.Close()
+	tenant.AssetServiceURL = bad.URL
+	if err := tenant.syncAssets(); err == nil {
+		t.Fatalf("a catalogue with duplicates should be refused")
+	}
+	if ids := catalogIds(tenant.currentCatalog()); !reflect.DeepEqual(ids, []string{"S1", "S2"}) {
+		t.Fatalf("refused sync should keep the catalogue, got %v", ids)
+	}
+}
+
+func TestReconcileAssetsMovesAndQueues(t *testing.T) {
+	r := newVehicleRegistry([]string{"A1", "A2", "A3"})
+	observeAll(r, "car1", "car2", "car3")
+
+	if r.reconcileAssets([]string{"A1", "A2", "A3"}) {
+		t.Fatalf("an unchanged catalogue should change nothing")
+	}
+
+	// A2 and A3 go away and B1 arrives: car2 moves to B1, car3 has to wait.
+	if !r.reconcileAssets([]string{"A1", "B1"}) {
+		t.Fatalf("reconcile should report the moves")
+	}
+	if r.apmId("car1") != "A1" || r.apmId("car2") != "B1" || r.apmId("car3") != "" {
+		t.Fatalf("unexpected bindings %q %q %q", r.apmId("car1"), r.apmId("car2"), r.apmId("car3"))
+	}
+	p := r.pool()
+	if !reflect.DeepEqual(p.Waiting, []string{"car3"}) || len(p.Unconfigured) != 0 {
+		t.Fatalf("unexpected pool %+v", p)
+	}
+
+	// The waiting vehicle is served first when the catalogue grows.
+	if !r.reconcileAssets([]string{"A1", "B1", "B2"}) {
+		t.Fatalf("serving the queue should count as a change")
+	}
+	if r.apmId("car3") != "B2" {
+		t.Fatalf("car3 should take B2, got %q", r.apmId("car3"))
+	}
+}
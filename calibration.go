@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sync"
+)
+
+// Devices are mounted at arbitrary angles, so readings are rotated into the
+// vehicle frame (X forward, Y left, Z up) before detection. The gravity vector
+// is estimated from periods where the device is at rest and the forward axis
+// from horizontal acceleration seen while driving in a straight line.
+
+type vec3 [3]float64
+
+func (a vec3) dot(b vec3) float64 { return a[0]*b[0] + a[1]*b[1] + a[2]*b[2] }
+
+func (a vec3) cross(b vec3) vec3 {
+	return vec3{a[1]*b[2] - a[2]*b[1], a[2]*b[0] - a[0]*b[2], a[0]*b[1] - a[1]*b[0]}
+}
+
+func (a vec3) add(b vec3) vec3 { return vec3{a[0] + b[0], a[1] + b[1], a[2] + b[2]} }
+
+func (a vec3) sub(b vec3) vec3 { return vec3{a[0] - b[0], a[1] - b[1], a[2] - b[2]} }
+
+func (a vec3) scale(s float64) vec3 { return vec3{a[0] * s, a[1] * s, a[2] * s} }
+
+func (a vec3) norm() float64 { return math.Sqrt(a.dot(a)) }
+
+func (a vec3) unit() vec3 {
+	n := a.norm()
+	if n == 0 {
+		return a
+	}
+	return a.scale(1 / n)
+}
+
+type mat3 [3]vec3
+
+var identity = mat3{{1, 0, 0}, {0, 1, 0}, {0, 0, 1}}
+
+func (m mat3) apply(v vec3) vec3 { return vec3{m[0].dot(v), m[1].dot(v), m[2].dot(v)} }
+
+const (
+	calibRestWindow      = 25    // samples in the rest detection window
+	calibRestMaxStdDev   = 0.03  // per-axis std dev below which the device is at rest
+	calibRestSamples     = 50    // rest samples needed before gravity is trusted
+	calibForwardMinAcc   = 0.15  // horizontal acceleration needed to count as driving
+	calibForwardMaxAngle = 0.9   // cosine a sample must keep to the running forward estimate
+	calibForwardSamples  = 40    // straight-line samples needed before forward is trusted
+	calibGravityTrack    = 0.002 // how quickly gravity follows new rest periods once calibrated
+)
+
+const (
+	calibStateRest     = "collecting_rest"
+	calibStateForward  = "collecting_forward"
+	calibStateComplete = "calibrated"
+)
+
+type Calibration struct {
+	State           string  `json:"state"`
+	RestSamples     int     `json:"restSamples"`
+	RestNeeded      int     `json:"restNeeded"`
+	ForwardSamples  int     `json:"forwardSamples"`
+	ForwardNeeded   int     `json:"forwardNeeded"`
+	Progress        float64 `json:"progress"`
+	Gravity         vec3    `json:"gravity"`
+	Forward         vec3    `json:"forward"`
+	Rotation        mat3    `json:"rotation"`
+	window          []vec3
+	gravitySum      vec3
+	forwardSum      vec3
+	gravityEstimate vec3
+}
+
+var (
+	calibMap      = make(map[vehicleKey]*Calibration)
+	calibMapMutex = &sync.Mutex{}
+)
+
+func newCalibration() *Calibration {
+	return &Calibration{
+		State:         calibStateRest,
+		RestNeeded:    calibRestSamples,
+		ForwardNeeded: calibForwardSamples,
+		Rotation:      identity,
+	}
+}
+
+// orient feeds the reading into its device's calibration and returns it
+// rotated into the vehicle frame.
+func orient(t *Tenant, msg EdisonMessage) EdisonMessage {
+	calibMapMutex.Lock()
+	c, found := calibMap[t.key(msg.ID)]
+	if !found {
+		c = newCalibration()
+		calibMap[t.key(msg.ID)] = c
+	}
+	raw := vec3{msg.X, msg.Y, msg.Z}
+	c.observe(raw)
+	v := c.Rotation.apply(raw)
+	calibMapMutex.Unlock()
+
+	msg.X, msg.Y, msg.Z = v[0], v[1], v[2]
+	return msg
+}
+
+func (c *Calibration) observe(raw vec3) {
+	c.window = append(c.window, raw)
+	if len(c.window) > calibRestWindow {
+		c.window = c.window[1:]
+	}
+
+	if c.atRest() {
+		if c.RestSamples < calibRestSamples {
+			c.RestSamples++
+			c.gravitySum = c.gravitySum.add(raw)
+			if c.RestSamples == calibRestSamples {
+				c.gravityEstimate = c.gravitySum.scale(1 / float64(c.RestSamples))
+				c.State = calibStateForward
+			}
+		} else {
+			c.gravityEstimate = c.gravityEstimate.scale(1 - calibGravityTrack).add(raw.scale(calibGravityTrack))
+		}
+	} else if c.RestSamples >= calibRestSamples && c.ForwardSamples < calibForwardSamples {
+		up := c.gravityEstimate.unit()
+		horizontal := raw.sub(up.scale(raw.dot(up)))
+		if horizontal.norm() >= calibForwardMinAcc {
+			dir := horizontal.unit()
+			if c.ForwardSamples > 0 {
+				ref := c.forwardSum.unit()
+				// braking points backwards along the same axis
+				if dir.dot(ref) < 0 {
+					dir = dir.scale(-1)
+				}
+				if dir.dot(ref) < calibForwardMaxAngle {
+					dir = vec3{}
+				}
+			}
+			if dir.norm() > 0 {
+				c.ForwardSamples++
+				c.forwardSum = c.forwardSum.add(dir)
+				if c.ForwardSamples == calibForwardSamples {
+					c.State = calibStateComplete
+				}
+			}
+		}
+	}
+
+	c.updateRotation()
+	c.Progress = float64(c.RestSamples+c.ForwardSamples) / float64(calibRestSamples+calibForwardSamples)
+}
+
+func (c *Calibration) atRest() bool {
+	if len(c.window) < calibRestWindow {
+		return false
+	}
+	var mean vec3
+	for _, v := range c.window {
+		mean = mean.add(v)
+	}
+	mean = mean.scale(1 / float64(len(c.window)))
+	var variance vec3
+	for _, v := range c.window {
+		d := v.sub(mean)
+		variance = variance.add(vec3{d[0] * d[0], d[1] * d[1], d[2] * d[2]})
+	}
+	variance = variance.scale(1 / float64(len(c.window)))
+	limit := calibRestMaxStdDev * calibRestMaxStdDev
+	return variance[0] < limit && variance[1] < limit && variance[2] < limit
+}
+
+func (c *Calibration) updateRotation() {
+	if c.RestSamples < calibRestSamples {
+		return
+	}
+	up := c.gravityEstimate.unit()
+	c.Gravity = c.gravityEstimate
+
+	var forward vec3
+	if c.ForwardSamples >= calibForwardSamples {
+		forward = c.forwardSum.unit()
+		// the sign of the driving axis is ambiguous from acceleration alone;
+		// assume the device is mounted facing roughly forward rather than backward
+		deviceX := vec3{1, 0, 0}
+		if forward.dot(deviceX) < 0 {
+			forward = forward.scale(-1)
+		}
+	} else {
+		// until the forward axis is known, keep the device X axis as close to
+		// forward as the gravity estimate allows
+		forward = vec3{1, 0, 0}
+		if math.Abs(up.dot(forward)) > 0.95 {
+			forward = vec3{0, 1, 0}
+		}
+	}
+	forward = forward.sub(up.scale(forward.dot(up))).unit()
+	c.Forward = forward
+	c.Rotation = mat3{forward, up.cross(forward), up}
+}
+
+func clearCalibrations(t *Tenant) {
+	calibMapMutex.Lock()
+	for k := range calibMap {
+		if k.tenant == t.ID {
+			delete(calibMap, k)
+		}
+	}
+	calibMapMutex.Unlock()
+}
+
+func calibration(w http.ResponseWriter, r *http.Request, t *Tenant) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	calibMapMutex.Lock()
+	own := make(map[string]*Calibration)
+	for k, c := range calibMap {
+		if k.tenant == t.ID {
+			own[k.device] = c
+		}
+	}
+	out, err := json.Marshal(own)
+	calibMapMutex.Unlock()
+	if err != nil {
+		fmt.Println("ERROR: could not marshal calibration state")
+		w.WriteHeader(500)
+		return
+	}
+	io.WriteString(w, string(out))
+}
+
+// gravityMagnitude returns the size of the device's rest reading, or 0 while
+// gravity has not been calibrated yet.
+func gravityMagnitude(t *Tenant, id string) float64 {
+	calibMapMutex.Lock()
+	defer calibMapMutex.Unlock()
+	c, found := calibMap[t.key(id)]
+	if !found || c.RestSamples < calibRestSamples {
+		return 0
+	}
+	return c.gravityEstimate.norm()
+}
+
+// CalibrationState is a calibration as kept in a snapshot. The rest window is
+// rebuilt from readings.
+type CalibrationState struct {
+	Calibration
+	GravitySum      vec3 `json:"gravitySum"`
+	ForwardSum      vec3 `json:"forwardSum"`
+	GravityEstimate vec3 `json:"gravityEstimate"`
+}
+
+func calibrationStates(t *Tenant) map[string]CalibrationState {
+	calibMapMutex.Lock()
+	defer calibMapMutex.Unlock()
+	out := make(map[string]CalibrationState)
+	for k, c := range calibMap {
+		if k.tenant == t.ID {
+			s := CalibrationState{Calibration: *c, GravitySum: c.gravitySum, ForwardSum: c.forwardSum, GravityEstimate: c.gravityEstimate}
+			s.window = nil
+			out[k.device] = s
+		}
+	}
+	return out
+}
+
+func restoreCalibrations(t *Tenant, states map[string]CalibrationState) {
+	calibMapMutex.Lock()
+	defer calibMapMutex.Unlock()
+	for carId, s := range states {
+		c := s.Calibration
+		c.gravitySum, c.forwardSum, c.gravityEstimate = s.GravitySum, s.ForwardSum, s.GravityEstimate
+		calibMap[t.key(carId)] = &c
+	}
+}
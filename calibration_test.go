@@ -0,0 +1,82 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func nearVec(a, b vec3) bool {
+	for k := range a {
+		if math.Abs(a[k]-b[k]) > 1e-9 {
+			return false
+		}
+	}
+	return true
+}
+
+func orientRaw(tenant *Tenant, v vec3) vec3 {
+	msg := orient(tenant, EdisonMessage{ID: "car1", X: v[0], Y: v[1], Z: v[2]})
+	return vec3{msg.X, msg.Y, msg.Z}
+}
+
+func calibrationOf(tenant *Tenant) Calibration {
+	calibMapMutex.Lock()
+	defer calibMapMutex.Unlock()
+	return *calibMap[tenant.key("car1")]
+}
+
+// The device is mounted on its side: its Y axis points up and its X axis
+// forward, so the vehicle's left is the device's -Z.
+func TestCalibrationRotatesIntoVehicleFrame(t *testing.T) {
+	tenant := newTenant(&Tenant{ID: "calibration"})
+	defer clearCalibrations(tenant)
+
+	if got := orientRaw(tenant, vec3{0, 1, 0}); !nearVec(got, vec3{0, 1, 0}) {
+		t.Fatalf("an uncalibrated device should be passed through, got %v", got)
+	}
+	for i := 1; i < calibRestWindow+calibRestSamples-1; i++ {
+		orientRaw(tenant, vec3{0, 1, 0})
+	}
+	if c := calibrationOf(tenant); c.State != calibStateForward || c.RestSamples != calibRestSamples {
+		t.Fatalf("expected gravity calibrated, got %s with %d rest samples", c.State, c.RestSamples)
+	}
+	if got := orientRaw(tenant, vec3{0, 1, 0}); !nearVec(got, vec3{0, 0, 1}) {
+		t.Fatalf("gravity should point up in the vehicle frame, got %v", got)
+	}
+
+	// Speeding up and braking along the device X axis, never staying still.
+	for i := 0; calibrationOf(tenant).State != calibStateComplete; i++ {
+		if i > 1000 {
+			t.Fatalf("forward axis never calibrated: %+v", calibrationOf(tenant))
+		}
+		x := 0.3 + 0.2*float64(i%2)
+		if i%4 >= 2 {
+			x = -x
+		}
+		orientRaw(tenant, vec3{x, 1, 0})
+	}
+	c := calibrationOf(tenant)
+	if !nearVec(c.Forward, vec3{1, 0, 0}) || !nearVec(c.Rotation[1], vec3{0, 0, -1}) {
+		t.Fatalf("expected forward along X and left along -Z, got %v", c.Rotation)
+	}
+	if c.Progress != 1 {
+		t.Fatalf("a complete calibration should have progress 1, got %v", c.Progress)
+	}
+	if got := orientRaw(tenant, vec3{0.4, 1, 0.2}); !nearVec(got, vec3{0.4, -0.2, 1}) {
+		t.Fatalf("reading not rotated into the vehicle frame, got %v", got)
+	}
+}
+
+func TestCalibrationFlipsBackwardMounting(t *testing.T) {
+	c := newCalibration()
+	for i := 0; i < calibRestWindow+calibRestSamples; i++ {
+		c.observe(vec3{0, 0, 1})
+	}
+	// Only braking is seen, along the device's -X.
+	for i := 0; i < 2*calibForwardSamples && c.State != calibStateComplete; i++ {
+		c.observe(vec3{-0.3 - 0.2*float64(i%2), 0, 1})
+	}
+	if c.State != calibStateComplete || !nearVec(c.Forward, vec3{1, 0, 0}) {
+		t.Fatalf("forward should be taken along the device X axis, got %s %v", c.State, c.Forward)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+)
+
+// Each component has a wear budget. Events consume it at the configured cost
+// per event type, scaled by the weight of the event's severity band.
+
+type ComponentConfig struct {
+	Budget      float64            `json:"budget"`
+	Consumption map[string]float64 `json:"consumption"`
+	Tag         string             `json:"tag"`
+}
+
+type ComponentLife struct {
+	Budget    float64 `json:"budget"`
+	Consumed  float64 `json:"consumed"`
+	Remaining float64 `json:"remaining"`
+	Percent   float64 `json:"percent"`
+}
+
+var (
+	defaultComponents = map[string]ComponentConfig{
+		"brakes": {
+			Budget:      1000,
+			Consumption: map[string]float64{"hardBreak": 10, "crash": 100},
+			Tag:         "Tag_Brakes_Life",
+		},
+		"tires": {
+			Budget:      1000,
+			Consumption: map[string]float64{"hardAcc": 5, "hardBreak": 4, "speeding": 2, "crash": 100},
+			Tag:         "Tag_Tires_Life",
+		},
+		"suspension": {
+			Budget:      1000,
+			Consumption: map[string]float64{"bump": 10, "anomaly": 2, "crash": 200},
+			Tag:         "Tag_Suspension_Life",
+		},
+	}
+
+	componentWearMap   = make(map[vehicleKey]map[string]float64)
+	componentWearMutex = &sync.Mutex{}
+)
+
+func prepareComponents(config map[string]ComponentConfig) (map[string]ComponentConfig, error) {
+	if config == nil {
+		return defaultComponents, nil
+	}
+	for name, c := range config {
+		if c.Budget <= 0 {
+			return nil, fmt.Errorf("component %q needs a positive budget", name)
+		}
+		if c.Tag == "" {
+			c.Tag = fmt.Sprintf("Tag_%s_Life", name)
+			config[name] = c
+		}
+	}
+	return config, nil
+}
+
+func componentNames(config map[string]ComponentConfig) []string {
+	names := make([]string, 0, len(config))
+	for name := range config {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// wearComponents charges an event against every component that it wears and
+// returns the components that changed.
+func wearComponents(t *Tenant, carId string, event string, band string) []string {
+	config := t.currentRules().components
+	weight := bandWeight(t.severity(), event, band)
+	k := t.key(carId)
+
+	componentWearMutex.Lock()
+	defer componentWearMutex.Unlock()
+	var changed []string
+	for _, name := range componentNames(config) {
+		cost := config[name].Consumption[event]
+		if cost == 0 {
+			continue
+		}
+		if componentWearMap[k] == nil {
+			componentWearMap[k] = make(map[string]float64)
+		}
+		componentWearMap[k][name] = componentWearMap[k][name] + cost*weight
+		changed = append(changed, name)
+	}
+	return changed
+}
+
+func componentLives(t *Tenant, carId string) map[string]ComponentLife {
+	config := t.currentRules().components
+
+	componentWearMutex.Lock()
+	defer componentWearMutex.Unlock()
+	lives := make(map[string]ComponentLife)
+	for name, c := range config {
+		consumed := componentWearMap[t.key(carId)][name]
+		remaining := math.Max(c.Budget-consumed, 0)
+		lives[name] = ComponentLife{
+			Budget:    c.Budget,
+			Consumed:  consumed,
+			Remaining: remaining,
+			Percent:   remaining / c.Budget * 100,
+		}
+	}
+	return lives
+}
+
+func componentLivesJSON(t *Tenant, carId string) string {
+	out, err := json.Marshal(componentLives(t, carId))
+	if err != nil {
+		fmt.Println("ERROR: could not marshal component lives")
+		return "{}"
+	}
+	return string(out)
+}
+
+func storeComponents(t *Tenant, ts uint64, apmId string, carId string, changed []string) {
+	if apmId == "" {
+		return
+	}
+	config := t.currentRules().components
+	lives := componentLives(t, carId)
+	var tags []tagValue
+	for _, name := range changed {
+		tags = append(tags, tagValue{fmt.Sprintf("%s.%s", apmId, config[name].Tag), fmt.Sprintf("%.1f", lives[name].Remaining)})
+	}
+	if len(tags) > 0 {
+		storeTags(t, ts, tags)
+	}
+}
+
+func clearComponents(t *Tenant) {
+	componentWearMutex.Lock()
+	for k := range componentWearMap {
+		if k.tenant == t.ID {
+			delete(componentWearMap, k)
+		}
+	}
+	componentWearMutex.Unlock()
+}
+
+func componentWear(t *Tenant) map[string]map[string]float64 {
+	componentWearMutex.Lock()
+	defer componentWearMutex.Unlock()
+	out := make(map[string]map[string]float64)
+	for k, wear := range componentWearMap {
+		if k.tenant != t.ID {
+			continue
+		}
+		out[k.device] = make(map[string]float64)
+		for name, v := range wear {
+			out[k.device][name] = v
+		}
+	}
+	return out
+}
+
+func restoreComponentWear(t *Tenant, wear map[string]map[string]float64) {
+	componentWearMutex.Lock()
+	defer componentWearMutex.Unlock()
+	for carId, w := range wear {
+		componentWearMap[t.key(carId)] = make(map[string]float64)
+		for name, v := range w {
+			componentWearMap[t.key(carId)][name] = v
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import "testing"
+
+func componentTenant(t *testing.T, id string) *Tenant {
+	tenant := newTenant(&Tenant{ID: id})
+	rules, err := compileRules(RuleConfig{Components: map[string]ComponentConfig{
+		"brakes": {Budget: 100, Consumption: map[string]float64{"hardBreak": 10, "crash": 100}},
+		"tires":  {Budget: 200, Consumption: map[string]float64{"hardAcc": 5, "hardBreak": 4}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenant.setRules(rules)
+	return tenant
+}
+
+func TestComponentWearBudgets(t *testing.T) {
+	tenant := componentTenant(t, "components")
+	defer clearComponents(tenant)
+
+	if changed := wearComponents(tenant, "car1", "hardBreak", "moderate"); len(changed) != 2 || changed[0] != "brakes" || changed[1] != "tires" {
+		t.Fatalf("a hard brake should wear brakes and tires, got %v", changed)
+	}
+	// A severe band doubles the cost; events no component cares about change
+	// nothing.
+	wearComponents(tenant, "car1", "hardBreak", "severe")
+	if changed := wearComponents(tenant, "car1", "speeding", "moderate"); len(changed) != 0 {
+		t.Fatalf("speeding should wear nothing, got %v", changed)
+	}
+	lives := componentLives(tenant, "car1")
+	if b := lives["brakes"]; b.Consumed != 30 || b.Remaining != 70 || b.Percent != 70 {
+		t.Fatalf("unexpected brakes %+v", b)
+	}
+	if tires := lives["tires"]; tires.Consumed != 12 || tires.Remaining != 188 || tires.Percent != 94 {
+		t.Fatalf("unexpected tires %+v", tires)
+	}
+
+	// Wear past the budget leaves nothing, not a negative life.
+	wearComponents(tenant, "car1", "crash", "")
+	if b := componentLives(tenant, "car1")["brakes"]; b.Consumed != 130 || b.Remaining != 0 || b.Percent != 0 {
+		t.Fatalf("worn out brakes should have nothing left, got %+v", b)
+	}
+	if tires := componentLives(tenant, "car2")["tires"]; tires.Remaining != 200 {
+		t.Fatalf("car2 should have its full budget, got %+v", tires)
+	}
+}
+
+func TestPrepareComponents(t *testing.T) {
+	if _, err := prepareComponents(map[string]ComponentConfig{"brakes": {}}); err == nil {
+		t.Errorf("a component without a budget should be refused")
+	}
+	config, err := prepareComponents(map[string]ComponentConfig{"wipers": {Budget: 10}})
+	if err != nil || config["wipers"].Tag != "Tag_wipers_Life" {
+		t.Errorf("a component without a tag should get one, got %+v %v", config, err)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+)
+
+// A crash is either a single reading above crashImpactG, or a violent spike on
+// several axes followed by the vehicle coming to a stop. Crash alerts skip the
+// rule engine and go straight to every websocket client and webhook. Readings
+// older than the device's last one are dropped, so the window stays in order.
+
+const (
+	crashImpactG      = 4.0
+	crashSpikeG       = 2.5
+	crashSpikeAxes    = 2
+	crashWindow       = 40    // samples kept from before the impact
+	crashStillMs      = 3000  // how long the vehicle must stay still after a spike
+	crashStillRange   = 0.1   // per-axis spread allowed while still
+	crashWatchMs      = 10000 // how long after a spike to wait for stillness
+	crashCooldownMs   = 30000
+	crashEvent        = "crash"
+	crashTag          = "Tag_Crash_1"
+	crashTriggerPeak  = "impact"
+	crashTriggerStill = "spike_then_still"
+)
+
+type crashState struct {
+	window    []EdisonMessage
+	pending   bool
+	impact    EdisonMessage
+	peak      float64
+	before    []EdisonMessage
+	after     []EdisonMessage
+	lastCrash uint64
+}
+
+type CrashAlert struct {
+	CarID    string          `json:"carId"`
+	ApmID    string          `json:"apmId"`
+	Crash    int             `json:"crash"`
+	Priority string          `json:"priority"`
+	Trigger  string          `json:"trigger"`
+	Peak     float64         `json:"peak"`
+	Ts       uint64          `json:"ts"`
+	Miles    int             `json:"miles"`
+	Lifetime Lifetime        `json:"lifetime"`
+	Window   []EdisonMessage `json:"window"`
+}
+
+var (
+	crashMap      = make(map[vehicleKey]*crashState)
+	crashMapMutex = &sync.Mutex{}
+)
+
+func detectCrash(t *Tenant, msg EdisonMessage) {
+	g := gravityMagnitude(t, msg.ID)
+	dyn := vec3{msg.X, msg.Y, msg.Z - g}
+
+	crashMapMutex.Lock()
+	c, found := crashMap[t.key(msg.ID)]
+	if !found {
+		c = &crashState{}
+		crashMap[t.key(msg.ID)] = c
+	}
+	alert := c.observe(msg, dyn)
+	crashMapMutex.Unlock()
+
+	if alert != nil {
+		raiseCrash(t, alert)
+	}
+}
+
+func (c *crashState) observe(msg EdisonMessage, dyn vec3) *CrashAlert {
+	if n := len(c.window); n > 0 && msg.Timestamp < c.window[n-1].Timestamp {
+		return nil
+	}
+	c.window = append(c.window, msg)
+	if len(c.window) > crashWindow {
+		c.window = c.window[1:]
+	}
+	if c.lastCrash != 0 && msg.Timestamp < c.lastCrash+crashCooldownMs {
+		return nil
+	}
+
+	if c.pending {
+		c.after = append(c.after, msg)
+		if msg.Miles != c.impact.Miles || msg.Timestamp > c.impact.Timestamp+crashWatchMs {
+			c.pending = false
+			c.before = nil
+			c.after = nil
+			return nil
+		}
+		if c.stillFor() < crashStillMs {
+			return nil
+		}
+		return c.fire(crashTriggerStill)
+	}
+
+	peak := dyn.norm()
+	if peak >= crashImpactG {
+		c.impact, c.peak = msg, peak
+		c.before = c.window
+		c.after = nil
+		return c.fire(crashTriggerPeak)
+	}
+	axes := 0
+	for _, v := range dyn {
+		if math.Abs(v) >= crashSpikeG {
+			axes++
+		}
+	}
+	if axes >= crashSpikeAxes {
+		c.pending = true
+		c.impact, c.peak = msg, peak
+		c.before = append([]EdisonMessage(nil), c.window...)
+		c.after = nil
+	}
+	return nil
+}
+
+// stillFor returns how long the samples at the end of the post-impact window
+// have stayed within crashStillRange of each other on every axis.
+func (c *crashState) stillFor() uint64 {
+	last := c.after[len(c.after)-1]
+	lo := vec3{last.X, last.Y, last.Z}
+	hi := lo
+	start := last.Timestamp
+	for i := len(c.after) - 1; i >= 0; i-- {
+		s := c.after[i]
+		v := vec3{s.X, s.Y, s.Z}
+		for k := range v {
+			lo[k] = math.Min(lo[k], v[k])
+			hi[k] = math.Max(hi[k], v[k])
+			if hi[k]-lo[k] > crashStillRange {
+				return last.Timestamp - start
+			}
+		}
+		start = s.Timestamp
+	}
+	return last.Timestamp - start
+}
+
+func (c *crashState) fire(trigger string) *CrashAlert {
+	window := make([]EdisonMessage, 0, len(c.before)+len(c.after))
+	window = append(window, c.before...)
+	window = append(window, c.after...)
+
+	c.pending = false
+	c.before = nil
+	c.after = nil
+	c.lastCrash = c.impact.Timestamp
+	return &CrashAlert{
+		CarID:    c.impact.ID,
+		Priority: "high",
+		Trigger:  trigger,
+		Peak:     c.peak,
+		Ts:       c.impact.Timestamp,
+		Window:   window,
+	}
+}
+
+func raiseCrash(t *Tenant, alert *CrashAlert) {
+	alert.ApmID = t.registry.apmId(alert.CarID)
+	alert.Crash, _ = recordEvent(t, alert.Ts, alert.CarID, crashEvent, alert.Peak, classify(t.severity(), crashEvent, alert.Peak, "extreme"))
+	alert.Miles = int(alert.Window[len(alert.Window)-1].Miles)
+	alert.Lifetime = lifetimeFor(t, alert.CarID)
+
+	payload, err := json.Marshal(alert)
+	if err != nil {
+		fmt.Println("ERROR: could not marshal crash alert")
+		return
+	}
+	broadcast(t, string(payload))
+	if replayingWAL() {
+		return
+	}
+	notifyWebhooks(t, payload)
+	go storeEvent(t, alert.Ts, alert.Peak, crashTag, "", alert.ApmID, int(alert.Lifetime.Value), alert.Crash, 0)
+}
+
+func clearCrashes(t *Tenant) {
+	crashMapMutex.Lock()
+	for k := range crashMap {
+		if k.tenant == t.ID {
+			delete(crashMap, k)
+		}
+	}
+	crashMapMutex.Unlock()
+}
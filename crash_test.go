@@ -0,0 +1,107 @@
+package main
+
+import "testing"
+
+func crashReading(ts uint64, x, y, z float64) EdisonMessage {
+	return EdisonMessage{ID: "car1", Timestamp: ts, Miles: 10, X: x, Y: y, Z: z}
+}
+
+func observeCrash(c *crashState, msg EdisonMessage) *CrashAlert {
+	return c.observe(msg, vec3{msg.X, msg.Y, msg.Z})
+}
+
+// stillUntil feeds still readings every 200ms from from to to, returning the
+// first alert raised.
+func stillUntil(c *crashState, from, to uint64) *CrashAlert {
+	for ts := from; ts <= to; ts += 200 {
+		if alert := observeCrash(c, crashReading(ts, 0, 0, 0)); alert != nil {
+			return alert
+		}
+	}
+	return nil
+}
+
+func TestCrashOnImpact(t *testing.T) {
+	c := &crashState{}
+	observeCrash(c, crashReading(500, 0, 0, 0))
+	alert := observeCrash(c, crashReading(1000, 2.6, 2.6, 0))
+	if alert != nil {
+		t.Fatalf("a spike alone should only start watching, got %+v", alert)
+	}
+	c = &crashState{}
+	observeCrash(c, crashReading(500, 0, 0, 0))
+	alert = observeCrash(c, crashReading(1000, 4, 1, 0))
+	if alert == nil || alert.Trigger != crashTriggerPeak || alert.Ts != 1000 || len(alert.Window) != 2 {
+		t.Fatalf("expected an impact alert with the window before it, got %+v", alert)
+	}
+}
+
+func TestCrashSpikeThenStill(t *testing.T) {
+	c := &crashState{}
+	observeCrash(c, crashReading(1000, 2.6, 2.6, 0))
+	if alert := stillUntil(c, 1200, 4000); alert != nil {
+		t.Fatalf("still for less than %dms should not raise an alert, got %+v", crashStillMs, alert)
+	}
+	alert := stillUntil(c, 4200, 4200)
+	if alert == nil || alert.Trigger != crashTriggerStill || alert.Ts != 1000 {
+		t.Fatalf("expected a spike-then-still alert once still for %dms, got %+v", crashStillMs, alert)
+	}
+	if c.pending || c.after != nil {
+		t.Fatalf("firing should end the watch: %+v", c)
+	}
+}
+
+func TestCrashSpikeThenMovement(t *testing.T) {
+	c := &crashState{}
+	observeCrash(c, crashReading(1000, 2.6, 2.6, 0))
+	moving := crashReading(1200, 0, 0, 0)
+	moving.Miles++
+	if alert := observeCrash(c, moving); alert != nil || c.pending {
+		t.Fatalf("moving on should cancel the watch, got %+v", alert)
+	}
+	if alert := stillUntil(c, 1400, 6000); alert != nil {
+		t.Fatalf("stopping after the watch was cancelled should not raise an alert, got %+v", alert)
+	}
+
+	c = &crashState{}
+	observeCrash(c, crashReading(1000, 2.6, 2.6, 0))
+	for ts := uint64(1200); ts <= 1000+crashWatchMs; ts += 200 {
+		// Shaking keeps the vehicle from ever being still.
+		if alert := observeCrash(c, crashReading(ts, float64(ts%400)/1000, 0, 0)); alert != nil {
+			t.Fatalf("a vehicle that never stops should not crash, got %+v", alert)
+		}
+	}
+	if observeCrash(c, crashReading(1200+crashWatchMs, 0, 0, 0)); c.pending {
+		t.Fatalf("the watch should end %dms after the spike", crashWatchMs)
+	}
+}
+
+func TestCrashDropsLateReadings(t *testing.T) {
+	// A late still reading used to wrap stillFor around and raise an alert.
+	c := &crashState{}
+	observeCrash(c, crashReading(1000, 2.6, 2.6, 0))
+	observeCrash(c, crashReading(1200, 0, 0, 0))
+	if alert := observeCrash(c, crashReading(1100, 0, 0, 0)); alert != nil {
+		t.Fatalf("a late reading raised %+v", alert)
+	}
+	if len(c.after) != 1 || len(c.window) != 2 {
+		t.Fatalf("the late reading should have been dropped: %+v", c)
+	}
+
+	// Nor does a late reading cancel the watch or end the cooldown.
+	if observeCrash(c, crashReading(500, 0, 0, 0)); !c.pending {
+		t.Fatalf("a late reading should not cancel a pending crash")
+	}
+	if alert := stillUntil(c, 1400, 4200); alert == nil {
+		t.Fatalf("the crash should still be raised once the vehicle has been still")
+	}
+	if alert := observeCrash(c, crashReading(800, 5, 5, 5)); alert != nil {
+		t.Fatalf("a late impact should not slip past the cooldown, got %+v", alert)
+	}
+	if alert := observeCrash(c, crashReading(1000+crashCooldownMs-1, 5, 5, 5)); alert != nil {
+		t.Fatalf("an impact within the cooldown should not raise an alert, got %+v", alert)
+	}
+	if alert := observeCrash(c, crashReading(1000+crashCooldownMs, 5, 5, 5)); alert == nil {
+		t.Fatalf("an impact after the cooldown should raise an alert")
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// A small expression language for detection rules. Values are float64;
+// comparisons and logical operators yield 1 for true and 0 for false.
+//
+//	expr    = or
+//	or      = and { "||" and }
+//	and     = cmp { "&&" cmp }
+//	cmp     = sum [ ( "<" | "<=" | ">" | ">=" | "==" | "!=" ) sum ]
+//	sum     = product { ( "+" | "-" ) product }
+//	product = unary { ( "*" | "/" ) unary }
+//	unary   = ( "-" | "!" ) unary | primary
+//	primary = number | signal | func "(" expr { "," expr } ")" | "(" expr ")"
+
+type exprNode interface {
+	eval(signals map[string]float64) float64
+}
+
+type numberNode float64
+
+func (n numberNode) eval(map[string]float64) float64 { return float64(n) }
+
+type signalNode string
+
+func (n signalNode) eval(signals map[string]float64) float64 { return signals[string(n)] }
+
+type unaryNode struct {
+	op      string
+	operand exprNode
+}
+
+func (n *unaryNode) eval(signals map[string]float64) float64 {
+	v := n.operand.eval(signals)
+	if n.op == "!" {
+		return boolValue(v == 0)
+	}
+	return -v
+}
+
+type binaryNode struct {
+	op          string
+	left, right exprNode
+}
+
+func (n *binaryNode) eval(signals map[string]float64) float64 {
+	l := n.left.eval(signals)
+	switch n.op {
+	case "&&":
+		if l == 0 {
+			return 0
+		}
+		return boolValue(n.right.eval(signals) != 0)
+	case "||":
+		if l != 0 {
+			return 1
+		}
+		return boolValue(n.right.eval(signals) != 0)
+	}
+	r := n.right.eval(signals)
+	switch n.op {
+	case "+":
+		return l + r
+	case "-":
+		return l - r
+	case "*":
+		return l * r
+	case "/":
+		if r == 0 {
+			return 0
+		}
+		return l / r
+	case "<":
+		return boolValue(l < r)
+	case "<=":
+		return boolValue(l <= r)
+	case ">":
+		return boolValue(l > r)
+	case ">=":
+		return boolValue(l >= r)
+	case "==":
+		return boolValue(l == r)
+	case "!=":
+		return boolValue(l != r)
+	}
+	return 0
+}
+
+type callNode struct {
+	name string
+	args []exprNode
+}
+
+func (n *callNode) eval(signals map[string]float64) float64 {
+	v := n.args[0].eval(signals)
+	switch n.name {
+	case "abs":
+		return math.Abs(v)
+	case "sqrt":
+		return math.Sqrt(math.Max(v, 0))
+	case "min":
+		for _, a := range n.args[1:] {
+			v = math.Min(v, a.eval(signals))
+		}
+	case "max":
+		for _, a := range n.args[1:] {
+			v = math.Max(v, a.eval(signals))
+		}
+	}
+	return v
+}
+
+var exprFuncs = map[string]int{"abs": 1, "sqrt": 1, "min": -1, "max": -1}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+type exprParser struct {
+	tokens  []string
+	pos     int
+	signals map[string]bool
+}
+
+// compileExpr parses src, rejecting any identifier that is not a known signal
+// or function.
+func compileExpr(src string, signals []string) (exprNode, error) {
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens, signals: make(map[string]bool)}
+	for _, s := range signals {
+		p.signals[s] = true
+	}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	return node, nil
+}
+
+func tokenize(src string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(src); {
+		c := rune(src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsDigit(c) || c == '.':
+			j := i
+			for j < len(src) && (unicode.IsDigit(rune(src[j])) || src[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, src[i:j])
+			i = j
+		case unicode.IsLetter(c) || c == '_':
+			j := i
+			for j < len(src) && (unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j])) || src[j] == '_') {
+				j++
+			}
+			tokens = append(tokens, src[i:j])
+			i = j
+		case strings.ContainsRune("<>=!&|", c) && i+1 < len(src) && isTwoCharOp(src[i:i+2]):
+			tokens = append(tokens, src[i:i+2])
+			i += 2
+		case strings.ContainsRune("+-*/()<>!,", c):
+			tokens = append(tokens, string(c))
+			i++
+		default:
+			return nil, fmt.Errorf("unexpected character %q", c)
+		}
+	}
+	return tokens, nil
+}
+
+func isTwoCharOp(s string) bool {
+	switch s {
+	case "<=", ">=", "==", "!=", "&&", "||":
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *exprParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	return p.parseBinary([]string{"||"}, p.parseAnd)
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	return p.parseBinary([]string{"&&"}, p.parseCmp)
+}
+
+func (p *exprParser) parseCmp() (exprNode, error) {
+	left, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	switch op := p.peek(); op {
+	case "<", "<=", ">", ">=", "==", "!=":
+		p.next()
+		right, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		return &binaryNode{op: op, left: left, right: right}, nil
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseSum() (exprNode, error) {
+	return p.parseBinary([]string{"+", "-"}, p.parseProduct)
+}
+
+func (p *exprParser) parseProduct() (exprNode, error) {
+	return p.parseBinary([]string{"*", "/"}, p.parseUnary)
+}
+
+func (p *exprParser) parseBinary(ops []string, operand func() (exprNode, error)) (exprNode, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		matched := false
+		for _, o := range ops {
+			if op == o {
+				matched = true
+			}
+		}
+		if !matched {
+			return left, nil
+		}
+		p.next()
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: op, left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if op := p.peek(); op == "-" || op == "!" {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{op: op, operand: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	t := p.next()
+	switch {
+	case t == "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	case t == "(":
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return node, nil
+	case unicode.IsDigit(rune(t[0])) || t[0] == '.':
+		v, err := strconv.ParseFloat(t, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad number %q", t)
+		}
+		return numberNode(v), nil
+	case unicode.IsLetter(rune(t[0])) || t[0] == '_':
+		if p.peek() == "(" {
+			return p.parseCall(t)
+		}
+		if !p.signals[t] {
+			return nil, fmt.Errorf("unknown signal %q", t)
+		}
+		return signalNode(t), nil
+	}
+	return nil, fmt.Errorf("unexpected %q", t)
+}
+
+func (p *exprParser) parseCall(name string) (exprNode, error) {
+	arity, found := exprFuncs[name]
+	if !found {
+		return nil, fmt.Errorf("unknown function %q", name)
+	}
+	p.next()
+	call := &callNode{name: name}
+	for {
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		call.args = append(call.args, arg)
+		t := p.next()
+		if t == ")" {
+			break
+		}
+		if t != "," {
+			return nil, fmt.Errorf("expected , or ) in call to %s", name)
+		}
+	}
+	if arity > 0 && len(call.args) != arity {
+		return nil, fmt.Errorf("%s takes %d argument(s)", name, arity)
+	}
+	return call, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	cases := []struct {
+		src    string
+		tokens []string
+	}{
+		{"mag > 1.2", []string{"mag", ">", "1.2"}},
+		{"abs(x)>=.5&&!(y<=-1)", []string{"abs", "(", "x", ")", ">=", ".5", "&&", "!", "(", "y", "<=", "-", "1", ")"}},
+		{"a_1 == b || c != 2", []string{"a_1", "==", "b", "||", "c", "!=", "2"}},
+		{"max(x, y, z)", []string{"max", "(", "x", ",", "y", ",", "z", ")"}},
+		{"", nil},
+	}
+	for _, c := range cases {
+		tokens, err := tokenize(c.src)
+		if err != nil {
+			t.Errorf("tokenize(%q): %v", c.src, err)
+			continue
+		}
+		if !reflect.DeepEqual(tokens, c.tokens) {
+			t.Errorf("tokenize(%q) = %q, want %q", c.src, tokens, c.tokens)
+		}
+	}
+
+	for _, src := range []string{"x = 1", "x & y", "x | y", "x ^ 2", "x; y"} {
+		if _, err := tokenize(src); err == nil {
+			t.Errorf("tokenize(%q) should fail", src)
+		}
+	}
+}
+
+func TestCompileExpr(t *testing.T) {
+	signals := map[string]float64{"x": 3, "y": -4, "z": 0.5}
+	cases := []struct {
+		src  string
+		want float64
+	}{
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"10 - 4 - 3", 3},
+		{"12 / 3 / 2", 2},
+		{"x / 0", 0},
+		{"-x", -3},
+		{"--x", 3},
+		{"x > 2", 1},
+		{"x > 3", 0},
+		{"x >= 3 && y < 0", 1},
+		{"x < 0 || z == 0.5", 1},
+		{"!z", 0},
+		{"!(x < 0)", 1},
+		{"1 + 2 > 2", 1},
+		{"abs(y)", 4},
+		{"sqrt(x*x + y*y)", 5},
+		{"sqrt(y)", 0},
+		{"min(x, y, z)", -4},
+		{"max(x, y, z)", 3},
+		{"max(abs(y), x) > 3.5", 1},
+		{"x > 1 || y > 1 && z > 1", 1},
+	}
+	for _, c := range cases {
+		node, err := compileExpr(c.src, []string{"x", "y", "z"})
+		if err != nil {
+			t.Errorf("compileExpr(%q): %v", c.src, err)
+			continue
+		}
+		if got := node.eval(signals); got != c.want {
+			t.Errorf("%q = %g, want %g", c.src, got, c.want)
+		}
+	}
+
+	for _, src := range []string{
+		"",
+		"w > 1",
+		"foo(x)",
+		"abs(x, y)",
+		"(x + 1",
+		"x + ",
+		"x 1",
+		"1..2",
+		"max(x y)",
+		"x < y < z",
+	} {
+		if _, err := compileExpr(src, []string{"x", "y", "z"}); err == nil {
+			t.Errorf("compileExpr(%q) should fail", src)
+		}
+	}
+}
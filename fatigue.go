@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+)
+
+// Fatigue damage is accumulated with Miner's rule from cycles found by
+// streaming rainflow counting (ASTM E1049 four-point method) over one axis of
+// the filtered signal. Each S-N curve follows Basquin's law, N = C * S^-m, where
+// S is the cycle range scaled by StressPerG; ranges below EnduranceLimit are
+// taken to cause no damage.
+
+type SNCurve struct {
+	C              float64 `json:"c"`
+	M              float64 `json:"m"`
+	StressPerG     float64 `json:"stressPerG"`
+	EnduranceLimit float64 `json:"enduranceLimit"`
+}
+
+type FatigueConfig struct {
+	Signal   string             `json:"signal"`
+	Gate     float64            `json:"gate"`
+	Curves   map[string]SNCurve `json:"curves"`
+	Vehicles map[string]string  `json:"vehicles,omitempty"`
+}
+
+type fatigueState struct {
+	stack     []float64
+	last      float64
+	rising    bool
+	primed    bool
+	moving    bool
+	damage    float64
+	cycles    float64
+	curveName string
+}
+
+type FatigueReport struct {
+	Curve    string  `json:"curve"`
+	Damage   float64 `json:"damage"`
+	Cycles   float64 `json:"cycles"`
+	Residual int     `json:"residual"`
+}
+
+var (
+	defaultFatigueConfig = FatigueConfig{
+		Signal: "z",
+		Gate:   0.05,
+		Curves: map[string]SNCurve{
+			"default": {C: 1e9, M: 3, StressPerG: 1, EnduranceLimit: 0.1},
+		},
+	}
+
+	fatigueMap      = make(map[vehicleKey]*fatigueState)
+	fatigueMapMutex = &sync.Mutex{}
+)
+
+func prepareFatigueConfig(config *FatigueConfig) (FatigueConfig, error) {
+	if config == nil {
+		return defaultFatigueConfig, nil
+	}
+	c := *config
+	switch c.Signal {
+	case "x", "y", "z":
+	case "":
+		c.Signal = defaultFatigueConfig.Signal
+	default:
+		return c, fmt.Errorf("fatigue signal must be x, y or z")
+	}
+	if _, found := c.Curves["default"]; !found {
+		return c, fmt.Errorf("fatigue curves need a default curve")
+	}
+	for name, curve := range c.Curves {
+		if curve.C <= 0 || curve.M <= 0 {
+			return c, fmt.Errorf("fatigue curve %q needs positive c and m", name)
+		}
+		if curve.StressPerG == 0 {
+			curve.StressPerG = 1
+			c.Curves[name] = curve
+		}
+	}
+	for id, name := range c.Vehicles {
+		if _, found := c.Curves[name]; !found {
+			return c, fmt.Errorf("unknown fatigue curve %q for %s", name, id)
+		}
+	}
+	return c, nil
+}
+
+func (c FatigueConfig) curveFor(carId string) (string, SNCurve) {
+	name, found := c.Vehicles[carId]
+	if !found {
+		name = "default"
+	}
+	return name, c.Curves[name]
+}
+
+func (s SNCurve) damage(rangeG float64, cycles float64) float64 {
+	stress := rangeG * s.StressPerG
+	if stress <= s.EnduranceLimit {
+		return 0
+	}
+	return cycles / (s.C * math.Pow(stress, -s.M))
+}
+
+func trackFatigue(t *Tenant, msg EdisonMessage) {
+	config := t.currentRules().fatigue
+
+	v := msg.Z
+	switch config.Signal {
+	case "x":
+		v = msg.X
+	case "y":
+		v = msg.Y
+	}
+	name, curve := config.curveFor(msg.ID)
+
+	fatigueMapMutex.Lock()
+	defer fatigueMapMutex.Unlock()
+	f, found := fatigueMap[t.key(msg.ID)]
+	if !found {
+		f = &fatigueState{}
+		fatigueMap[t.key(msg.ID)] = f
+	}
+	f.curveName = name
+	f.observe(v, config.Gate, curve)
+}
+
+// observe extracts turning points, ignoring reversals smaller than gate, and
+// feeds each one to the rainflow stack.
+func (f *fatigueState) observe(v float64, gate float64, curve SNCurve) {
+	if !f.primed {
+		f.last, f.primed = v, true
+		f.stack = append(f.stack, v)
+		return
+	}
+	if !f.moving {
+		if math.Abs(v-f.stack[0]) >= gate {
+			f.rising = v > f.stack[0]
+			f.last, f.moving = v, true
+		}
+		return
+	}
+	if (f.rising && v >= f.last) || (!f.rising && v <= f.last) {
+		f.last = v
+		return
+	}
+	if math.Abs(v-f.last) < gate {
+		return
+	}
+	f.push(f.last, curve)
+	f.last = v
+	f.rising = !f.rising
+}
+
+func (f *fatigueState) push(peak float64, curve SNCurve) {
+	f.stack = append(f.stack, peak)
+	for len(f.stack) >= 3 {
+		n := len(f.stack)
+		x := math.Abs(f.stack[n-1] - f.stack[n-2])
+		y := math.Abs(f.stack[n-2] - f.stack[n-3])
+		if x < y {
+			return
+		}
+		if n == 3 {
+			f.count(y, 0.5, curve)
+			f.stack = f.stack[1:]
+			continue
+		}
+		f.count(y, 1, curve)
+		f.stack = append(f.stack[:n-3], f.stack[n-1])
+	}
+}
+
+func (f *fatigueState) count(rangeG float64, cycles float64, curve SNCurve) {
+	f.cycles += cycles
+	f.damage += curve.damage(rangeG, cycles)
+}
+
+// residualDamage counts what is left on the stack as half cycles without
+// committing them.
+func (f *fatigueState) residualDamage(curve SNCurve) float64 {
+	d := 0.0
+	points := append([]float64(nil), f.stack...)
+	if f.moving {
+		points = append(points, f.last)
+	}
+	for i := 1; i < len(points); i++ {
+		d += curve.damage(math.Abs(points[i]-points[i-1]), 0.5)
+	}
+	return d
+}
+
+func fatigueReport(t *Tenant, carId string) FatigueReport {
+	config := t.currentRules().fatigue
+	name, curve := config.curveFor(carId)
+
+	fatigueMapMutex.Lock()
+	defer fatigueMapMutex.Unlock()
+	f, found := fatigueMap[t.key(carId)]
+	if !found {
+		return FatigueReport{Curve: name}
+	}
+	return FatigueReport{
+		Curve:    name,
+		Damage:   f.damage + f.residualDamage(curve),
+		Cycles:   f.cycles,
+		Residual: len(f.stack),
+	}
+}
+
+// rainflowModel reports the fraction of fatigue life left under Miner's rule.
+type rainflowModel struct{}
+
+func (rainflowModel) Name() string { return "rainflow" }
+
+func (m rainflowModel) Remaining(h VehicleHistory) Lifetime {
+	return Lifetime{
+		Value: math.Max(0, 1-h.Damage) * 100,
+		Units: "percent",
+		Model: m.Name(),
+	}
+}
+
+func init() {
+	registerLifetimeModel(rainflowModel{})
+}
+
+func clearFatigue(t *Tenant) {
+	fatigueMapMutex.Lock()
+	for k := range fatigueMap {
+		if k.tenant == t.ID {
+			delete(fatigueMap, k)
+		}
+	}
+	fatigueMapMutex.Unlock()
+}
+
+// FatigueTotals is the part of a vehicle's fatigue state kept across
+// restarts. Half-open cycles still on the rainflow stack are dropped.
+type FatigueTotals struct {
+	Damage float64 `json:"damage"`
+	Cycles float64 `json:"cycles"`
+}
+
+func fatigueTotals(t *Tenant) map[string]FatigueTotals {
+	fatigueMapMutex.Lock()
+	defer fatigueMapMutex.Unlock()
+	out := make(map[string]FatigueTotals)
+	for k, f := range fatigueMap {
+		if k.tenant == t.ID {
+			out[k.device] = FatigueTotals{Damage: f.damage, Cycles: f.cycles}
+		}
+	}
+	return out
+}
+
+func restoreFatigue(t *Tenant, totals map[string]FatigueTotals) {
+	fatigueMapMutex.Lock()
+	defer fatigueMapMutex.Unlock()
+	for carId, f := range totals {
+		fatigueMap[t.key(carId)] = &fatigueState{damage: f.Damage, cycles: f.Cycles}
+	}
+}
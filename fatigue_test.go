@@ -0,0 +1,101 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+// astmHistory is the example load history of ASTM E1049 section 5.4.4, whose
+// rainflow count is half a cycle of range 3, one and a half of 4, half of 6,
+// one of 8 and half of 9.
+var astmHistory = []float64{-2, 1, -3, 5, -1, 3, -4, 4, -2}
+
+// rainflowTotals feeds samples through observe and returns the damage and
+// cycles counted, the stack left over counting as half cycles.
+func rainflowTotals(samples []float64, gate float64, curve SNCurve) (float64, float64) {
+	f := &fatigueState{}
+	for _, v := range samples {
+		f.observe(v, gate, curve)
+	}
+	residual := len(f.stack) - 1
+	if f.moving {
+		residual++
+	}
+	return f.damage + f.residualDamage(curve), f.cycles + 0.5*float64(residual)
+}
+
+func TestRainflowMatchesASTMExample(t *testing.T) {
+	// With m = 1 damage sums range times cycles; with m = 2, range squared.
+	for _, c := range []struct {
+		m    float64
+		want float64
+	}{
+		{1, 3*0.5 + 4*1.5 + 6*0.5 + 8*1 + 9*0.5},
+		{2, 9*0.5 + 16*1.5 + 36*0.5 + 64*1 + 81*0.5},
+	} {
+		curve := SNCurve{C: 1, M: c.m, StressPerG: 1}
+		damage, cycles := rainflowTotals(astmHistory, 0.5, curve)
+		if math.Abs(damage-c.want) > 1e-9 || cycles != 4 {
+			t.Errorf("m %v: damage %v over %v cycles, want %v over 4", c.m, damage, cycles, c.want)
+		}
+	}
+}
+
+func TestRainflowCommitsClosedCycles(t *testing.T) {
+	f := &fatigueState{}
+	curve := SNCurve{C: 1, M: 1, StressPerG: 1}
+	for _, v := range astmHistory {
+		f.observe(v, 0.5, curve)
+	}
+	// -1 to 3 closes a full cycle of range 4, and the half cycles -2 to 1,
+	// 1 to -3 and -3 to 5 leave the start of the stack. 5, -4 and 4 are left
+	// with -2 still open.
+	if f.cycles != 2.5 || f.damage != 3*0.5+4*0.5+4*1+8*0.5 {
+		t.Fatalf("expected 2.5 cycles with damage 11.5 committed, got %v cycles, damage %v", f.cycles, f.damage)
+	}
+	if !reflect.DeepEqual(f.stack, []float64{5, -4, 4}) || !f.moving || f.last != -2 {
+		t.Fatalf("expected 5, -4, 4 left on the stack and -2 open, got %v and %v", f.stack, f.last)
+	}
+}
+
+func TestRainflowIgnoresReversalsBelowGate(t *testing.T) {
+	var noisy []float64
+	for i, v := range astmHistory {
+		noisy = append(noisy, v)
+		if i+1 < len(astmHistory) {
+			// A small wobble on the way to the next peak.
+			mid := (v + astmHistory[i+1]) / 2
+			noisy = append(noisy, mid, mid-0.2*math.Copysign(1, astmHistory[i+1]-v), mid)
+		}
+	}
+	curve := SNCurve{C: 1, M: 1, StressPerG: 1}
+	wantDamage, wantCycles := rainflowTotals(astmHistory, 0.5, curve)
+	if damage, cycles := rainflowTotals(noisy, 0.5, curve); math.Abs(damage-wantDamage) > 1e-9 || cycles != wantCycles {
+		t.Fatalf("wobbles below the gate changed the count: damage %v over %v cycles, want %v over %v", damage, cycles, wantDamage, wantCycles)
+	}
+	if _, cycles := rainflowTotals(noisy, 0.1, curve); cycles <= wantCycles {
+		t.Fatalf("wobbles above the gate should add cycles, got %v", cycles)
+	}
+}
+
+func TestRainflowWaitsForFirstMove(t *testing.T) {
+	f := &fatigueState{}
+	curve := SNCurve{C: 1, M: 1, StressPerG: 1}
+	for _, v := range []float64{1, 1.01, 0.99, 1} {
+		f.observe(v, 0.05, curve)
+	}
+	if f.moving || len(f.stack) != 1 || f.residualDamage(curve) != 0 {
+		t.Fatalf("noise below the gate should not start the count: %+v", f)
+	}
+}
+
+func TestSNCurveDamage(t *testing.T) {
+	curve := SNCurve{C: 1e6, M: 3, StressPerG: 2, EnduranceLimit: 1}
+	if d := curve.damage(0.5, 1); d != 0 {
+		t.Errorf("a range at the endurance limit should do no damage, got %v", d)
+	}
+	if d, want := curve.damage(5, 2), 2/(1e6*math.Pow(10, -3)); math.Abs(d-want) > 1e-12 {
+		t.Errorf("damage %v, want %v", d, want)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+)
+
+const (
+	filterNone          = "none"
+	filterMovingAverage = "moving_average"
+	filterEMA           = "ema"
+	filterMedian        = "median"
+	filterLowPass       = "lowpass"
+)
+
+type FilterConfig struct {
+	Type     string  `json:"type"`
+	Window   int     `json:"window,omitempty"`
+	Alpha    float64 `json:"alpha,omitempty"`
+	CutoffHz float64 `json:"cutoffHz,omitempty"`
+}
+
+type FilterSettings struct {
+	Default FilterConfig            `json:"default"`
+	Devices map[string]FilterConfig `json:"devices,omitempty"`
+}
+
+type deviceFilter struct {
+	config FilterConfig
+	window []vec3
+	last   vec3
+	lastTs uint64
+	primed bool
+}
+
+var (
+	filterMap      = make(map[vehicleKey]*deviceFilter)
+	filterMapMutex = &sync.Mutex{}
+)
+
+func (f FilterConfig) validate() error {
+	switch f.Type {
+	case filterNone:
+	case filterMovingAverage, filterMedian:
+		if f.Window < 1 {
+			return fmt.Errorf("%s filter needs a window of at least 1", f.Type)
+		}
+	case filterEMA:
+		if f.Alpha <= 0 || f.Alpha > 1 {
+			return fmt.Errorf("ema filter needs 0 < alpha <= 1")
+		}
+	case filterLowPass:
+		if f.CutoffHz <= 0 {
+			return fmt.Errorf("lowpass filter needs a positive cutoffHz")
+		}
+	default:
+		return fmt.Errorf("unknown filter type %q", f.Type)
+	}
+	return nil
+}
+
+func prepareFilterSettings(settings *FilterSettings) (FilterSettings, error) {
+	next := FilterSettings{Default: FilterConfig{Type: filterNone}}
+	if settings != nil {
+		next = *settings
+		if next.Default.Type == "" {
+			next.Default.Type = filterNone
+		}
+	}
+	if err := next.Default.validate(); err != nil {
+		return next, fmt.Errorf("default filter: %v", err)
+	}
+	for id, f := range next.Devices {
+		if err := f.validate(); err != nil {
+			return next, fmt.Errorf("filter for %s: %v", id, err)
+		}
+	}
+	return next, nil
+}
+
+func filterConfigFor(t *Tenant, id string) FilterConfig {
+	settings := t.currentRules().filters
+	if f, found := settings.Devices[id]; found {
+		return f
+	}
+	return settings.Default
+}
+
+// filterReading smooths X/Y/Z with the device's configured filter. State is
+// reset whenever that configuration changes.
+func filterReading(t *Tenant, msg EdisonMessage) EdisonMessage {
+	config := filterConfigFor(t, msg.ID)
+
+	filterMapMutex.Lock()
+	f, found := filterMap[t.key(msg.ID)]
+	if !found || f.config != config {
+		f = &deviceFilter{config: config}
+		filterMap[t.key(msg.ID)] = f
+	}
+	v := f.apply(vec3{msg.X, msg.Y, msg.Z}, msg.Timestamp)
+	filterMapMutex.Unlock()
+
+	msg.X, msg.Y, msg.Z = v[0], v[1], v[2]
+	return msg
+}
+
+func (f *deviceFilter) apply(v vec3, ts uint64) vec3 {
+	switch f.config.Type {
+	case filterMovingAverage:
+		f.push(v)
+		var sum vec3
+		for _, w := range f.window {
+			sum = sum.add(w)
+		}
+		return sum.scale(1 / float64(len(f.window)))
+	case filterMedian:
+		f.push(v)
+		var out vec3
+		for k := range out {
+			values := make([]float64, len(f.window))
+			for i, w := range f.window {
+				values[i] = w[k]
+			}
+			out[k] = median(values)
+		}
+		return out
+	case filterEMA:
+		return f.smooth(v, ts, f.config.Alpha)
+	case filterLowPass:
+		alpha := 0.0
+		if f.primed && ts > f.lastTs {
+			// first-order RC low-pass: alpha = dt / (RC + dt)
+			dt := float64(ts-f.lastTs) / 1000
+			rc := 1 / (2 * math.Pi * f.config.CutoffHz)
+			alpha = dt / (rc + dt)
+		}
+		return f.smooth(v, ts, alpha)
+	}
+	return v
+}
+
+func (f *deviceFilter) push(v vec3) {
+	f.window = append(f.window, v)
+	if len(f.window) > f.config.Window {
+		f.window = f.window[1:]
+	}
+}
+
+func (f *deviceFilter) smooth(v vec3, ts uint64, alpha float64) vec3 {
+	if !f.primed {
+		f.last, f.primed = v, true
+	} else {
+		f.last = f.last.add(v.sub(f.last).scale(alpha))
+	}
+	f.lastTs = ts
+	return f.last
+}
+
+func clearFilters(t *Tenant) {
+	filterMapMutex.Lock()
+	for k := range filterMap {
+		if k.tenant == t.ID {
+			delete(filterMap, k)
+		}
+	}
+	filterMapMutex.Unlock()
+}
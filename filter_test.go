@@ -0,0 +1,121 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func filterTenant(t *testing.T, id string, settings FilterSettings) *Tenant {
+	tenant := newTenant(&Tenant{ID: id})
+	setFilters(t, tenant, settings)
+	return tenant
+}
+
+func setFilters(t *testing.T, tenant *Tenant, settings FilterSettings) {
+	rules, err := compileRules(RuleConfig{Filters: &settings})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenant.setRules(rules)
+}
+
+// filterXs filters readings of car1 with the given X values, 100ms apart.
+func filterXs(tenant *Tenant, xs ...float64) []float64 {
+	var out []float64
+	for i, x := range xs {
+		msg := filterReading(tenant, EdisonMessage{ID: "car1", Timestamp: uint64(1000 + i*100), X: x, Y: -x})
+		if msg.Y != -msg.X {
+			return nil
+		}
+		out = append(out, msg.X)
+	}
+	return out
+}
+
+func closeTo(got, want []float64) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if math.Abs(got[i]-want[i]) > 1e-9 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestFilterKinds(t *testing.T) {
+	// At 1Hz and 100ms apart the low-pass takes each reading in at a.
+	a := 0.1 / (1/(2*math.Pi) + 0.1)
+	y1 := 3 - 3*a
+	y2 := y1 + (6-y1)*a
+	cases := []struct {
+		config FilterConfig
+		want   []float64
+	}{
+		{FilterConfig{Type: filterNone}, []float64{3, 0, 6, 3}},
+		{FilterConfig{Type: filterMovingAverage, Window: 2}, []float64{3, 1.5, 3, 4.5}},
+		{FilterConfig{Type: filterMedian, Window: 3}, []float64{3, 1.5, 3, 3}},
+		{FilterConfig{Type: filterEMA, Alpha: 0.5}, []float64{3, 1.5, 3.75, 3.375}},
+		{FilterConfig{Type: filterLowPass, CutoffHz: 1}, []float64{3, y1, y2, y2 + (3-y2)*a}},
+	}
+	for _, c := range cases {
+		tenant := filterTenant(t, "filter-"+c.config.Type, FilterSettings{Default: c.config})
+		got := filterXs(tenant, 3, 0, 6, 3)
+		if !closeTo(got, c.want) {
+			t.Errorf("%s filter gave %v, want %v", c.config.Type, got, c.want)
+		}
+		clearFilters(tenant)
+	}
+}
+
+func TestFilterPerDevice(t *testing.T) {
+	tenant := filterTenant(t, "filter-device", FilterSettings{
+		Default: FilterConfig{Type: filterNone},
+		Devices: map[string]FilterConfig{"car1": {Type: filterMovingAverage, Window: 2}},
+	})
+	defer clearFilters(tenant)
+
+	filterReading(tenant, EdisonMessage{ID: "car2", Timestamp: 1000, X: 3})
+	if msg := filterReading(tenant, EdisonMessage{ID: "car2", Timestamp: 1100, X: 0}); msg.X != 0 {
+		t.Fatalf("car2 should use the default filter, got %v", msg.X)
+	}
+	if got := filterXs(tenant, 3, 0); !closeTo(got, []float64{3, 1.5}) {
+		t.Fatalf("car1 should use its own filter, got %v", got)
+	}
+}
+
+func TestFilterResetsOnConfigChange(t *testing.T) {
+	tenant := filterTenant(t, "filter-reset", FilterSettings{Default: FilterConfig{Type: filterMovingAverage, Window: 3}})
+	defer clearFilters(tenant)
+
+	filterXs(tenant, 9, 9, 9)
+	setFilters(t, tenant, FilterSettings{Default: FilterConfig{Type: filterMovingAverage, Window: 2}})
+	if got := filterXs(tenant, 1, 3); !closeTo(got, []float64{1, 2}) {
+		t.Fatalf("a changed filter should start from nothing, got %v", got)
+	}
+
+	// An unchanged configuration keeps its state across a reload.
+	setFilters(t, tenant, FilterSettings{Default: FilterConfig{Type: filterMovingAverage, Window: 2}})
+	if got := filterXs(tenant, 5); !closeTo(got, []float64{4}) {
+		t.Fatalf("a reload with the same filter should keep its window, got %v", got)
+	}
+}
+
+func TestFilterConfigValidation(t *testing.T) {
+	for _, f := range []FilterConfig{
+		{Type: filterMovingAverage},
+		{Type: filterMedian, Window: 0},
+		{Type: filterEMA, Alpha: 0},
+		{Type: filterEMA, Alpha: 1.5},
+		{Type: filterLowPass},
+		{Type: "kalman"},
+	} {
+		if _, err := prepareFilterSettings(&FilterSettings{Default: f}); err == nil {
+			t.Errorf("%+v should be refused", f)
+		}
+	}
+	if s, err := prepareFilterSettings(&FilterSettings{}); err != nil || s.Default.Type != filterNone {
+		t.Errorf("an empty default should mean no filter, got %+v %v", s, err)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Chunks are compressed the way Facebook's Gorilla does it: timestamps as
+// delta-of-deltas in variable-width buckets, values XORed with the previous
+// value so only the bits that changed are written.
+
+type bitWriter struct {
+	buf  []byte
+	free uint8
+}
+
+func (w *bitWriter) writeBit(bit bool) {
+	if w.free == 0 {
+		w.buf = append(w.buf, 0)
+		w.free = 8
+	}
+	w.free--
+	if bit {
+		w.buf[len(w.buf)-1] |= 1 << w.free
+	}
+}
+
+func (w *bitWriter) writeBits(v uint64, n uint) {
+	for i := n; i > 0; i-- {
+		w.writeBit(v>>(i-1)&1 == 1)
+	}
+}
+
+type bitReader struct {
+	buf []byte
+	pos uint
+}
+
+func (r *bitReader) readBit() bool {
+	b := r.buf[r.pos/8]>>(7-r.pos%8)&1 == 1
+	r.pos++
+	return b
+}
+
+func (r *bitReader) readBits(n uint) uint64 {
+	var v uint64
+	for i := uint(0); i < n; i++ {
+		v <<= 1
+		if r.readBit() {
+			v |= 1
+		}
+	}
+	return v
+}
+
+// timestamp buckets: control bits, then payload width in bits
+var dodBuckets = []struct {
+	control uint64
+	bits    uint
+	width   uint
+}{
+	{0x2, 2, 7},
+	{0x6, 3, 9},
+	{0xe, 4, 12},
+}
+
+type chunk struct {
+	stream    bitWriter
+	count     int
+	minTs     uint64
+	maxTs     uint64
+	prevDelta int64
+	prevVal   uint64
+	leading   uint
+	trailing  uint
+}
+
+// chunkHeaderSize is the encoder state MarshalBinary writes ahead of the bits.
+const chunkHeaderSize = 40
+
+func fitsSigned(v int64, width uint) bool {
+	return v >= -(1<<(width-1)) && v < 1<<(width-1)
+}
+
+func signExtend(v uint64, width uint) int64 {
+	shift := 64 - width
+	return int64(v<<shift) >> shift
+}
+
+func leadingZeros(v uint64) uint {
+	n := uint(0)
+	for i := 63; i >= 0 && v>>uint(i)&1 == 0; i-- {
+		n++
+	}
+	return n
+}
+
+func trailingZeros(v uint64) uint {
+	n := uint(0)
+	for i := uint(0); i < 64 && v>>i&1 == 0; i++ {
+		n++
+	}
+	return n
+}
+
+// append adds a sample; timestamps must not go backwards.
+func (c *chunk) append(ts uint64, v float64) {
+	bits := math.Float64bits(v)
+	if c.count == 0 {
+		c.stream.writeBits(ts, 64)
+		c.stream.writeBits(bits, 64)
+		c.minTs, c.maxTs, c.prevVal, c.count = ts, ts, bits, 1
+		return
+	}
+
+	delta := int64(ts - c.maxTs)
+	dod := delta - c.prevDelta
+	if dod == 0 {
+		c.stream.writeBit(false)
+	} else {
+		written := false
+		for _, b := range dodBuckets {
+			if fitsSigned(dod, b.width) {
+				c.stream.writeBits(b.control, b.bits)
+				c.stream.writeBits(uint64(dod), b.width)
+				written = true
+				break
+			}
+		}
+		if !written {
+			c.stream.writeBits(0xf, 4)
+			c.stream.writeBits(uint64(dod), 64)
+		}
+	}
+
+	xor := bits ^ c.prevVal
+	if xor == 0 {
+		c.stream.writeBit(false)
+	} else {
+		c.stream.writeBit(true)
+		lead, trail := leadingZeros(xor), trailingZeros(xor)
+		if lead > 31 {
+			lead = 31
+		}
+		if c.leading+c.trailing > 0 && lead >= c.leading && trail >= c.trailing {
+			c.stream.writeBit(false)
+			c.stream.writeBits(xor>>c.trailing, 64-c.leading-c.trailing)
+		} else {
+			sig := 64 - lead - trail
+			c.stream.writeBit(true)
+			c.stream.writeBits(uint64(lead), 5)
+			c.stream.writeBits(uint64(sig-1), 6)
+			c.stream.writeBits(xor>>trail, sig)
+			c.leading, c.trailing = lead, trail
+		}
+	}
+
+	c.prevDelta, c.maxTs, c.prevVal = delta, ts, bits
+	c.count++
+}
+
+// each decodes the chunk in order, stopping early if fn returns false.
+func (c *chunk) each(fn func(ts uint64, v float64) bool) {
+	if c.count == 0 {
+		return
+	}
+	r := &bitReader{buf: c.stream.buf}
+	ts := r.readBits(64)
+	bits := r.readBits(64)
+	if !fn(ts, math.Float64frombits(bits)) {
+		return
+	}
+
+	var delta int64
+	var leading, trailing uint
+	for i := 1; i < c.count; i++ {
+		var dod int64
+		if r.readBit() {
+			matched := false
+			for _, b := range dodBuckets {
+				if !r.readBit() {
+					dod = signExtend(r.readBits(b.width), b.width)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				dod = int64(r.readBits(64))
+			}
+		}
+		delta += dod
+		ts = uint64(int64(ts) + delta)
+
+		if r.readBit() {
+			if r.readBit() {
+				leading = uint(r.readBits(5))
+				sig := uint(r.readBits(6)) + 1
+				trailing = 64 - leading - sig
+			}
+			bits ^= r.readBits(64-leading-trailing) << trailing
+		}
+		if !fn(ts, math.Float64frombits(bits)) {
+			return
+		}
+	}
+}
+
+func (c *chunk) size() int {
+	return len(c.stream.buf)
+}
+
+// MarshalBinary encodes the chunk along with the encoder state needed to keep
+// appending to it once it is read back.
+func (c *chunk) MarshalBinary() ([]byte, error) {
+	out := make([]byte, chunkHeaderSize+len(c.stream.buf))
+	binary.BigEndian.PutUint32(out[0:4], uint32(c.count))
+	out[4], out[5], out[6] = c.stream.free, uint8(c.leading), uint8(c.trailing)
+	binary.BigEndian.PutUint64(out[8:16], c.minTs)
+	binary.BigEndian.PutUint64(out[16:24], c.maxTs)
+	binary.BigEndian.PutUint64(out[24:32], uint64(c.prevDelta))
+	binary.BigEndian.PutUint64(out[32:40], c.prevVal)
+	copy(out[chunkHeaderSize:], c.stream.buf)
+	return out, nil
+}
+
+func (c *chunk) UnmarshalBinary(data []byte) error {
+	if len(data) < chunkHeaderSize {
+		return fmt.Errorf("chunk is %d bytes, too short", len(data))
+	}
+	count := int(binary.BigEndian.Uint32(data[0:4]))
+	free, leading, trailing := data[4], uint(data[5]), uint(data[6])
+	buf := append([]byte(nil), data[chunkHeaderSize:]...)
+	bits := len(buf)*8 - int(free)
+	if free > 7 || leading+trailing > 64 || (count == 0) != (len(buf) == 0) || (count > 0 && bits < 128) {
+		return fmt.Errorf("chunk header is inconsistent")
+	}
+	*c = chunk{
+		stream:    bitWriter{buf: buf, free: free},
+		count:     count,
+		minTs:     binary.BigEndian.Uint64(data[8:16]),
+		maxTs:     binary.BigEndian.Uint64(data[16:24]),
+		prevDelta: int64(binary.BigEndian.Uint64(data[24:32])),
+		prevVal:   binary.BigEndian.Uint64(data[32:40]),
+		leading:   leading,
+		trailing:  trailing,
+	}
+	return nil
+}
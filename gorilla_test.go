@@ -0,0 +1,105 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+// chunkSamples covers every delta-of-delta bucket, including the 64-bit
+// fallback, and repeated, small and large value changes.
+func chunkSamples() []Point {
+	ts := uint64(1000000)
+	steps := []uint64{1000, 1000, 1000, 1001, 1050, 1300, 3000, 1000, 1 << 40, 1000, 0, 0, 7}
+	values := []float64{0, 0, 1.5, 1.5, -1.5, 1e300, 1e-300, math.Inf(1), 42, 42, 42.0000001, -0, 3}
+	var out []Point
+	for i, step := range steps {
+		ts += step
+		out = append(out, Point{ts, values[i]})
+	}
+	for i := 0; i < 200; i++ {
+		ts += 250
+		out = append(out, Point{ts, math.Sin(float64(i) / 10)})
+	}
+	return out
+}
+
+func decodeChunk(c *chunk) []Point {
+	var out []Point
+	c.each(func(ts uint64, v float64) bool {
+		out = append(out, Point{ts, v})
+		return true
+	})
+	return out
+}
+
+func TestChunkRoundTrip(t *testing.T) {
+	want := chunkSamples()
+	c := &chunk{}
+	for _, p := range want {
+		c.append(p.Ts, p.V)
+	}
+	if got := decodeChunk(c); !reflect.DeepEqual(got, want) {
+		t.Fatalf("decoded samples differ\n got %v\nwant %v", got, want)
+	}
+	if c.minTs != want[0].Ts || c.maxTs != want[len(want)-1].Ts {
+		t.Fatalf("bounds %d..%d, want %d..%d", c.minTs, c.maxTs, want[0].Ts, want[len(want)-1].Ts)
+	}
+}
+
+func TestChunkEachStopsEarly(t *testing.T) {
+	c := &chunk{}
+	for _, p := range chunkSamples() {
+		c.append(p.Ts, p.V)
+	}
+	seen := 0
+	c.each(func(ts uint64, v float64) bool {
+		seen++
+		return seen < 3
+	})
+	if seen != 3 {
+		t.Fatalf("each kept going after fn returned false: %d calls", seen)
+	}
+}
+
+func TestChunkMarshalKeepsAppending(t *testing.T) {
+	want := chunkSamples()
+	for _, split := range []int{0, 1, 2, 9, len(want)} {
+		c := &chunk{}
+		for _, p := range want[:split] {
+			c.append(p.Ts, p.V)
+		}
+		data, err := c.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		back := &chunk{}
+		if err = back.UnmarshalBinary(data); err != nil {
+			t.Fatalf("split %d: %v", split, err)
+		}
+		for _, p := range want[split:] {
+			back.append(p.Ts, p.V)
+		}
+		if got := decodeChunk(back); !reflect.DeepEqual(got, want) {
+			t.Fatalf("split %d: decoded samples differ\n got %v\nwant %v", split, got, want)
+		}
+	}
+}
+
+func TestChunkUnmarshalRejectsBadHeader(t *testing.T) {
+	c := &chunk{}
+	c.append(1000, 1)
+	data, _ := c.MarshalBinary()
+
+	if err := (&chunk{}).UnmarshalBinary(data[:chunkHeaderSize-1]); err == nil {
+		t.Fatalf("a short chunk should be rejected")
+	}
+	bad := append([]byte(nil), data...)
+	bad[4] = 8
+	if err := (&chunk{}).UnmarshalBinary(bad); err == nil {
+		t.Fatalf("a chunk with 8 free bits should be rejected")
+	}
+	if err := (&chunk{}).UnmarshalBinary(data[:chunkHeaderSize+8]); err == nil {
+		t.Fatalf("a chunk too short for its first sample should be rejected")
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// /vehicles/{id}/readings and /vehicles/{id}/events serve the local store.
+// Both take from and to (ms, to exclusive), and optionally step (ms) with an
+// agg of min, max, mean, count or p95 to roll samples up into buckets. format
+// picks json (the default), csv, or kairosdb for dashboards written against
+// /queryTS. kairosdb events are served as running counts, like the APM
+// service holds them, whatever agg is asked for.
+//
+// Each series is read from the tier picked by pickTier, so a long range with a
+// coarse step is answered from rollups rather than raw samples.
+
+var (
+	readingMetrics = []string{"x", "y", "z", "miles"}
+	aggregations   = map[string]func(bucketStats) float64{
+		"min":   func(b bucketStats) float64 { return b.Min },
+		"max":   func(b bucketStats) float64 { return b.Max },
+		"mean":  func(b bucketStats) float64 { return b.Sum / b.Count },
+		"count": func(b bucketStats) float64 { return b.Count },
+		"p95":   func(b bucketStats) float64 { return b.P95 },
+	}
+)
+
+type HistoryQuery struct {
+	From    uint64 `json:"from"`
+	To      uint64 `json:"to"`
+	Step    uint64 `json:"step,omitempty"`
+	Agg     string `json:"agg"`
+	metrics []string
+	format  string
+}
+
+// HistoryResult reports the step each series was answered at: 0 for raw
+// samples, otherwise the bucket width, which can be wider than asked for when
+// the query reaches back past the raw data.
+type HistoryResult struct {
+	CarID  string             `json:"carId"`
+	Query  HistoryQuery       `json:"query"`
+	Steps  map[string]uint64  `json:"steps"`
+	Series map[string][]Point `json:"series"`
+}
+
+func parseMs(r *http.Request, name string, fallback uint64) (uint64, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return fallback, nil
+	}
+	n, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a timestamp in ms", name)
+	}
+	return n, nil
+}
+
+func parseHistoryQuery(r *http.Request, metrics []string, defaultAgg string) (HistoryQuery, error) {
+	q := HistoryQuery{metrics: metrics, format: r.URL.Query().Get("format")}
+	var err error
+	if q.From, err = parseMs(r, "from", 0); err != nil {
+		return q, err
+	}
+	if q.To, err = parseMs(r, "to", math.MaxUint64); err != nil {
+		return q, err
+	}
+	if q.Step, err = parseMs(r, "step", 0); err != nil {
+		return q, err
+	}
+	if q.To <= q.From {
+		return q, fmt.Errorf("to must be after from")
+	}
+	q.Agg = r.URL.Query().Get("agg")
+	if q.Agg == "" {
+		q.Agg = defaultAgg
+	}
+	if _, found := aggregations[q.Agg]; !found {
+		return q, fmt.Errorf("unknown agg %q", q.Agg)
+	}
+	switch q.format {
+	case "":
+		q.format = "json"
+	case "json", "csv", "kairosdb":
+	default:
+		return q, fmt.Errorf("unknown format %q", q.format)
+	}
+	return q, nil
+}
+
+// pickMetrics narrows the available metrics down to the requested ones.
+func pickMetrics(available []string, requested string) ([]string, error) {
+	if requested == "" {
+		return available, nil
+	}
+	known := make(map[string]bool)
+	for _, m := range available {
+		known[m] = true
+	}
+	var out []string
+	for _, m := range splitList(requested) {
+		if !known[m] {
+			return nil, fmt.Errorf("unknown metric %q", m)
+		}
+		out = append(out, m)
+	}
+	return out, nil
+}
+
+func runHistoryQuery(t *Tenant, carId string, q HistoryQuery, names func(string) string) HistoryResult {
+	k := t.key(carId)
+	res := HistoryResult{CarID: carId, Query: q, Steps: make(map[string]uint64), Series: make(map[string][]Point)}
+	config := t.currentRules().storage
+	now := nowMs()
+	for _, metric := range q.metrics {
+		tier := pickTier(config, metric, q.From, q.Step, now)
+		step, base := q.Step, q.From
+		if tier > 0 {
+			step = (step + tier - 1) / tier * tier
+			if step == 0 {
+				step = tier
+			}
+			base -= base % tier
+		}
+
+		stats := readTierStats(k, metric, tier, base, q.To)
+		if step > 0 {
+			stats = combine(stats, base, step)
+		}
+		points := make([]Point, len(stats))
+		for i, b := range stats {
+			points[i] = Point{b.Ts, b.Sum}
+			if step > 0 {
+				points[i].V = aggregations[q.Agg](b)
+			}
+		}
+		res.Steps[names(metric)] = step
+		res.Series[names(metric)] = points
+	}
+	return res
+}
+
+func vehicleReadings(w http.ResponseWriter, r *http.Request, t *Tenant, v Vehicle) {
+	metrics, err := pickMetrics(readingMetrics, r.URL.Query().Get("metric"))
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+		return
+	}
+	q, err := parseHistoryQuery(r, metrics, "mean")
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+		return
+	}
+	writeHistory(w, v, runHistoryQuery(t, v.ID, q, func(m string) string { return m }), q.format)
+}
+
+func vehicleEvents(w http.ResponseWriter, r *http.Request, t *Tenant, v Vehicle) {
+	var events []string
+	for _, m := range deviceMetrics(t.key(v.ID), eventSeriesPrefix) {
+		events = append(events, strings.TrimPrefix(m, eventSeriesPrefix))
+	}
+	events, err := pickMetrics(events, r.URL.Query().Get("event"))
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+		return
+	}
+	q, err := parseHistoryQuery(r, nil, "count")
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+		return
+	}
+	for _, e := range events {
+		q.metrics = append(q.metrics, eventSeriesPrefix+e)
+	}
+	if q.format == "kairosdb" {
+		q.Agg = "count"
+	}
+	res := runHistoryQuery(t, v.ID, q, func(m string) string { return strings.TrimPrefix(m, eventSeriesPrefix) })
+	if q.format == "kairosdb" {
+		res = runningCounts(t, v, res)
+	}
+	writeHistory(w, v, res, q.format)
+}
+
+// eventTag is the tag an event's count is posted to the APM service under.
+func eventTag(t *Tenant, event string) string {
+	switch event {
+	case crashEvent:
+		return crashTag
+	case anomalyEvent:
+		return anomalyTag(t)
+	}
+	for _, r := range t.currentRules().rules {
+		if r.Event == event {
+			return r.Tag
+		}
+	}
+	return event
+}
+
+// eventsSince counts a vehicle's events from ts on, reading each stretch from
+// the finest tier that still holds it.
+func eventsSince(t *Tenant, carId string, event string, ts uint64) float64 {
+	metric := eventSeriesPrefix + event
+	tier := pickTier(t.currentRules().storage, metric, ts, 0, nowMs())
+	var n float64
+	for _, b := range readTierStats(t.key(carId), metric, tier, ts, math.MaxUint64) {
+		n += b.Count
+	}
+	return n
+}
+
+// runningCounts turns per-event counts into the running totals posted to the
+// APM service, renaming each series to its tag. Events before the query are
+// worked out from the vehicle's total, so they count even once retention has
+// dropped them.
+func runningCounts(t *Tenant, v Vehicle, res HistoryResult) HistoryResult {
+	out := HistoryResult{CarID: res.CarID, Query: res.Query, Steps: make(map[string]uint64), Series: make(map[string][]Point)}
+	for _, event := range historyNames(res) {
+		points := res.Series[event]
+		var inRange float64
+		for _, p := range points {
+			if res.Steps[event] == 0 {
+				inRange++
+			} else {
+				inRange += p.V
+			}
+		}
+		after := float64(0)
+		if res.Query.To != math.MaxUint64 {
+			after = eventsSince(t, v.ID, event, res.Query.To)
+		}
+		total := math.Max(float64(v.Events[event])-inRange-after, 0)
+		running := make([]Point, len(points))
+		for i, p := range points {
+			if res.Steps[event] == 0 {
+				total++
+			} else {
+				total += p.V
+			}
+			running[i] = Point{p.Ts, total}
+		}
+		tag := eventTag(t, event)
+		out.Steps[tag] = res.Steps[event]
+		out.Series[tag] = running
+	}
+	return out
+}
+
+func writeHistory(w http.ResponseWriter, v Vehicle, res HistoryResult, format string) {
+	switch format {
+	case "csv":
+		writeHistoryCSV(w, res)
+	case "kairosdb":
+		writeJSON(w, kairosResponse(v, res))
+	default:
+		writeJSON(w, res)
+	}
+}
+
+func historyNames(res HistoryResult) []string {
+	names := make([]string, 0, len(res.Series))
+	for name := range res.Series {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func writeHistoryCSV(w http.ResponseWriter, res HistoryResult) {
+	w.Header().Set("Content-Type", "text/csv")
+	out := csv.NewWriter(w)
+	out.Write([]string{"carId", "series", "ts", "value"})
+	for _, name := range historyNames(res) {
+		for _, p := range res.Series[name] {
+			out.Write([]string{res.CarID, name, strconv.FormatUint(p.Ts, 10), strconv.FormatFloat(p.V, 'g', -1, 64)})
+		}
+	}
+	out.Flush()
+	if err := out.Error(); err != nil {
+		fmt.Println("ERROR: could not write csv:", err)
+	}
+}
+
+// kairosResponse mirrors what the APM time series service returns for
+// responseFormat=KAIROSDB, naming each series <apmId>.<series>. Event series
+// have been through runningCounts and so match the tags the router posts
+// there; readings keep their metric names, which are not posted.
+func kairosResponse(v Vehicle, res HistoryResult) map[string]interface{} {
+	prefix := v.ApmID
+	if prefix == "" {
+		prefix = v.ID
+	}
+	var queries []interface{}
+	for _, name := range historyNames(res) {
+		values := make([][]interface{}, 0, len(res.Series[name]))
+		for _, p := range res.Series[name] {
+			values = append(values, []interface{}{p.Ts, p.V, 3})
+		}
+		queries = append(queries, map[string]interface{}{
+			"sample_size": len(values),
+			"results": []interface{}{map[string]interface{}{
+				"name":     fmt.Sprintf("%s.%s", prefix, name),
+				"group_by": []interface{}{map[string]string{"name": "type", "type": "number"}},
+				"tags":     map[string]interface{}{},
+				"values":   values,
+			}},
+		})
+	}
+	if queries == nil {
+		queries = []interface{}{}
+	}
+	return map[string]interface{}{"queries": queries}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// withEvents gives car1, bound to asset A1, hardAcc events 1s to 5s after
+// base, a recent whole minute so the raw samples are still kept.
+func withEvents(t *testing.T, base uint64) (*Tenant, Vehicle) {
+	tenant := newTenant(&Tenant{ID: "history-events"})
+	tenant.registry.setAssets([]string{"A1"})
+	if err := tenant.registry.observe(EdisonMessage{ID: "car1", Timestamp: 1}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 5; i++ {
+		tenant.registry.count("car1", "hardAcc", SeverityBand{})
+		storeEventPoint(tenant, "car1", "hardAcc", base+uint64(i*1000), 1.5)
+	}
+	v, _ := tenant.registry.vehicle("car1")
+	return tenant, v
+}
+
+func kairosEvents(t *testing.T, tenant *Tenant, v Vehicle, query string) map[string][][]float64 {
+	w := httptest.NewRecorder()
+	vehicleEvents(w, httptest.NewRequest("GET", "/vehicles/car1/events?format=kairosdb&"+query, nil), tenant, v)
+	if w.Code != 200 {
+		t.Fatalf("%s: status %d: %s", query, w.Code, w.Body.String())
+	}
+	var body struct {
+		Queries []struct {
+			Results []struct {
+				Name   string      `json:"name"`
+				Values [][]float64 `json:"values"`
+			} `json:"results"`
+		} `json:"queries"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	out := make(map[string][][]float64)
+	for _, q := range body.Queries {
+		for _, r := range q.Results {
+			out[r.Name] = r.Values
+		}
+	}
+	return out
+}
+
+func TestKairosEventsAreRunningCounts(t *testing.T) {
+	base := nowMs()/60000*60000 - 10*60000
+	tenant, v := withEvents(t, base)
+	defer resetTenant(tenant)
+
+	b := float64(base)
+	cases := []struct {
+		from  uint64
+		extra string
+		want  [][]float64
+	}{
+		{0, "", [][]float64{{b + 1000, 1, 3}, {b + 2000, 2, 3}, {b + 3000, 3, 3}, {b + 4000, 4, 3}, {b + 5000, 5, 3}}},
+		{2500, fmt.Sprintf("&to=%d", base+4500), [][]float64{{b + 3000, 3, 3}, {b + 4000, 4, 3}}},
+		{2500, fmt.Sprintf("&to=%d&agg=max", base+4500), [][]float64{{b + 3000, 3, 3}, {b + 4000, 4, 3}}},
+		{0, "&step=2000", [][]float64{{b, 1, 3}, {b + 2000, 3, 3}, {b + 4000, 5, 3}}},
+		{6000, "", [][]float64{}},
+	}
+	for _, c := range cases {
+		query := fmt.Sprintf("from=%d%s", base+c.from, c.extra)
+		got := kairosEvents(t, tenant, v, query)
+		if len(got) != 1 || !reflect.DeepEqual(got["A1.Tag_Hard_Acceleration_1"], c.want) {
+			t.Errorf("%s: got %v, want A1.Tag_Hard_Acceleration_1 %v", query, got, c.want)
+		}
+	}
+}
+
+func TestEventTag(t *testing.T) {
+	tenant := newTenant(&Tenant{ID: "history-tags"})
+	cases := map[string]string{
+		"hardBreak":  "Tag_Hard_Breaks_1",
+		crashEvent:   crashTag,
+		anomalyEvent: anomalyTag(tenant),
+		"unknown":    "unknown",
+	}
+	for event, want := range cases {
+		if got := eventTag(tenant, event); got != want {
+			t.Errorf("eventTag(%s) = %s, want %s", event, got, want)
+		}
+	}
+}
+
+func TestKairosReadingsKeepMetricNames(t *testing.T) {
+	v := Vehicle{ID: "car1", ApmID: "A1"}
+	res := HistoryResult{Series: map[string][]Point{"miles": {{1000, 2}}}}
+	queries := kairosResponse(v, res)["queries"].([]interface{})
+	results := queries[0].(map[string]interface{})["results"].([]interface{})
+	if name := results[0].(map[string]interface{})["name"]; name != "A1.miles" {
+		t.Fatalf("expected A1.miles, got %v", name)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const wsWriteTimeout = 2 * time.Second
+
+func listen(w http.ResponseWriter, r *http.Request, t *Tenant) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	c, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	// A new client is first sent the status the others already have, since
+	// only changes are broadcast.
+	t.connsMutex.Lock()
+	for _, msg := range publishedStatus(t) {
+		c.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		if err = c.WriteMessage(messageTypeText, []byte(msg)); err != nil {
+			t.connsMutex.Unlock()
+			fmt.Println("ERROR: could not write to ws")
+			c.Close()
+			return
+		}
+	}
+	t.conns[c] = true
+	t.connsMutex.Unlock()
+
+	go drain(t, c)
+}
+
+// drain reads until the client goes away so control frames are handled and
+// closed connections are dropped from the broadcast set.
+func drain(t *Tenant, c *websocket.Conn) {
+	for {
+		if _, _, err := c.NextReader(); err != nil {
+			dropConn(t, c)
+			return
+		}
+	}
+}
+
+func hasConns(t *Tenant) bool {
+	t.connsMutex.Lock()
+	defer t.connsMutex.Unlock()
+	return len(t.conns) > 0
+}
+
+func dropConn(t *Tenant, c *websocket.Conn) {
+	t.connsMutex.Lock()
+	delete(t.conns, c)
+	t.connsMutex.Unlock()
+	c.Close()
+}
+
+// broadcast sends a message to the tenant's websocket clients only.
+func broadcast(t *Tenant, msg string) {
+	t.connsMutex.Lock()
+	defer t.connsMutex.Unlock()
+	for c := range t.conns {
+		c.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		err := c.WriteMessage(messageTypeText, []byte(msg))
+		if err != nil {
+			fmt.Println("ERROR: could not write to ws")
+			delete(t.conns, c)
+			go c.Close()
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// VehicleHistory is what a LifetimeModel gets to work with.
+type VehicleHistory struct {
+	CarID     string
+	Miles     float64
+	Events    map[string]int
+	Severity  map[string]map[string]int
+	Penalty   float64
+	Recovered float64
+	Damage    float64
+}
+
+type Lifetime struct {
+	Value float64 `json:"value"`
+	Units string  `json:"units"`
+	Model string  `json:"model"`
+}
+
+// LifetimeModel estimates remaining life from a vehicle's event history.
+type LifetimeModel interface {
+	Name() string
+	Remaining(h VehicleHistory) Lifetime
+}
+
+type LifetimeSettings struct {
+	Default  string            `json:"default"`
+	Vehicles map[string]string `json:"vehicles,omitempty"`
+}
+
+// linearModel is the original formula: every weighted event not yet earned
+// back through recovery takes scalingFactor off lifetimeMax, capped at 200000.
+type linearModel struct{}
+
+func (linearModel) Name() string { return "linear" }
+
+func (m linearModel) Remaining(h VehicleHistory) Lifetime {
+	return Lifetime{
+		Value: math.Min(float64(lifetimeMax)-float64(scalingFactor)*(h.Penalty-h.Recovered), float64(200000)),
+		Units: "points",
+		Model: m.Name(),
+	}
+}
+
+var (
+	lifetimeModels      = make(map[string]LifetimeModel)
+	lifetimeModelsMutex = &sync.RWMutex{}
+)
+
+func init() {
+	registerLifetimeModel(linearModel{})
+}
+
+func registerLifetimeModel(m LifetimeModel) {
+	lifetimeModelsMutex.Lock()
+	lifetimeModels[m.Name()] = m
+	lifetimeModelsMutex.Unlock()
+}
+
+func lifetimeModelNames() []string {
+	lifetimeModelsMutex.RLock()
+	defer lifetimeModelsMutex.RUnlock()
+	names := make([]string, 0, len(lifetimeModels))
+	for name := range lifetimeModels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func prepareLifetimeSettings(settings *LifetimeSettings) (LifetimeSettings, error) {
+	next := LifetimeSettings{Default: "linear"}
+	if settings != nil {
+		next = *settings
+		if next.Default == "" {
+			next.Default = "linear"
+		}
+	}
+
+	lifetimeModelsMutex.RLock()
+	defer lifetimeModelsMutex.RUnlock()
+	if _, found := lifetimeModels[next.Default]; !found {
+		return next, fmt.Errorf("unknown lifetime model %q", next.Default)
+	}
+	for id, name := range next.Vehicles {
+		if _, found := lifetimeModels[name]; !found {
+			return next, fmt.Errorf("unknown lifetime model %q for %s", name, id)
+		}
+	}
+	return next, nil
+}
+
+func lifetimeModelFor(t *Tenant, carId string) LifetimeModel {
+	settings := t.currentRules().lifetime
+	lifetimeModelsMutex.RLock()
+	defer lifetimeModelsMutex.RUnlock()
+	name, found := settings.Vehicles[carId]
+	if !found {
+		name = settings.Default
+	}
+	return lifetimeModels[name]
+}
+
+func vehicleHistory(t *Tenant, carId string) VehicleHistory {
+	v, _ := t.registry.vehicle(carId)
+	return historyOf(t, v)
+}
+
+// historyOf builds a model's input from one snapshot of the vehicle so the
+// counters and penalty it sees are consistent with each other.
+func historyOf(t *Tenant, v Vehicle) VehicleHistory {
+	return VehicleHistory{
+		CarID:     v.ID,
+		Miles:     v.Miles,
+		Events:    v.Events,
+		Severity:  v.Severity,
+		Penalty:   v.Penalty,
+		Recovered: recovered(t, v.ID),
+		Damage:    fatigueReport(t, v.ID).Damage,
+	}
+}
+
+func lifetimeFor(t *Tenant, carId string) Lifetime {
+	return lifetimeModelFor(t, carId).Remaining(vehicleHistory(t, carId))
+}
+
+func lifetimeOf(t *Tenant, v Vehicle) Lifetime {
+	return lifetimeModelFor(t, v.ID).Remaining(historyOf(t, v))
+}
+
+func listLifetimeModels(w http.ResponseWriter, r *http.Request, t *Tenant) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	settings := t.currentRules().lifetime
+	writeJSON(w, map[string]interface{}{
+		"models":   lifetimeModelNames(),
+		"settings": settings,
+	})
+}
@@ -0,0 +1,55 @@
+package main
+
+import "testing"
+
+func TestLinearModel(t *testing.T) {
+	cases := []struct {
+		penalty, recovered float64
+		want               float64
+	}{
+		{0, 0, 150000},
+		{10, 0, 145000},
+		{10, 4, 147000},
+		{1000, 0, -350000},
+		// Credit beyond the penalty is capped at 200000.
+		{0, 60, 180000},
+		{0, 1000, 200000},
+	}
+	for _, c := range cases {
+		l := linearModel{}.Remaining(VehicleHistory{Penalty: c.penalty, Recovered: c.recovered})
+		if l.Value != c.want || l.Units != "points" || l.Model != "linear" {
+			t.Errorf("penalty %v recovered %v gave %+v, want %v points", c.penalty, c.recovered, l, c.want)
+		}
+	}
+}
+
+func TestLifetimeSettingsRefuseUnknownModels(t *testing.T) {
+	if _, err := prepareLifetimeSettings(&LifetimeSettings{Default: "exponential"}); err == nil {
+		t.Errorf("an unknown default model should be refused")
+	}
+	if _, err := prepareLifetimeSettings(&LifetimeSettings{Vehicles: map[string]string{"car1": "exponential"}}); err == nil {
+		t.Errorf("an unknown model for a vehicle should be refused")
+	}
+	if _, err := compileRules(RuleConfig{Lifetime: &LifetimeSettings{Default: "exponential"}}); err == nil {
+		t.Errorf("rules naming an unknown model should not compile")
+	}
+	s, err := prepareLifetimeSettings(&LifetimeSettings{})
+	if err != nil || s.Default != "linear" {
+		t.Errorf("an empty default should mean linear, got %+v %v", s, err)
+	}
+}
+
+func TestLifetimeModelPerVehicle(t *testing.T) {
+	tenant := newTenant(&Tenant{ID: "lifetime"})
+	rules, err := compileRules(RuleConfig{Lifetime: &LifetimeSettings{Default: "linear", Vehicles: map[string]string{"car2": "rainflow"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenant.setRules(rules)
+	if m := lifetimeModelFor(tenant, "car1").Name(); m != "linear" {
+		t.Errorf("car1 should use the default model, got %s", m)
+	}
+	if m := lifetimeModelFor(tenant, "car2").Name(); m != "rainflow" {
+		t.Errorf("car2 should use its own model, got %s", m)
+	}
+}
@@ -5,12 +5,9 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"math"
 	"net/http"
 	"os"
 	"strings"
-	"sync"
-	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -29,101 +26,136 @@ type EdisonMessage struct {
 }
 
 var (
-	conn                *websocket.Conn
 	accThreshold        = 1.2
 	lifetimeMax         = 150000
 	scalingFactor       = 500
 	mobileScalingFactor = 25.00
 	messageTypeText     = 1
-	assetIds            = []string{"320I-UID1", "320I-UID2", "320I-UID3", "320I-UID4", "320I-UID5", "320I-UID6", "320I-UID7", "320I-UID8", "320I-UID9", "320I-UID10", "320I-UID11", "320I-UID12"}
-	assetIdMap          = make(map[string]string)
-	decMap              = make(map[string]int)
-	accMap              = make(map[string]int)
-	milesMap            = make(map[string]float64)
-	startMap            = make(map[string]uint64)
 	upgrader            = websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
 		CheckOrigin:     func(r *http.Request) bool { return true },
 	}
 
-	assetIdMapMutex = &sync.Mutex{}
-	decMapMutex     = &sync.Mutex{}
-	accMapMutex     = &sync.Mutex{}
-	milesMapMutex   = &sync.Mutex{}
-	startMapMutex   = &sync.Mutex{}
-	token           = os.Getenv("TOKEN")
+	token     = os.Getenv("TOKEN")
+	apmTenant = "E1AB6F7711A5403FB2B607EA1306D94F"
 )
 
-func storeEvent(ts uint64, val float64, tag string, apmId string, lifetime int, accs int) {
+type tagValue struct {
+	tag string
+	v   interface{}
+}
+
+// storeEvent posts the vehicle's total count of the event to its tag and, when
+// the event's severity band has a tag suffix, the count in that band to the
+// suffixed tag. It posts nothing for a vehicle still waiting for an asset, as
+// do the other per-vehicle posts.
+func storeEvent(t *Tenant, ts uint64, val float64, tag string, suffix string, apmId string, lifetime int, count int, bandCount int) {
+	if apmId == "" {
+		return
+	}
+	tags := []tagValue{
+		{tag, val},
+		{fmt.Sprintf("%s.%s", apmId, "lifespan"), lifetime},
+		{fmt.Sprintf("%s.%s", apmId, tag), count},
+	}
+	if suffix != "" {
+		tags = append(tags, tagValue{fmt.Sprintf("%s.%s%s", apmId, tag, suffix), bandCount})
+	}
+	storeTags(t, ts, tags)
+}
+
+// storeTags posts to the APM time series service with the tenant's
+// credentials.
+func storeTags(t *Tenant, ts uint64, tags []tagValue) {
 	url := "https://apm-timeseries-services-hackapm.run.aws-usw02-pr.ice.predix.io/v2/time_series?file_type=json"
 	body := "{\"tags\": ["
-	body += fmt.Sprintf("{\"tagId\": \"%s\",\"errorCode\": null,\"errorMessage\": null,\"data\": [{\"ts\": %d,\"v\": \"%v\",\"q\": \"3\"}]},", tag, ts, val)
-	body += fmt.Sprintf("{\"tagId\": \"%s\",\"errorCode\": null,\"errorMessage\": null,\"data\": [{\"ts\": %d,\"v\": \"%v\",\"q\": \"3\"}]},", fmt.Sprintf("%s.%s", apmId, "lifespan"), ts, lifetime)
-	body += fmt.Sprintf("{\"tagId\": \"%s\",\"errorCode\": null,\"errorMessage\": null,\"data\": [{\"ts\": %d,\"v\": \"%v\",\"q\": \"3\"}]}", fmt.Sprintf("%s.%s", apmId, tag), ts, accs)
+	for i, tv := range tags {
+		if i > 0 {
+			body += ","
+		}
+		body += fmt.Sprintf("{\"tagId\": \"%s\",\"errorCode\": null,\"errorMessage\": null,\"data\": [{\"ts\": %d,\"v\": \"%v\",\"q\": \"3\"}]}", tv.tag, ts, tv.v)
+	}
 	body += "]}"
 
-	fmt.Println("BODY: ", body)
 	payload := strings.NewReader(body)
 
 	req, _ := http.NewRequest("POST", url, payload)
 
-	req.Header.Add("authorization", token)
-	req.Header.Add("tenant", "E1AB6F7711A5403FB2B607EA1306D94F")
+	req.Header.Add("authorization", t.Token)
+	req.Header.Add("tenant", t.APMTenant)
 	req.Header.Add("content-type", "application/json")
 	req.Header.Add("accept", "application/json")
 	req.Header.Add("cache-control", "no-cache")
 	req.Header.Add("postman-token", "357e82d4-fc97-3895-df56-9ff67b8a4a98")
 
-	res, _ := http.DefaultClient.Do(req)
-	fmt.Println("%v", res)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Println("ERROR: could not post to apm ts:", err)
+		return
+	}
+	defer res.Body.Close()
 	if res.StatusCode > 299 {
-		fmt.Println("ERROR: bad status code while posting to apm ts")
+		fmt.Printf("ERROR: bad status code %d while posting to apm ts: %s\n", res.StatusCode, body)
 	}
 }
 
-func detectAccelerations(msg EdisonMessage) {
-	var err error
-	msgId := msg.ID
+func process(t *Tenant, msg EdisonMessage) {
+	storeReading(t, msg)
+	trackSpeed(t, msg)
+	trackTrip(t, msg)
+	msg = orient(t, msg)
+	detectCrash(t, msg)
+	filtered := filterReading(t, msg)
+	detectAccelerations(t, filtered)
+	trackFatigue(t, filtered)
+	trackRecovery(t, msg, vehicleHistory(t, msg.ID).Penalty)
+	trackAlertMiles(t, msg)
+	trackRUL(t, msg)
+}
 
-	if (msg.X > accThreshold) || (msg.Y > accThreshold) {
-		accMapMutex.Lock()
-		accMap[msgId] = accMap[msgId] + 1
-		accMapMutex.Unlock()
-		go storeEvent(msg.Timestamp, math.Max(msg.X, msg.Y), "Tag_Hard_Acceleration_1", assetIdMap[msgId], calcLifetime(msgId), accMap[msgId])
-		if conn == nil {
-			fmt.Println("ERROR: no active conns")
-			return
-		}
-		err = conn.WriteMessage(1, []byte(fmt.Sprintf("{\"carId\":\"%s\", \"apmId\":\"%s\", \"hardAcc\": %d, \"miles\": %d, \"lifetime\": %d}", msgId, assetIdMap[msgId], accMap[msgId], int(msg.Miles), calcLifetime(msgId))))
-		if err != nil {
-			fmt.Println("ERROR: could not write hard acc to ws")
-		}
-		time.Sleep(10 * time.Millisecond) //to stop concurrent ws writes
+func detectAccelerations(t *Tenant, msg EdisonMessage) {
+	for _, f := range evaluateRules(t, msg) {
+		emitEvent(t, msg, f.rule.Event, f.value, f.rule.Tag, f.rule.Severity)
+	}
+	if score, found := detectAnomaly(t, msg); found {
+		emitEvent(t, msg, anomalyEvent, score, anomalyTag(t), "moderate")
 	}
+}
 
-	if (msg.X < -1*accThreshold) || (msg.Y < -1*accThreshold) {
-		decMapMutex.Lock()
-		decMap[msgId] = decMap[msgId] + 1
-		decMapMutex.Unlock()
+func emitEvent(t *Tenant, msg EdisonMessage, event string, value float64, tag string, severity string) {
+	msgId := msg.ID
+	apmId := t.registry.apmId(msgId)
+	band := classify(t.severity(), event, value, severity)
+	count, bandCount := recordEvent(t, msg.Timestamp, msgId, event, value, band)
+	speed, maxSpeed := speeds(t, msgId)
+	score := vehicleScore(t, msgId)
+	lifetime := lifetimeFor(t, msgId)
+	if !replayingWAL() {
+		go storeEvent(t, msg.Timestamp, value, tag, band.TagSuffix, apmId, int(lifetime.Value), count, bandCount)
+	}
+	broadcast(t, fmt.Sprintf("{\"carId\":\"%s\", \"apmId\":\"%s\", \"%s\": %d, \"severity\": \"%s\", \"miles\": %d, \"speed\": %.1f, \"maxSpeed\": %.1f, \"score\": %.1f, \"lifetime\": %d, \"lifetimeUnits\": \"%s\", \"lifetimeModel\": \"%s\", \"damage\": %g, \"components\": %s}", msgId, apmId, event, count, band.Band, int(msg.Miles), speed, maxSpeed, score, int(lifetime.Value), lifetime.Units, lifetime.Model, fatigueReport(t, msgId).Damage, componentLivesJSON(t, msgId)))
+}
 
-		go storeEvent(msg.Timestamp, math.Max(msg.X, msg.Y), "Tag_Hard_Breaks_1", assetIdMap[msgId], calcLifetime(msgId), decMap[msgId])
-		if conn == nil {
-			fmt.Println("ERROR: no active conns")
-			return
-		}
-		err = conn.WriteMessage(1, []byte(fmt.Sprintf("{\"carId\":\"%s\", \"apmId\": \"%s\", \"hardBreak\": %d, \"miles\": %d, \"lifetime\": %d}", msgId, assetIdMap[msgId], decMap[msgId], int(msg.Miles), calcLifetime(msgId))))
-		if err != nil {
-			fmt.Println("ERROR: could not write hard break to ws")
-		}
+// recordEvent updates every per-vehicle tally that an event feeds and returns
+// the event's total count and its count within the band.
+func recordEvent(t *Tenant, ts uint64, carId string, event string, value float64, band SeverityBand) (int, int) {
+	count, bandCount := t.registry.count(carId, event, band)
+	storeEventPoint(t, carId, event, ts, value)
+	noteRecoveryEvent(t, carId, ts)
+	logAlertEvent(t, carId, ts, event)
+	countTripEvent(t, carId, event, band.Band)
+	if changed := wearComponents(t, carId, event, band.Band); len(changed) > 0 && !replayingWAL() {
+		go storeComponents(t, ts, t.registry.apmId(carId), carId, changed)
 	}
+	return count, bandCount
 }
 
-func calcLifetime(carId string) int {
-	return int(math.Min(float64(lifetimeMax-scalingFactor*(accMap[carId]+decMap[carId])), float64(200000)))
+func calcLifetime(t *Tenant, carId string) int {
+	return int(lifetimeFor(t, carId).Value)
 }
 
-func receive(w http.ResponseWriter, r *http.Request) {
+func receive(w http.ResponseWriter, r *http.Request, t *Tenant) {
 
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	var wrapper EdisonWrapper
@@ -137,45 +169,26 @@ func receive(w http.ResponseWriter, r *http.Request) {
 		fmt.Println("ERROR: could not unmarshal wrapper body")
 		return
 	}
-	io.WriteString(w, "OK")
-
-	msg := wrapper.Form
-	_, found := startMap[msg.ID]
-	if !found {
-		startMapMutex.Lock()
-		startMap[msg.ID] = msg.Timestamp
-		startMapMutex.Unlock()
-
-		if len(assetIds) > 0 {
-			headId := assetIds[0]
-			assetIds = assetIds[1:]
-			assetIdMapMutex.Lock()
-			assetIdMap[msg.ID] = headId
-			assetIdMapMutex.Unlock()
-		}
-	}
-	milesMapMutex.Lock()
-	milesMap[msg.ID] = msg.Miles
-	milesMapMutex.Unlock()
-
-	detectAccelerations(msg)
-}
-
-func listen(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	var err error
-	conn, err = upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		fmt.Println(err)
+	if err = ingest(t, wrapper.Form); err == errAssetPoolExhausted {
+		w.WriteHeader(202)
+		io.WriteString(w, "QUEUED")
+		return
+	} else if err != nil {
+		w.WriteHeader(503)
+		io.WriteString(w, err.Error())
 		return
 	}
+	io.WriteString(w, "OK")
 }
 
-func all(w http.ResponseWriter, r *http.Request) {
+func all(w http.ResponseWriter, r *http.Request, t *Tenant) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	response := "["
-	for key, value := range startMap {
-		response += fmt.Sprintf("{\"carId\":\"%s\", \"apmId\": \"%s\", \"startTime\": %d,\"miles\":%d, \"hardAcc\": %d, \"hardBreak\": %d, \"lifetime\": %d}", key, assetIdMap[key], value, int(milesMap[key]), accMap[key], decMap[key], calcLifetime(key))
+	for _, v := range t.registry.snapshot() {
+		key := v.ID
+		speed, maxSpeed := speeds(t, key)
+		lifetime := lifetimeOf(t, v)
+		response += fmt.Sprintf("{\"carId\":\"%s\", \"apmId\": \"%s\", \"startTime\": %d,\"miles\":%d, \"speed\": %.1f, \"maxSpeed\": %.1f, \"hardAcc\": %d, \"hardBreak\": %d, \"severity\": %s, \"score\": %.1f, \"lifetime\": %d, \"lifetimeUnits\": \"%s\", \"lifetimeModel\": \"%s\", \"damage\": %g, \"rul\": %s, \"components\": %s}", key, v.ApmID, v.StartTime, int(v.Miles), speed, maxSpeed, v.Events["hardAcc"], v.Events["hardBreak"], bandCountsJSON(v.Severity), vehicleScore(t, key), int(lifetime.Value), lifetime.Units, lifetime.Model, fatigueReport(t, key).Damage, projectionJSON(t, key), componentLivesJSON(t, key))
 		response += ","
 	}
 	response = strings.TrimSuffix(response, ",")
@@ -183,7 +196,7 @@ func all(w http.ResponseWriter, r *http.Request) {
 	io.WriteString(w, response)
 }
 
-func mobile(w http.ResponseWriter, r *http.Request) {
+func mobile(w http.ResponseWriter, r *http.Request, t *Tenant) {
 	fmt.Println("HELLO MOBILE")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	var msg EdisonMessage
@@ -199,39 +212,32 @@ func mobile(w http.ResponseWriter, r *http.Request) {
 		fmt.Printf("BODY: %s\n", string(body))
 		return
 	}
-	io.WriteString(w, "OK")
-
-	_, found := startMap[msg.ID]
-	if !found {
-		startMapMutex.Lock()
-		startMap[msg.ID] = msg.Timestamp
-		startMapMutex.Unlock()
-
-		if len(assetIds) > 0 {
-			headId := assetIds[0]
-			assetIds = assetIds[1:]
-			assetIdMapMutex.Lock()
-			assetIdMap[msg.ID] = headId
-			assetIdMapMutex.Unlock()
-		}
-	}
-	milesMapMutex.Lock()
-	milesMap[msg.ID] = msg.Miles
-	milesMapMutex.Unlock()
 
 	msg.X = msg.X / mobileScalingFactor
 	msg.Y = msg.Y / mobileScalingFactor
-	detectAccelerations(msg)
+	msg.Z = msg.Z / mobileScalingFactor
+	if err = ingest(t, msg); err == errAssetPoolExhausted {
+		w.WriteHeader(202)
+		io.WriteString(w, "QUEUED")
+		return
+	} else if err != nil {
+		w.WriteHeader(503)
+		io.WriteString(w, err.Error())
+		return
+	}
+	io.WriteString(w, "OK")
 }
 
-func queryAPMTS(w http.ResponseWriter, r *http.Request) {
+// queryAPMTS proxies a tag query to the APM time series service as the
+// caller's tenant.
+func queryAPMTS(w http.ResponseWriter, r *http.Request, t *Tenant) {
 	w.Header().Set("Access-Control-Allow-Origin", fmt.Sprintf("*"))
 
 	tag := r.URL.Query().Get("tag")
-	tenant := r.URL.Query().Get("tenant")
 
-	if len(tag) < 1 || len(tenant) < 1 {
+	if len(tag) < 1 {
 		w.WriteHeader(400)
+		return
 	}
 
 	url := fmt.Sprintf("https://apm-timeseries-services-hackapm.run.aws-usw02-pr.ice.predix.io/v2/time_series?operation=raw&tagList=%s&startTime=2010-12-31T00:28:03.000Z&endTime=2017-04-05T00:28:03.000Z&responseFormat=KAIROSDB", tag)
@@ -240,11 +246,11 @@ func queryAPMTS(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		fmt.Println("Failed to create GET request")
 		w.WriteHeader(500)
-
+		return
 	}
 
-	req.Header.Add("authorization", token)
-	req.Header.Add("tenant", tenant)
+	req.Header.Add("authorization", t.Token)
+	req.Header.Add("tenant", t.APMTenant)
 	req.Header.Add("content-type", "application/json")
 	req.Header.Add("cache-control", "no-cache")
 	req.Header.Add("postman-token", "958d1a58-20f4-5361-fe72-aa149e73edf2")
@@ -253,6 +259,7 @@ func queryAPMTS(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		fmt.Println("HTTP Request failed to execute")
 		w.WriteHeader(500)
+		return
 	}
 
 	defer res.Body.Close()
@@ -260,84 +267,97 @@ func queryAPMTS(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		fmt.Println("Failed to read response body")
 		w.WriteHeader(500)
+		return
 	}
 	w.Write(body)
 }
 
-func gradualImprovement() {
-	ticker := time.NewTicker(2 * time.Second)
-	for {
-		select {
-		case <-ticker.C:
-			lifetimeMax += 250
-			for key, _ := range startMap {
-				msg := fmt.Sprintf("{\"carId\":\"%s\", \"apmId\":\"%s\", \"hardAcc\": %d, \"miles\": %d, \"lifetime\": %d}", key, assetIdMap[key], accMap[key], int(milesMap[key]), calcLifetime(key))
-				if conn == nil {
-					break
-				}
-				err := conn.WriteMessage(1, []byte(msg))
-				if err != nil {
-					fmt.Println("ERROR: could not write hard acc to ws")
-				}
-			}
-		}
-	}
-}
+// clear forgets the tenant's vehicles and everything recorded about them. The
+// devices keep their asset bindings.
+func clear(w http.ResponseWriter, r *http.Request, t *Tenant) {
+	w.Header().Set("Access-Control-Allow-Origin", fmt.Sprintf("*"))
+
+	ingestMutex.Lock()
+	resetTenant(t)
+	ingestMutex.Unlock()
 
-func clearMap(m map[string]string) {
-	for k := range m {
-		delete(m, k)
+	if err := saveSnapshot(); err != nil {
+		fmt.Println("ERROR: could not save snapshot after clear:", err)
 	}
 }
 
-func clear(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", fmt.Sprintf("*"))
-
-	lifetimeMax = 150000
-	assetIds = []string{"320I-UID1", "320I-UID2", "320I-UID3", "320I-UID4", "320I-UID5", "320I-UID6", "320I-UID7", "320I-UID8", "320I-UID9", "320I-UID10", "320I-UID11", "320I-UID12"}
-	assetIdMapMutex.Lock()
-	decMapMutex.Lock()
-	accMapMutex.Lock()
-	milesMapMutex.Lock()
-	startMapMutex.Lock()
+func resetTenant(t *Tenant) {
+	t.registry.reset()
+	clearCalibrations(t)
+	clearRuleState(t)
+	clearCrashes(t)
+	clearFilters(t)
+	clearAnomalies(t)
+	clearSpeeds(t)
+	clearTrips(t)
+	clearRUL(t)
+	clearComponents(t)
+	clearMaintenance(t)
+	clearRecovery(t)
+	clearPublished(t)
+	clearAlerts(t)
+	clearFatigue(t)
+	clearSeries(t)
+}
 
-	for k := range assetIdMap {
-		delete(assetIdMap, k)
+func main() {
+	var err error
+	if tenants, err = loadTenants(); err != nil {
+		fmt.Println("ERROR: could not load tenants:", err)
+		os.Exit(1)
 	}
-
-	for k := range decMap {
-		delete(decMap, k)
+	if err = loadRules(); err != nil {
+		fmt.Println("ERROR: could not load rules:", err)
+		os.Exit(1)
 	}
-
-	for k := range accMap {
-		delete(accMap, k)
+	seq, err := loadSnapshot()
+	if err != nil {
+		fmt.Println("ERROR: could not load snapshot:", err)
+		os.Exit(1)
 	}
-
-	for k := range milesMap {
-		delete(milesMap, k)
+	if seq, err = replayWAL(seq); err != nil {
+		fmt.Println("ERROR: could not replay wal:", err)
+		os.Exit(1)
 	}
-
-	for k := range startMap {
-		delete(startMap, k)
+	if err = openWAL(seq); err != nil {
+		fmt.Println("ERROR: could not open wal:", err)
+		os.Exit(1)
 	}
-
-	assetIdMapMutex.Unlock()
-	decMapMutex.Unlock()
-	accMapMutex.Unlock()
-	milesMapMutex.Unlock()
-	startMapMutex.Unlock()
-}
-
-func main() {
-	go gradualImprovement()
-
-	http.HandleFunc("/", receive)
-	http.HandleFunc("/listen", listen)
-	http.HandleFunc("/all", all)
-	http.HandleFunc("/mobile", mobile)
-	http.HandleFunc("/queryTS", queryAPMTS)
-	http.HandleFunc("/clear", clear)
+	if addr := os.Getenv("FAKE_ASSET_SERVICE"); addr != "" {
+		if err = startFakeAssets(addr); err != nil {
+			fmt.Println("ERROR: could not start fake asset service:", err)
+			os.Exit(1)
+		}
+	}
+	syncAllAssets()
+	go syncAssetsPeriodically()
+	go watchRuleReloads()
+	go watchShutdown()
+	go snapshotPeriodically()
+	go watchRetention()
+	go publishChanges()
+	go watchAlerts()
+	go watchIdleTrips()
+
+	http.HandleFunc("/", withTenant(receive))
+	http.HandleFunc("/listen", withTenant(listen))
+	http.HandleFunc("/all", withTenant(all))
+	http.HandleFunc("/mobile", withTenant(mobile))
+	http.HandleFunc("/queryTS", withTenant(queryAPMTS))
+	http.HandleFunc("/clear", withTenant(clear))
+	http.HandleFunc("/calibration", withTenant(calibration))
+	http.HandleFunc("/vehicles/", withTenant(vehicles))
+	http.HandleFunc("/lifetime/models", withTenant(listLifetimeModels))
+	http.HandleFunc("/alerts", withTenant(listAlerts))
+	http.HandleFunc("/alerts/", withTenant(listAlerts))
+	http.HandleFunc("/assets", withTenant(assets))
+	http.HandleFunc("/assets/", withTenant(assets))
+	http.HandleFunc("/rules", withTenant(listRules))
+	http.HandleFunc("/rules/reload", withTenant(reloadRules))
 	http.ListenAndServe(":"+os.Getenv("PORT"), nil)
-	// test ingest
-	// storeEvent(1469437879000, 1, "Tag_Hard_Breaks_2")
 }
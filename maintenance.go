@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	maintenanceReplace = "replace"
+	maintenanceRestore = "restore"
+	maintenanceTag     = "Tag_Maintenance_1"
+)
+
+type MaintenanceRecord struct {
+	ID         int           `json:"id"`
+	CarID      string        `json:"carId"`
+	Component  string        `json:"component"`
+	Action     string        `json:"action"`
+	Amount     float64       `json:"amount,omitempty"`
+	Ts         uint64        `json:"ts"`
+	Technician string        `json:"technician"`
+	Notes      string        `json:"notes"`
+	Before     ComponentLife `json:"before"`
+	After      ComponentLife `json:"after"`
+}
+
+var (
+	maintenanceMap      = make(map[vehicleKey][]MaintenanceRecord)
+	maintenanceMapMutex = &sync.Mutex{}
+	maintenanceSeq      = 0
+)
+
+// performMaintenance resets a replaced component's wear or gives back Amount
+// of it for a restore, and appends the action to the vehicle's history.
+func performMaintenance(t *Tenant, rec MaintenanceRecord) (MaintenanceRecord, error) {
+	config := t.currentRules().components
+	if _, found := config[rec.Component]; !found {
+		return rec, fmt.Errorf("unknown component %q", rec.Component)
+	}
+	switch rec.Action {
+	case maintenanceReplace:
+	case maintenanceRestore:
+		if rec.Amount <= 0 {
+			return rec, fmt.Errorf("restore needs a positive amount")
+		}
+	default:
+		return rec, fmt.Errorf("action must be %q or %q", maintenanceReplace, maintenanceRestore)
+	}
+	if rec.Technician == "" {
+		return rec, fmt.Errorf("technician is required")
+	}
+	if rec.Ts == 0 {
+		rec.Ts = uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	}
+
+	k := t.key(rec.CarID)
+	rec.Before = componentLives(t, rec.CarID)[rec.Component]
+	componentWearMutex.Lock()
+	if componentWearMap[k] == nil {
+		componentWearMap[k] = make(map[string]float64)
+	}
+	if rec.Action == maintenanceReplace {
+		componentWearMap[k][rec.Component] = 0
+	} else {
+		componentWearMap[k][rec.Component] = math.Max(componentWearMap[k][rec.Component]-rec.Amount, 0)
+	}
+	componentWearMutex.Unlock()
+	rec.After = componentLives(t, rec.CarID)[rec.Component]
+
+	maintenanceMapMutex.Lock()
+	maintenanceSeq++
+	rec.ID = maintenanceSeq
+	maintenanceMap[k] = append(maintenanceMap[k], rec)
+	maintenanceMapMutex.Unlock()
+	return rec, nil
+}
+
+func maintenanceHistory(t *Tenant, carId string) []MaintenanceRecord {
+	maintenanceMapMutex.Lock()
+	defer maintenanceMapMutex.Unlock()
+	return append([]MaintenanceRecord{}, maintenanceMap[t.key(carId)]...)
+}
+
+func vehicleMaintenance(w http.ResponseWriter, r *http.Request, t *Tenant, carId string) {
+	switch r.Method {
+	case "GET":
+		writeJSON(w, maintenanceHistory(t, carId))
+	case "POST":
+		var rec MaintenanceRecord
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			fmt.Println("ERROR: could not read body")
+			w.WriteHeader(400)
+			return
+		}
+		if err = json.Unmarshal(body, &rec); err != nil {
+			fmt.Println("ERROR: could not unmarshal maintenance body")
+			w.WriteHeader(400)
+			return
+		}
+		rec.CarID = carId
+		rec, err = performMaintenance(t, rec)
+		if err != nil {
+			w.WriteHeader(400)
+			io.WriteString(w, err.Error())
+			return
+		}
+		announceMaintenance(t, rec)
+		writeJSON(w, rec)
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+func announceMaintenance(t *Tenant, rec MaintenanceRecord) {
+	apmId := t.registry.apmId(rec.CarID)
+
+	out, err := json.Marshal(rec)
+	if err != nil {
+		fmt.Println("ERROR: could not marshal maintenance record")
+		return
+	}
+	broadcast(t, fmt.Sprintf("{\"carId\":\"%s\", \"apmId\":\"%s\", \"maintenance\": %s, \"components\": %s}", rec.CarID, apmId, out, componentLivesJSON(t, rec.CarID)))
+
+	if apmId == "" {
+		return
+	}
+	config := t.currentRules().components
+	go storeTags(t, rec.Ts, []tagValue{
+		{fmt.Sprintf("%s.%s", apmId, config[rec.Component].Tag), fmt.Sprintf("%.1f", rec.After.Remaining)},
+		{fmt.Sprintf("%s.%s", apmId, maintenanceTag), fmt.Sprintf("%s:%s", rec.Component, rec.Action)},
+	})
+}
+
+func clearMaintenance(t *Tenant) {
+	maintenanceMapMutex.Lock()
+	for k := range maintenanceMap {
+		if k.tenant == t.ID {
+			delete(maintenanceMap, k)
+		}
+	}
+	maintenanceMapMutex.Unlock()
+}
+
+func maintenanceRecords(t *Tenant) map[string][]MaintenanceRecord {
+	maintenanceMapMutex.Lock()
+	defer maintenanceMapMutex.Unlock()
+	out := make(map[string][]MaintenanceRecord)
+	for k, records := range maintenanceMap {
+		if k.tenant == t.ID {
+			out[k.device] = append([]MaintenanceRecord(nil), records...)
+		}
+	}
+	return out
+}
+
+func restoreMaintenance(t *Tenant, records map[string][]MaintenanceRecord) {
+	maintenanceMapMutex.Lock()
+	defer maintenanceMapMutex.Unlock()
+	for carId, r := range records {
+		maintenanceMap[t.key(carId)] = append([]MaintenanceRecord(nil), r...)
+	}
+}
+
+func currentMaintenanceSeq() int {
+	maintenanceMapMutex.Lock()
+	defer maintenanceMapMutex.Unlock()
+	return maintenanceSeq
+}
+
+func restoreMaintenanceSeq(seq int) {
+	maintenanceMapMutex.Lock()
+	maintenanceSeq = seq
+	maintenanceMapMutex.Unlock()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func maintain(t *testing.T, tenant *Tenant, method, body string) (int, string) {
+	req, err := http.NewRequest(method, "/vehicles/car1/maintenance", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	vehicles(w, req, tenant)
+	return w.Code, w.Body.String()
+}
+
+func maintained(t *testing.T, tenant *Tenant, body string) MaintenanceRecord {
+	code, reply := maintain(t, tenant, "POST", body)
+	if code != 200 {
+		t.Fatalf("maintenance %s: %d %s", body, code, reply)
+	}
+	var rec MaintenanceRecord
+	if err := json.Unmarshal([]byte(reply), &rec); err != nil {
+		t.Fatal(err)
+	}
+	return rec
+}
+
+func TestMaintenanceReplaceAndRestore(t *testing.T) {
+	tenant := componentTenant(t, "maintenance")
+	defer resetTenant(tenant)
+	tenant.registry.setAssets(nil)
+	tenant.registry.observe(EdisonMessage{ID: "car1", Timestamp: 1})
+	for i := 0; i < 5; i++ {
+		wearComponents(tenant, "car1", "hardBreak", "moderate")
+	}
+
+	rec := maintained(t, tenant, `{"component": "brakes", "action": "restore", "amount": 20, "technician": "sam", "ts": 1000}`)
+	if rec.CarID != "car1" || rec.Before.Consumed != 50 || rec.After.Consumed != 30 || rec.After.Remaining != 70 {
+		t.Fatalf("restore should give back 20, got %+v", rec)
+	}
+	rec = maintained(t, tenant, `{"component": "brakes", "action": "restore", "amount": 500, "technician": "sam", "ts": 2000}`)
+	if rec.After.Consumed != 0 || rec.After.Remaining != 100 {
+		t.Fatalf("restore should not give back more than was worn, got %+v", rec.After)
+	}
+
+	wearComponents(tenant, "car1", "hardBreak", "moderate")
+	rec = maintained(t, tenant, `{"component": "tires", "action": "replace", "technician": "alex", "ts": 3000}`)
+	if rec.Before.Consumed != 24 || rec.After.Consumed != 0 || rec.After.Percent != 100 {
+		t.Fatalf("replace should reset the tires, got %+v", rec)
+	}
+	if b := componentLives(tenant, "car1")["brakes"]; b.Consumed != 10 {
+		t.Fatalf("replacing the tires should leave the brakes alone, got %+v", b)
+	}
+
+	code, reply := maintain(t, tenant, "GET", "")
+	var history []MaintenanceRecord
+	if err := json.Unmarshal([]byte(reply), &history); code != 200 || err != nil {
+		t.Fatalf("history: %d %s", code, reply)
+	}
+	if len(history) != 3 || history[0].Ts != 1000 || history[2].Component != "tires" || history[2].Technician != "alex" {
+		t.Fatalf("unexpected history %+v", history)
+	}
+	if history[0].ID >= history[1].ID || history[1].ID >= history[2].ID {
+		t.Fatalf("record IDs should increase, got %d %d %d", history[0].ID, history[1].ID, history[2].ID)
+	}
+}
+
+func TestMaintenanceRefusesBadRecords(t *testing.T) {
+	tenant := componentTenant(t, "maintenance-bad")
+	defer resetTenant(tenant)
+	tenant.registry.setAssets(nil)
+	tenant.registry.observe(EdisonMessage{ID: "car1", Timestamp: 1})
+
+	for _, body := range []string{
+		`{"component": "wipers", "action": "replace", "technician": "sam"}`,
+		`{"component": "brakes", "action": "polish", "technician": "sam"}`,
+		`{"component": "brakes", "action": "restore", "technician": "sam"}`,
+		`{"component": "brakes", "action": "restore", "amount": -5, "technician": "sam"}`,
+		`{"component": "brakes", "action": "replace"}`,
+		`{"component": `,
+	} {
+		if code, _ := maintain(t, tenant, "POST", body); code != 400 {
+			t.Errorf("%s should be refused, got %d", body, code)
+		}
+	}
+	if code, _ := maintain(t, tenant, "PUT", ""); code != 405 {
+		t.Errorf("PUT should not be allowed, got %d", code)
+	}
+	if history := maintenanceHistory(tenant, "car1"); len(history) != 0 {
+		t.Fatalf("refused records should not be kept, got %+v", history)
+	}
+}
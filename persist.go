@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// State is snapshotted to STATE_DIR every SNAPSHOT_INTERVAL, after /clear and
+// on shutdown, and restored on startup before the WAL is replayed on top.
+// Version 1 snapshots predate tenants; their vehicles go to the first tenant.
+// Version 2 snapshots kept per-device state outside the tenants, which is
+// handed to the tenant listing the device.
+//
+// Short windows are not kept and refill from the next readings: the crash
+// window, filter state, calibration rest window, RUL samples, the fatigue
+// residual stack and what was last published to websocket clients. Series
+// history is kept alongside, see seriesstore.go.
+
+const (
+	snapshotFile    = "state.json"
+	snapshotVersion = 3
+)
+
+// TenantState is what a snapshot keeps for each tenant, with per-device state
+// keyed by device ID.
+type TenantState struct {
+	Vehicles     []Vehicle                      `json:"vehicles"`
+	Bindings     map[string]string              `json:"bindings"`
+	Waiting      []string                       `json:"waiting"`
+	Recovered    map[string]float64             `json:"recovered"`
+	Recovery     map[string]RecoveryProgress    `json:"recovery,omitempty"`
+	Wear         map[string]map[string]float64  `json:"wear"`
+	Maintenance  map[string][]MaintenanceRecord `json:"maintenance"`
+	Fatigue      map[string]FatigueTotals       `json:"fatigue"`
+	Trips        map[string]TripHistory         `json:"trips,omitempty"`
+	Alerts       []Alert                        `json:"alerts,omitempty"`
+	AlertHistory map[string]AlertHistory        `json:"alertHistory,omitempty"`
+	Calibrations map[string]CalibrationState    `json:"calibrations,omitempty"`
+	Speeds       map[string]SpeedState          `json:"speeds,omitempty"`
+	Rules        map[string]DeviceRuleState     `json:"rules,omitempty"`
+	Anomalies    map[string]AnomalyBaseline     `json:"anomalies,omitempty"`
+	Series       []OpenChunk                    `json:"series,omitempty"`
+	Compacted    map[string][]CompactionMark    `json:"compacted,omitempty"`
+	Devices      []string                       `json:"devices,omitempty"`
+}
+
+type StateSnapshot struct {
+	Version        int                            `json:"version"`
+	WalSeq         uint64                         `json:"walSeq"`
+	Taken          int64                          `json:"taken"`
+	Tenants        map[string]TenantState         `json:"tenants"`
+	MaintenanceSeq int                            `json:"maintenanceSeq"`
+	AlertSeq       int                            `json:"alertSeq"`
+	Vehicles       []Vehicle                      `json:"vehicles,omitempty"`
+	Bindings       map[string]string              `json:"bindings,omitempty"`
+	Waiting        []string                       `json:"waiting,omitempty"`
+	Recovered      map[string]float64             `json:"recovered,omitempty"`
+	Wear           map[string]map[string]float64  `json:"wear,omitempty"`
+	Maintenance    map[string][]MaintenanceRecord `json:"maintenance,omitempty"`
+	Fatigue        map[string]FatigueTotals       `json:"fatigue,omitempty"`
+
+	writes []seriesWrite
+}
+
+var (
+	stateDir         = os.Getenv("STATE_DIR")
+	snapshotInterval = envDuration("SNAPSHOT_INTERVAL", 30*time.Second)
+	stateFsync       = walFsync != "never"
+	snapshotMutex    = &sync.Mutex{}
+)
+
+func envDuration(name string, fallback time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		fmt.Printf("ERROR: bad %s %q, using %v\n", name, v, fallback)
+		return fallback
+	}
+	return d
+}
+
+func takeSnapshot() StateSnapshot {
+	s := StateSnapshot{
+		Version:        snapshotVersion,
+		Taken:          time.Now().UnixNano() / int64(time.Millisecond),
+		Tenants:        make(map[string]TenantState),
+		MaintenanceSeq: currentMaintenanceSeq(),
+		AlertSeq:       currentAlertSeq(),
+	}
+	open, writes := collectSeries()
+	s.writes = writes
+	for _, t := range tenants {
+		ts := TenantState{
+			Recovered:    recoveredTotals(t),
+			Recovery:     recoveryProgress(t),
+			Wear:         componentWear(t),
+			Maintenance:  maintenanceRecords(t),
+			Fatigue:      fatigueTotals(t),
+			Trips:        tripHistories(t),
+			Alerts:       tenantAlerts(t),
+			AlertHistory: alertHistories(t),
+			Calibrations: calibrationStates(t),
+			Speeds:       speedStates(t),
+			Rules:        ruleStates(t),
+			Anomalies:    anomalyBaselines(t),
+			Series:       open[t.ID],
+			Compacted:    compactionMarks(t),
+		}
+		ts.Vehicles, ts.Bindings, ts.Waiting = t.registry.state()
+		s.Tenants[t.ID] = ts
+	}
+	return s
+}
+
+func applySnapshot(s StateSnapshot) {
+	for id, ts := range s.Tenants {
+		t := tenantByID(id)
+		if t == nil {
+			fmt.Printf("ERROR: dropping %d vehicles of unknown tenant %s from snapshot\n", len(ts.Vehicles), id)
+			continue
+		}
+		t.registry.restore(ts.Vehicles, ts.Bindings, ts.Waiting)
+		restoreRecovered(t, ts.Recovered)
+		restoreRecoveryProgress(t, ts.Recovery)
+		restoreComponentWear(t, ts.Wear)
+		restoreMaintenance(t, ts.Maintenance)
+		restoreFatigue(t, ts.Fatigue)
+		restoreTrips(t, ts.Trips)
+		restoreAlerts(t, ts.Alerts)
+		restoreAlertHistories(t, ts.AlertHistory)
+		restoreCalibrations(t, ts.Calibrations)
+		restoreSpeeds(t, ts.Speeds)
+		restoreRuleState(t, ts.Rules)
+		restoreAnomalies(t, ts.Anomalies)
+		restoreOpenChunks(t, ts.Series)
+		restoreCompaction(t, ts.Compacted)
+	}
+	restoreMaintenanceSeq(s.MaintenanceSeq)
+	restoreAlertSeq(s.AlertSeq)
+}
+
+// upgradeSnapshot moves the per-device state of version 1 and 2 snapshots
+// into the tenants, going by the devices each tenant listed.
+func upgradeSnapshot(s *StateSnapshot) {
+	if s.Tenants == nil {
+		s.Tenants = map[string]TenantState{tenants[0].ID: legacyTenantState(*s)}
+	}
+	owners := make(map[string]string)
+	for id, ts := range s.Tenants {
+		for _, device := range ts.Devices {
+			owners[device] = id
+		}
+	}
+	tenantFor := func(device string) TenantState {
+		id, found := owners[device]
+		if !found {
+			id = tenants[0].ID
+			owners[device] = id
+		}
+		ts := s.Tenants[id]
+		if ts.Recovered == nil {
+			ts.Recovered = make(map[string]float64)
+			ts.Wear = make(map[string]map[string]float64)
+			ts.Maintenance = make(map[string][]MaintenanceRecord)
+			ts.Fatigue = make(map[string]FatigueTotals)
+		}
+		return ts
+	}
+	for device, v := range s.Recovered {
+		ts := tenantFor(device)
+		ts.Recovered[device] = v
+		s.Tenants[owners[device]] = ts
+	}
+	for device, v := range s.Wear {
+		ts := tenantFor(device)
+		ts.Wear[device] = v
+		s.Tenants[owners[device]] = ts
+	}
+	for device, v := range s.Maintenance {
+		ts := tenantFor(device)
+		ts.Maintenance[device] = v
+		s.Tenants[owners[device]] = ts
+	}
+	for device, v := range s.Fatigue {
+		ts := tenantFor(device)
+		ts.Fatigue[device] = v
+		s.Tenants[owners[device]] = ts
+	}
+}
+
+func legacyTenantState(s StateSnapshot) TenantState {
+	ts := TenantState{Vehicles: s.Vehicles, Bindings: s.Bindings, Waiting: s.Waiting}
+	if ts.Bindings == nil {
+		ts.Bindings = make(map[string]string)
+		for _, v := range s.Vehicles {
+			if v.ApmID != "" {
+				ts.Bindings[v.ID] = v.ApmID
+			}
+		}
+	}
+	for _, v := range s.Vehicles {
+		ts.Devices = append(ts.Devices, v.ID)
+	}
+	ts.Devices = append(ts.Devices, s.Waiting...)
+	return ts
+}
+
+// saveSnapshot writes the current state next to the old snapshot and renames
+// it into place, so a crash mid-write leaves the previous one intact.
+func saveSnapshot() error {
+	if stateDir == "" {
+		return nil
+	}
+	snapshotMutex.Lock()
+	defer snapshotMutex.Unlock()
+
+	ingestMutex.Lock()
+	s := takeSnapshot()
+	s.WalSeq = walSeq()
+	ingestMutex.Unlock()
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(stateDir, 0755); err != nil {
+		return err
+	}
+	if err = writeSeries(s.writes); err != nil {
+		return err
+	}
+	path := filepath.Join(stateDir, snapshotFile)
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil && stateFsync {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return err
+	}
+	if stateFsync {
+		if err = syncDir(stateDir); err != nil {
+			return err
+		}
+	}
+	return truncateWAL(s.WalSeq)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// loadSnapshot restores the last saved state, if there is one, and returns
+// the WAL sequence number it covers.
+func loadSnapshot() (uint64, error) {
+	if stateDir == "" {
+		return 0, nil
+	}
+	if err := loadSeries(); err != nil {
+		return 0, err
+	}
+	data, err := ioutil.ReadFile(filepath.Join(stateDir, snapshotFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var s StateSnapshot
+	if err = json.Unmarshal(data, &s); err != nil {
+		return 0, err
+	}
+	if s.Version < 1 || s.Version > snapshotVersion {
+		return 0, fmt.Errorf("snapshot version %d is not supported", s.Version)
+	}
+	if s.Version < snapshotVersion {
+		upgradeSnapshot(&s)
+	}
+	applySnapshot(s)
+	fmt.Printf("restored %d tenants from snapshot\n", len(s.Tenants))
+	return s.WalSeq, nil
+}
+
+func snapshotPeriodically() {
+	if stateDir == "" {
+		return
+	}
+	ticker := time.NewTicker(snapshotInterval)
+	for range ticker.C {
+		if err := saveSnapshot(); err != nil {
+			fmt.Println("ERROR: could not save snapshot:", err)
+		}
+	}
+}
+
+// watchShutdown saves a final snapshot before the process exits.
+func watchShutdown() {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+	if err := saveSnapshot(); err != nil {
+		fmt.Println("ERROR: could not save snapshot:", err)
+	}
+	os.Exit(0)
+}
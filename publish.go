@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const publishInterval = 2 * time.Second
+
+var (
+	publishedMap      = make(map[vehicleKey]string)
+	publishedMapMutex = &sync.Mutex{}
+)
+
+func vehicleStatus(t *Tenant, v Vehicle) string {
+	key := v.ID
+	speed, maxSpeed := speeds(t, key)
+	lifetime := lifetimeOf(t, v)
+	return fmt.Sprintf("{\"carId\":\"%s\", \"apmId\":\"%s\", \"hardAcc\": %d, \"miles\": %d, \"speed\": %.1f, \"maxSpeed\": %.1f, \"score\": %.1f, \"lifetime\": %d, \"lifetimeUnits\": \"%s\", \"lifetimeModel\": \"%s\", \"damage\": %g, \"components\": %s}", key, v.ApmID, v.Events["hardAcc"], int(v.Miles), speed, maxSpeed, vehicleScore(t, key), int(lifetime.Value), lifetime.Units, lifetime.Model, fatigueReport(t, key).Damage, componentLivesJSON(t, key))
+}
+
+// publishChanges broadcasts the status of every vehicle whose status differs
+// from what was last sent to its tenant.
+func publishChanges() {
+	ticker := time.NewTicker(publishInterval)
+	for range ticker.C {
+		for _, t := range tenants {
+			publishTenant(t)
+		}
+	}
+}
+
+// publishTenant skips tenants nobody is listening to, so what is recorded as
+// sent is what the tenant's clients have actually been sent.
+func publishTenant(t *Tenant) {
+	if !hasConns(t) {
+		return
+	}
+	for _, v := range t.registry.snapshot() {
+		key := t.key(v.ID)
+		msg := vehicleStatus(t, v)
+		publishedMapMutex.Lock()
+		changed := publishedMap[key] != msg
+		publishedMap[key] = msg
+		publishedMapMutex.Unlock()
+		if changed {
+			broadcast(t, msg)
+		}
+	}
+}
+
+// publishedStatus returns the last status sent for each of the tenant's
+// vehicles, ordered by device.
+func publishedStatus(t *Tenant) []string {
+	publishedMapMutex.Lock()
+	defer publishedMapMutex.Unlock()
+	var devices []string
+	for k := range publishedMap {
+		if k.tenant == t.ID {
+			devices = append(devices, k.device)
+		}
+	}
+	sort.Strings(devices)
+	var out []string
+	for _, d := range devices {
+		out = append(out, publishedMap[t.key(d)])
+	}
+	return out
+}
+
+func clearPublished(t *Tenant) {
+	publishedMapMutex.Lock()
+	for k := range publishedMap {
+		if k.tenant == t.ID {
+			delete(publishedMap, k)
+		}
+	}
+	publishedMapMutex.Unlock()
+}
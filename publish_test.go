@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func readStatus(t *testing.T, c *websocket.Conn) string {
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, msg, err := c.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(msg)
+}
+
+func TestPublishWaitsForClients(t *testing.T) {
+	acme, _, srv, done := withTwoTenants(t)
+	defer done()
+	postReading(t, srv, "ka", 1000, 0.1)
+
+	publishTenant(acme)
+	if sent := publishedStatus(acme); len(sent) != 0 {
+		t.Fatalf("nothing should be recorded as sent without clients, got %v", sent)
+	}
+
+	first := dialTenant(t, srv, acme, "ka")
+	defer first.Close()
+	publishTenant(acme)
+	if msg := readStatus(t, first); !strings.Contains(msg, `"carId":"car1"`) {
+		t.Fatalf("the first client should get car1's status, got %s", msg)
+	}
+
+	// A later client is sent the status it missed, and an unchanged status
+	// is not sent again.
+	second := dialTenant(t, srv, acme, "ka")
+	defer second.Close()
+	if msg := readStatus(t, second); !strings.Contains(msg, `"carId":"car1"`) {
+		t.Fatalf("a later client should get car1's status on connect, got %s", msg)
+	}
+	publishTenant(acme)
+	first.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if _, msg, err := first.ReadMessage(); err == nil {
+		t.Fatalf("an unchanged status was sent again: %s", msg)
+	}
+}
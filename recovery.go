@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+)
+
+// Vehicles earn back part of their lifetime penalty through calm driving (miles
+// covered with no event for CalmAfterMs) and through elapsed time between
+// readings. Recovery is capped at MaxFraction of the penalty accumulated so
+// far, so lifetime can never climb above where it started.
+
+type RecoveryConfig struct {
+	PerCalmMile float64 `json:"perCalmMile"`
+	PerHour     float64 `json:"perHour"`
+	CalmAfterMs uint64  `json:"calmAfterMs"`
+	MaxFraction float64 `json:"maxFraction"`
+}
+
+type recoveryState struct {
+	recovered   float64
+	lastTs      uint64
+	lastMiles   float64
+	lastEventTs uint64
+	primed      bool
+}
+
+var (
+	defaultRecoveryConfig = RecoveryConfig{
+		PerCalmMile: 0.05,
+		PerHour:     0.01,
+		CalmAfterMs: 60 * 1000,
+		MaxFraction: 0.5,
+	}
+
+	recoveryMap      = make(map[vehicleKey]*recoveryState)
+	recoveryMapMutex = &sync.Mutex{}
+)
+
+func prepareRecoveryConfig(config *RecoveryConfig) (RecoveryConfig, error) {
+	if config == nil {
+		return defaultRecoveryConfig, nil
+	}
+	c := *config
+	if c.PerCalmMile < 0 || c.PerHour < 0 {
+		return c, fmt.Errorf("recovery rates cannot be negative")
+	}
+	if c.MaxFraction < 0 || c.MaxFraction > 1 {
+		return c, fmt.Errorf("recovery maxFraction must be between 0 and 1")
+	}
+	return c, nil
+}
+
+func recoveryFor(k vehicleKey) *recoveryState {
+	r, found := recoveryMap[k]
+	if !found {
+		r = &recoveryState{}
+		recoveryMap[k] = r
+	}
+	return r
+}
+
+func trackRecovery(t *Tenant, msg EdisonMessage, penalty float64) {
+	config := t.currentRules().recovery
+
+	recoveryMapMutex.Lock()
+	defer recoveryMapMutex.Unlock()
+	r := recoveryFor(t.key(msg.ID))
+	if !r.primed || msg.Timestamp <= r.lastTs {
+		if !r.primed {
+			r.lastTs, r.lastMiles, r.primed = msg.Timestamp, msg.Miles, true
+		}
+		return
+	}
+
+	hours := float64(msg.Timestamp-r.lastTs) / (60 * 60 * 1000)
+	credit := hours * config.PerHour
+	if miles := msg.Miles - r.lastMiles; miles > 0 && msg.Timestamp >= r.lastEventTs+config.CalmAfterMs {
+		credit += miles * config.PerCalmMile
+	}
+	r.recovered = math.Min(r.recovered+credit, config.MaxFraction*penalty)
+	r.lastTs = msg.Timestamp
+	if msg.Miles > r.lastMiles {
+		r.lastMiles = msg.Miles
+	}
+}
+
+func noteRecoveryEvent(t *Tenant, carId string, ts uint64) {
+	recoveryMapMutex.Lock()
+	if r := recoveryFor(t.key(carId)); ts > r.lastEventTs {
+		r.lastEventTs = ts
+	}
+	recoveryMapMutex.Unlock()
+}
+
+func recovered(t *Tenant, carId string) float64 {
+	recoveryMapMutex.Lock()
+	defer recoveryMapMutex.Unlock()
+	if r, found := recoveryMap[t.key(carId)]; found {
+		return r.recovered
+	}
+	return 0
+}
+
+func clearRecovery(t *Tenant) {
+	recoveryMapMutex.Lock()
+	for k := range recoveryMap {
+		if k.tenant == t.ID {
+			delete(recoveryMap, k)
+		}
+	}
+	recoveryMapMutex.Unlock()
+}
+
+func recoveredTotals(t *Tenant) map[string]float64 {
+	recoveryMapMutex.Lock()
+	defer recoveryMapMutex.Unlock()
+	out := make(map[string]float64)
+	for k, r := range recoveryMap {
+		if k.tenant == t.ID {
+			out[k.device] = r.recovered
+		}
+	}
+	return out
+}
+
+func restoreRecovered(t *Tenant, totals map[string]float64) {
+	recoveryMapMutex.Lock()
+	defer recoveryMapMutex.Unlock()
+	for carId, v := range totals {
+		recoveryMap[t.key(carId)] = &recoveryState{recovered: v}
+	}
+}
+
+// RecoveryProgress is where recovery left off, so the next reading carries on
+// accruing rather than starting over.
+type RecoveryProgress struct {
+	LastTs      uint64  `json:"lastTs"`
+	LastMiles   float64 `json:"lastMiles"`
+	LastEventTs uint64  `json:"lastEventTs"`
+	Primed      bool    `json:"primed"`
+}
+
+func recoveryProgress(t *Tenant) map[string]RecoveryProgress {
+	recoveryMapMutex.Lock()
+	defer recoveryMapMutex.Unlock()
+	out := make(map[string]RecoveryProgress)
+	for k, r := range recoveryMap {
+		if k.tenant == t.ID {
+			out[k.device] = RecoveryProgress{r.lastTs, r.lastMiles, r.lastEventTs, r.primed}
+		}
+	}
+	return out
+}
+
+func restoreRecoveryProgress(t *Tenant, progress map[string]RecoveryProgress) {
+	recoveryMapMutex.Lock()
+	defer recoveryMapMutex.Unlock()
+	for carId, p := range progress {
+		r := recoveryFor(t.key(carId))
+		r.lastTs, r.lastMiles, r.lastEventTs, r.primed = p.LastTs, p.LastMiles, p.LastEventTs, p.Primed
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import "testing"
+
+func recoveryTenant(t *testing.T, id string) *Tenant {
+	tenant := newTenant(&Tenant{ID: id})
+	rules, err := compileRules(RuleConfig{Recovery: &RecoveryConfig{
+		PerCalmMile: 0.1,
+		PerHour:     0,
+		CalmAfterMs: 60 * 1000,
+		MaxFraction: 0.5,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenant.setRules(rules)
+	return tenant
+}
+
+func driveCalm(tenant *Tenant, ts uint64, miles, penalty float64) {
+	trackRecovery(tenant, EdisonMessage{ID: "car1", Timestamp: ts, Miles: miles}, penalty)
+}
+
+func TestRecoveryCreditsCalmMiles(t *testing.T) {
+	tenant := recoveryTenant(t, "recovery-calm")
+	defer clearRecovery(tenant)
+
+	driveCalm(tenant, 100000, 0, 10)
+	driveCalm(tenant, 101000, 10, 10)
+	if got := recovered(tenant, "car1"); got != 1 {
+		t.Fatalf("10 calm miles should earn 1, got %v", got)
+	}
+
+	// Miles within CalmAfterMs of an event, and late readings, earn nothing.
+	noteRecoveryEvent(tenant, "car1", 101500)
+	driveCalm(tenant, 102000, 20, 10)
+	driveCalm(tenant, 100500, 30, 10)
+	if got := recovered(tenant, "car1"); got != 1 {
+		t.Fatalf("expected no credit after an event or for a late reading, got %v", got)
+	}
+	driveCalm(tenant, 101500+60*1000, 25, 10)
+	if got := recovered(tenant, "car1"); got != 1.5 {
+		t.Fatalf("5 calm miles after the event should earn 0.5, got %v", got)
+	}
+}
+
+func TestRecoveryCappedAtMaxFraction(t *testing.T) {
+	tenant := recoveryTenant(t, "recovery-cap")
+	defer clearRecovery(tenant)
+
+	driveCalm(tenant, 100000, 0, 4)
+	driveCalm(tenant, 101000, 1000, 4)
+	if got := recovered(tenant, "car1"); got != 2 {
+		t.Fatalf("credit should be capped at half the penalty of 4, got %v", got)
+	}
+	driveCalm(tenant, 102000, 2000, 6)
+	if got := recovered(tenant, "car1"); got != 3 {
+		t.Fatalf("the cap should follow the penalty up to 6, got %v", got)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Vehicle is the core per-device record: its asset binding, odometer and
+// event tallies. Values handed out by the registry are copies.
+type Vehicle struct {
+	ID        string                    `json:"carId"`
+	ApmID     string                    `json:"apmId"`
+	StartTime uint64                    `json:"startTime"`
+	Miles     float64                   `json:"miles"`
+	Events    map[string]int            `json:"events"`
+	Severity  map[string]map[string]int `json:"severity"`
+	Penalty   float64                   `json:"penalty"`
+}
+
+type vehicleRecord struct {
+	mu sync.Mutex
+	v  Vehicle
+}
+
+// VehicleRegistry holds every known vehicle of one tenant and the asset pool
+// they are bound to (see assets.go). The registry lock guards the vehicle set
+// and the pool; each record has its own lock for its fields. The registry lock
+// is always taken before a record lock.
+type VehicleRegistry struct {
+	mu       sync.RWMutex
+	vehicles map[string]*vehicleRecord
+	assets   []string
+	bindings map[string]string
+	owners   map[string]string
+	waiting  []string
+}
+
+func newVehicleRegistry(assetIds []string) *VehicleRegistry {
+	return &VehicleRegistry{
+		vehicles: make(map[string]*vehicleRecord),
+		assets:   append([]string(nil), assetIds...),
+		bindings: make(map[string]string),
+		owners:   make(map[string]string),
+	}
+}
+
+func (v Vehicle) copy() Vehicle {
+	events := make(map[string]int, len(v.Events))
+	for event, n := range v.Events {
+		events[event] = n
+	}
+	severity := make(map[string]map[string]int, len(v.Severity))
+	for event, bands := range v.Severity {
+		severity[event] = make(map[string]int, len(bands))
+		for band, n := range bands {
+			severity[event][band] = n
+		}
+	}
+	v.Events, v.Severity = events, severity
+	return v
+}
+
+func (r *VehicleRegistry) record(id string) *vehicleRecord {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.vehicles[id]
+}
+
+// observe registers the vehicle on its first reading, giving it its existing
+// asset binding or else the next free asset, and updates its odometer. It
+// returns errAssetPoolExhausted for as long as the vehicle has no asset.
+func (r *VehicleRegistry) observe(msg EdisonMessage) error {
+	rec := r.record(msg.ID)
+	if rec == nil {
+		r.mu.Lock()
+		rec = r.vehicles[msg.ID]
+		if rec == nil {
+			rec = &vehicleRecord{v: Vehicle{
+				ID:        msg.ID,
+				StartTime: msg.Timestamp,
+				Events:    make(map[string]int),
+				Severity:  make(map[string]map[string]int),
+			}}
+			r.vehicles[msg.ID] = rec
+			if _, bound := r.bindings[msg.ID]; !bound {
+				if err := r.assignLocked(msg.ID); err != nil {
+					fmt.Printf("ERROR: %v, %s is waiting for an asset\n", err, msg.ID)
+				}
+			}
+			rec.v.ApmID = r.bindings[msg.ID]
+		}
+		r.mu.Unlock()
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.v.Miles = msg.Miles
+	if rec.v.ApmID == "" {
+		return errAssetPoolExhausted
+	}
+	return nil
+}
+
+// count tallies an event and its severity band, adding the band's weight to
+// the penalty, and returns the event's total and its count within the band.
+func (r *VehicleRegistry) count(id string, event string, band SeverityBand) (int, int) {
+	rec := r.record(id)
+	if rec == nil {
+		return 0, 0
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.v.Events[event]++
+	if rec.v.Severity[event] == nil {
+		rec.v.Severity[event] = make(map[string]int)
+	}
+	rec.v.Severity[event][band.Band]++
+	rec.v.Penalty += band.Weight
+	return rec.v.Events[event], rec.v.Severity[event][band.Band]
+}
+
+func (r *VehicleRegistry) vehicle(id string) (Vehicle, bool) {
+	rec := r.record(id)
+	if rec == nil {
+		return Vehicle{ID: id}, false
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.v.copy(), true
+}
+
+func (r *VehicleRegistry) apmId(id string) string {
+	rec := r.record(id)
+	if rec == nil {
+		return ""
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.v.ApmID
+}
+
+func (r *VehicleRegistry) ids() []string {
+	r.mu.RLock()
+	ids := make([]string, 0, len(r.vehicles))
+	for id := range r.vehicles {
+		ids = append(ids, id)
+	}
+	r.mu.RUnlock()
+	sort.Strings(ids)
+	return ids
+}
+
+// snapshot copies every vehicle, ordered by ID. The set of vehicles is fixed
+// for the duration of the call.
+func (r *VehicleRegistry) snapshot() []Vehicle {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.copyVehicles()
+}
+
+// copyVehicles expects r.mu to be held.
+func (r *VehicleRegistry) copyVehicles() []Vehicle {
+	out := make([]Vehicle, 0, len(r.vehicles))
+	for _, rec := range r.vehicles {
+		rec.mu.Lock()
+		out = append(out, rec.v.copy())
+		rec.mu.Unlock()
+	}
+	sort.Sort(vehiclesByID(out))
+	return out
+}
+
+// reset forgets every vehicle. Asset bindings and the waiting queue are kept,
+// so a vehicle gets its old asset back when it next reports.
+func (r *VehicleRegistry) reset() {
+	r.mu.Lock()
+	r.vehicles = make(map[string]*vehicleRecord)
+	r.mu.Unlock()
+}
+
+// state returns copies of every vehicle along with the pool's bindings and
+// waiting queue.
+func (r *VehicleRegistry) state() ([]Vehicle, map[string]string, []string) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	bindings := make(map[string]string, len(r.bindings))
+	for device, asset := range r.bindings {
+		bindings[device] = asset
+	}
+	return r.copyVehicles(), bindings, append([]string(nil), r.waiting...)
+}
+
+// restore replaces the registry's contents with previously saved state. The
+// configured pool is kept; waiting vehicles get any assets it has free.
+func (r *VehicleRegistry) restore(vehicles []Vehicle, bindings map[string]string, waiting []string) {
+	next := make(map[string]*vehicleRecord, len(vehicles))
+	for _, v := range vehicles {
+		v = v.copy()
+		next[v.ID] = &vehicleRecord{v: v}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.vehicles = next
+	r.bindings = make(map[string]string)
+	r.owners = make(map[string]string)
+	for device, asset := range bindings {
+		r.bindLocked(device, asset)
+	}
+	r.waiting = append([]string(nil), waiting...)
+	r.drainWaitingLocked()
+}
+
+type vehiclesByID []Vehicle
+
+func (v vehiclesByID) Len() int           { return len(v) }
+func (v vehiclesByID) Less(i, j int) bool { return v[i].ID < v[j].ID }
+func (v vehiclesByID) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
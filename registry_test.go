@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// Run with -race: readings, counts and snapshots of the same vehicles are
+// handled from many goroutines at once.
+func TestRegistryConcurrentUse(t *testing.T) {
+	r := newVehicleRegistry([]string{"A1", "A2", "A3", "A4"})
+	band := SeverityBand{Band: "moderate", Weight: 1}
+	const workers, rounds = 8, 200
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				r.observe(EdisonMessage{ID: fmt.Sprintf("car%d", i%4), Timestamp: uint64(i), Miles: float64(i)})
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				id := fmt.Sprintf("car%d", i%4)
+				r.observe(EdisonMessage{ID: id, Timestamp: uint64(i)})
+				r.count(id, "hardAcc", band)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				for _, v := range r.snapshot() {
+					_ = v.Events["hardAcc"] + v.Severity["hardAcc"]["moderate"]
+				}
+				r.vehicle("car1")
+				r.apmId("car2")
+				r.state()
+			}
+		}()
+	}
+	wg.Wait()
+
+	total, penalty := 0, 0.0
+	for _, v := range r.snapshot() {
+		total += v.Events["hardAcc"]
+		penalty += v.Penalty
+		if v.Severity["hardAcc"]["moderate"] != v.Events["hardAcc"] {
+			t.Fatalf("%s counted %d events but %d in their band", v.ID, v.Events["hardAcc"], v.Severity["hardAcc"]["moderate"])
+		}
+	}
+	if total != workers*rounds || penalty != workers*rounds {
+		t.Fatalf("expected %d events and penalty, got %d and %v", workers*rounds, total, penalty)
+	}
+	if ids := r.ids(); len(ids) != 4 {
+		t.Fatalf("expected 4 vehicles, got %v", ids)
+	}
+	for _, id := range []string{"car0", "car1", "car2", "car3"} {
+		if r.apmId(id) == "" {
+			t.Fatalf("%s should have an asset", id)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+)
+
+// Every raw series is rolled up into each configured tier by the compactor.
+// A tier bucket stores min, max, sum, count and p95 as five series, built from
+// the tier below it. p95 is exact for the first tier; coarser tiers, and
+// queries with a step wider than their tier's, take the p95 of the finer
+// buckets' p95s, which is close but not exact. A bucket is
+// compacted once it has been over for compactionGraceMs, so readings that
+// arrive a little late still make it in. Rollup series are stored like raw
+// ones and each tier's watermark goes in the snapshot.
+
+const compactionGraceMs = 60 * 1000
+
+type RollupTier struct {
+	StepMs      uint64 `json:"stepMs"`
+	RetentionMs uint64 `json:"retentionMs"`
+}
+
+type bucketStats struct {
+	Ts    uint64
+	Min   float64
+	Max   float64
+	Sum   float64
+	Count float64
+	P95   float64
+}
+
+var (
+	rollupFields = []string{"min", "max", "sum", "count", "p95"}
+	defaultTiers = []RollupTier{
+		{StepMs: 60 * 1000, RetentionMs: 90 * day},
+		{StepMs: 60 * 60 * 1000, RetentionMs: 5 * 365 * day},
+	}
+
+	compactedMap      = make(map[seriesKey]uint64)
+	compactedMapMutex = &sync.Mutex{}
+)
+
+func validateTiers(tiers []RollupTier) error {
+	var prev uint64
+	for i, t := range tiers {
+		if t.StepMs == 0 || t.RetentionMs == 0 {
+			return fmt.Errorf("storage tier %d needs a positive stepMs and retentionMs", i)
+		}
+		if prev > 0 && (t.StepMs <= prev || t.StepMs%prev != 0) {
+			return fmt.Errorf("storage tier %d step must be a larger multiple of the tier before it", i)
+		}
+		prev = t.StepMs
+	}
+	return nil
+}
+
+// storageConfigFor is the storage section of the tenant a series belongs to.
+func storageConfigFor(tenant string) StorageConfig {
+	if t := tenantByID(tenant); t != nil {
+		return t.currentRules().storage
+	}
+	return defaultStorageConfig
+}
+
+// percentile uses the nearest-rank method.
+func percentile(v []float64, p float64) float64 {
+	sorted := append([]float64(nil), v...)
+	sort.Float64s(sorted)
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+// combine merges stats into step-wide buckets aligned to base.
+func combine(stats []bucketStats, base uint64, step uint64) []bucketStats {
+	var out []bucketStats
+	var p95s []float64
+	for _, s := range stats {
+		start := base + (s.Ts-base)/step*step
+		if n := len(out); n == 0 || out[n-1].Ts != start {
+			if n > 0 {
+				out[n-1].P95 = percentile(p95s, 0.95)
+			}
+			out = append(out, bucketStats{Ts: start, Min: s.Min, Max: s.Max})
+			p95s = p95s[:0]
+		}
+		b := &out[len(out)-1]
+		b.Min = math.Min(b.Min, s.Min)
+		b.Max = math.Max(b.Max, s.Max)
+		b.Sum += s.Sum
+		b.Count += s.Count
+		p95s = append(p95s, s.P95)
+	}
+	if n := len(out); n > 0 {
+		out[n-1].P95 = percentile(p95s, 0.95)
+	}
+	return out
+}
+
+// readStats returns a series at one tier as per-bucket stats, with raw
+// samples as buckets of one.
+func readStats(k vehicleKey, metric string, step uint64, from uint64, to uint64) []bucketStats {
+	if step == 0 {
+		points := queryRange(k, metric, from, to)
+		out := make([]bucketStats, len(points))
+		for i, p := range points {
+			out[i] = bucketStats{p.Ts, p.V, p.V, p.V, 1, p.V}
+		}
+		return out
+	}
+
+	fields := make([][]Point, len(rollupFields))
+	n := -1
+	for i, f := range rollupFields {
+		fields[i] = querySeries(seriesKey{k, metric, step, f}, from, to)
+		if n < 0 || len(fields[i]) < n {
+			n = len(fields[i])
+		}
+	}
+	out := make([]bucketStats, n)
+	for i := range out {
+		out[i] = bucketStats{fields[0][i].Ts, fields[0][i].V, fields[1][i].V, fields[2][i].V, fields[3][i].V, fields[4][i].V}
+	}
+	return out
+}
+
+func compactedTo(k vehicleKey, metric string, step uint64) uint64 {
+	compactedMapMutex.Lock()
+	defer compactedMapMutex.Unlock()
+	return compactedMap[seriesKey{vehicleKey: k, metric: metric, step: step}]
+}
+
+// readTierStats reads a tier up to where it has been compacted and fills in
+// the rest from raw samples.
+func readTierStats(k vehicleKey, metric string, step uint64, from uint64, to uint64) []bucketStats {
+	if step == 0 {
+		return readStats(k, metric, 0, from, to)
+	}
+	done := compactedTo(k, metric, step)
+	if done <= from {
+		return readStats(k, metric, 0, from, to)
+	}
+	if done >= to {
+		return readStats(k, metric, step, from, to)
+	}
+	return append(readStats(k, metric, step, from, done), readStats(k, metric, 0, done, to)...)
+}
+
+// compact rolls every raw series up through each tier in turn. It holds
+// snapshotMutex so a snapshot never sees a watermark without the buckets
+// below it.
+func compact(now uint64) {
+	snapshotMutex.Lock()
+	defer snapshotMutex.Unlock()
+	seriesMapMutex.RLock()
+	var raw []seriesKey
+	for key := range seriesMap {
+		if key.step == 0 {
+			raw = append(raw, key)
+		}
+	}
+	seriesMapMutex.RUnlock()
+
+	for _, key := range raw {
+		source := uint64(0)
+		for _, t := range storageConfigFor(key.tenant).Tiers {
+			compactSeries(key.vehicleKey, key.metric, source, t.StepMs, now)
+			source = t.StepMs
+		}
+	}
+}
+
+func compactSeries(k vehicleKey, metric string, source uint64, step uint64, now uint64) {
+	if now < compactionGraceMs {
+		return
+	}
+	target := seriesKey{vehicleKey: k, metric: metric, step: step}
+	watermark := (now - compactionGraceMs) / step * step
+	from := compactedTo(k, metric, step)
+	if from >= watermark {
+		return
+	}
+
+	for _, b := range combine(readStats(k, metric, source, from, watermark), 0, step) {
+		for i, v := range []float64{b.Min, b.Max, b.Sum, b.Count, b.P95} {
+			appendSeries(seriesKey{k, metric, step, rollupFields[i]}, b.Ts, v)
+		}
+	}
+	compactedMapMutex.Lock()
+	compactedMap[target] = watermark
+	compactedMapMutex.Unlock()
+}
+
+// pickTier chooses which tier answers a query: the finest one still holding
+// data from `from`, or a coarser one that also does when the requested step is
+// a whole number of its buckets.
+func pickTier(config StorageConfig, metric string, from uint64, step uint64, now uint64) uint64 {
+	steps := []uint64{0}
+	retentions := []uint64{config.retentionFor(metric, 0)}
+	for _, t := range config.Tiers {
+		steps = append(steps, t.StepMs)
+		retentions = append(retentions, t.RetentionMs)
+	}
+	covers := func(i int) bool {
+		return now < retentions[i] || from >= now-retentions[i]
+	}
+
+	best := -1
+	for i := range steps {
+		if covers(i) {
+			best = i
+			break
+		}
+	}
+	if best < 0 {
+		return steps[len(steps)-1]
+	}
+	for i := best + 1; i < len(steps); i++ {
+		if covers(i) && step > 0 && step%steps[i] == 0 {
+			best = i
+		}
+	}
+	return steps[best]
+}
+
+// CompactionMark is how far one of a device's series has been rolled up into
+// the tier with the given step.
+type CompactionMark struct {
+	Metric string `json:"metric"`
+	Step   uint64 `json:"step"`
+	To     uint64 `json:"to"`
+}
+
+type marksByMetric []CompactionMark
+
+func (m marksByMetric) Len() int      { return len(m) }
+func (m marksByMetric) Swap(i, j int) { m[i], m[j] = m[j], m[i] }
+func (m marksByMetric) Less(i, j int) bool {
+	if m[i].Metric != m[j].Metric {
+		return m[i].Metric < m[j].Metric
+	}
+	return m[i].Step < m[j].Step
+}
+
+func compactionMarks(t *Tenant) map[string][]CompactionMark {
+	compactedMapMutex.Lock()
+	defer compactedMapMutex.Unlock()
+	out := make(map[string][]CompactionMark)
+	for k, to := range compactedMap {
+		if k.tenant == t.ID {
+			out[k.device] = append(out[k.device], CompactionMark{k.metric, k.step, to})
+		}
+	}
+	for _, marks := range out {
+		sort.Sort(marksByMetric(marks))
+	}
+	return out
+}
+
+func restoreCompaction(t *Tenant, marks map[string][]CompactionMark) {
+	compactedMapMutex.Lock()
+	defer compactedMapMutex.Unlock()
+	for carId, ms := range marks {
+		for _, m := range ms {
+			compactedMap[seriesKey{vehicleKey: t.key(carId), metric: m.Metric, step: m.Step}] = m.To
+		}
+	}
+}
+
+func clearCompaction(t *Tenant) {
+	compactedMapMutex.Lock()
+	for k := range compactedMap {
+		if k.tenant == t.ID {
+			delete(compactedMap, k)
+		}
+	}
+	compactedMapMutex.Unlock()
+}
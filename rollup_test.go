@@ -0,0 +1,171 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPercentile(t *testing.T) {
+	v := []float64{15, 20, 35, 40, 50}
+	cases := []struct {
+		p    float64
+		want float64
+	}{
+		{0, 15}, {0.05, 15}, {0.3, 20}, {0.4, 20}, {0.5, 35}, {0.95, 50}, {1, 50},
+	}
+	for _, c := range cases {
+		if got := percentile(v, c.p); got != c.want {
+			t.Errorf("percentile(%v) = %v, want %v", c.p, got, c.want)
+		}
+	}
+	if got := percentile([]float64{7}, 0.95); got != 7 {
+		t.Errorf("percentile of one value = %v, want 7", got)
+	}
+	if v[0] != 15 || v[4] != 50 {
+		t.Errorf("percentile reordered its input: %v", v)
+	}
+}
+
+func TestCombine(t *testing.T) {
+	var stats []bucketStats
+	for i := 0; i < 40; i++ {
+		v := float64(i % 20)
+		stats = append(stats, bucketStats{uint64(30000 + i*1000), v, v, v, 1, v})
+	}
+	got := combine(stats, 0, 20000)
+	want := []bucketStats{
+		{20000, 0, 9, 45, 10, 9},
+		{40000, 0, 19, 190, 20, 18},
+		{60000, 10, 19, 145, 10, 19},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("combine aligned to 0\n got %+v\nwant %+v", got, want)
+	}
+
+	got = combine(stats, 5000, 20000)
+	if len(got) != 3 || got[0].Ts != 25000 || got[0].Count != 15 || got[2].Ts != 65000 || got[2].Count != 5 {
+		t.Fatalf("combine aligned to 5000: %+v", got)
+	}
+	if combine(nil, 0, 20000) != nil {
+		t.Fatalf("combining nothing should give nothing")
+	}
+}
+
+func TestCombineTakesP95OfBuckets(t *testing.T) {
+	var stats []bucketStats
+	for i := 0; i < 20; i++ {
+		stats = append(stats, bucketStats{uint64(i * 1000), 0, 100, 50, 2, float64(i + 1)})
+	}
+	got := combine(stats, 0, 60000)
+	if len(got) != 1 || got[0].P95 != 19 || got[0].Count != 40 || got[0].Sum != 1000 {
+		t.Fatalf("combine of 20 buckets: %+v", got)
+	}
+}
+
+func TestPickTier(t *testing.T) {
+	config := StorageConfig{
+		DefaultRetentionMs: day,
+		RetentionMs:        map[string]uint64{"miles": 7 * day},
+		Tiers: []RollupTier{
+			{StepMs: 60 * 1000, RetentionMs: 90 * day},
+			{StepMs: 60 * 60 * 1000, RetentionMs: 5 * 365 * day},
+		},
+	}
+	now := 1000 * day
+	cases := []struct {
+		metric string
+		from   uint64
+		step   uint64
+		want   uint64
+	}{
+		{"x", now - 60*60*1000, 0, 0},
+		{"x", now - 60*60*1000, 30 * 1000, 0},
+		{"x", now - 60*60*1000, 2 * 60 * 1000, 60 * 1000},
+		{"x", now - 60*60*1000, 2 * 60 * 60 * 1000, 60 * 60 * 1000},
+		{"x", now - 2*day, 0, 60 * 1000},
+		{"miles", now - 2*day, 0, 0},
+		{"x", now - 100*day, 0, 60 * 60 * 1000},
+		{"x", now - 999*day, 0, 60 * 60 * 1000},
+	}
+	for _, c := range cases {
+		if got := pickTier(config, c.metric, c.from, c.step, now); got != c.want {
+			t.Errorf("pickTier(%s, now-%d, step %d) = %d, want %d", c.metric, now-c.from, c.step, got, c.want)
+		}
+	}
+	if got := pickTier(config, "x", 0, 0, 6*60*60*1000); got != 0 {
+		t.Errorf("raw data should cover everything before its retention has passed, got step %d", got)
+	}
+	if got := pickTier(config, "x", 0, 0, 10*365*day); got != 60*60*1000 {
+		t.Errorf("a range older than every tier should go to the coarsest, got step %d", got)
+	}
+}
+
+func TestReadTierStatsSpansCompactedAndRaw(t *testing.T) {
+	tenant := newTenant(&Tenant{ID: "rollup-span"})
+	defer clearSeries(tenant)
+	k := tenant.key("car1")
+
+	// A sample every 10s for 10 minutes, the first 5 of which are compacted.
+	var raw []bucketStats
+	for ts := uint64(0); ts < 10*60*1000; ts += 10 * 1000 {
+		v := float64(ts / 1000)
+		appendPoint(k, "miles", ts, v)
+		raw = append(raw, bucketStats{ts, v, v, v, 1, v})
+	}
+	compactSeries(k, "miles", 0, 60*1000, 5*60*1000+compactionGraceMs)
+	if done := compactedTo(k, "miles", 60*1000); done != 5*60*1000 {
+		t.Fatalf("compacted to %d, want %d", done, 5*60*1000)
+	}
+	if got := readStats(k, "miles", 60*1000, 0, ^uint64(0)); !reflect.DeepEqual(got, combine(raw[:30], 0, 60*1000)) {
+		t.Fatalf("rollup buckets differ from the raw samples combined: %+v", got)
+	}
+
+	got := readTierStats(k, "miles", 60*1000, 2*60*1000, 8*60*1000)
+	if len(got) != 3+18 || got[2].Ts != 4*60*1000 || got[2].Count != 6 || got[3].Ts != 5*60*1000 || got[3].Count != 1 {
+		t.Fatalf("expected 3 buckets then 18 raw samples, got %+v", got)
+	}
+	if want := combine(raw[12:48], 0, 60*1000); !reflect.DeepEqual(combine(got, 0, 60*1000), want) {
+		t.Fatalf("spanning read combined differs\n got %+v\nwant %+v", combine(got, 0, 60*1000), want)
+	}
+
+	if got = readTierStats(k, "miles", 60*1000, 0, 3*60*1000); len(got) != 3 || got[0].Count != 6 {
+		t.Fatalf("a range before the watermark should be read from the rollup: %+v", got)
+	}
+	if got = readTierStats(k, "miles", 60*1000, 6*60*1000, 7*60*1000); !reflect.DeepEqual(got, raw[36:42]) {
+		t.Fatalf("a range after the watermark should be read raw: %+v", got)
+	}
+}
+
+func TestCompactionMarksRoundTrip(t *testing.T) {
+	tenant := newTenant(&Tenant{ID: "rollup-marks"})
+	defer clearSeries(tenant)
+	k := tenant.key("car1")
+	for ts := uint64(0); ts < 3*60*60*1000; ts += 30 * 1000 {
+		appendPoint(k, "miles", ts, 1)
+	}
+	compactSeries(k, "miles", 0, 60*1000, 2*60*60*1000+compactionGraceMs)
+	compactSeries(k, "miles", 60*1000, 60*60*1000, 2*60*60*1000+compactionGraceMs)
+
+	marks := compactionMarks(tenant)
+	want := []CompactionMark{{"miles", 60 * 1000, 2 * 60 * 60 * 1000}, {"miles", 60 * 60 * 1000, 2 * 60 * 60 * 1000}}
+	if !reflect.DeepEqual(marks["car1"], want) {
+		t.Fatalf("marks %+v, want %+v", marks["car1"], want)
+	}
+	before := readTierStats(k, "miles", 60*60*1000, 0, 3*60*60*1000)
+
+	clearCompaction(tenant)
+	restoreCompaction(tenant, marks)
+	if !reflect.DeepEqual(compactionMarks(tenant), marks) {
+		t.Fatalf("restored marks differ: %+v", compactionMarks(tenant))
+	}
+	if got := readTierStats(k, "miles", 60*60*1000, 0, 3*60*60*1000); !reflect.DeepEqual(got, before) {
+		t.Fatalf("reads after restoring the marks differ")
+	}
+
+	// Buckets that outlived their watermark are not rolled up twice.
+	clearCompaction(tenant)
+	compactSeries(k, "miles", 0, 60*1000, 2*60*60*1000+compactionGraceMs)
+	if n := len(querySeries(seriesKey{k, "miles", 60 * 1000, "count"}, 0, ^uint64(0))); n != 120 {
+		t.Fatalf("expected 120 one-minute buckets, got %d", n)
+	}
+}
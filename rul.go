@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+)
+
+// Remaining useful life is projected from how fast lifetime has been consumed
+// per mile and how many miles a day the vehicle has recently been driving.
+// The confidence band treats the events in the window as a Poisson count, so
+// the wear rate carries a relative uncertainty of 1/sqrt(events).
+
+const (
+	rulSampleMs  = 30 * 1000
+	rulWindowMs  = 7 * 24 * 60 * 60 * 1000
+	rulMinSpanMs = 60 * 60 * 1000 // history needed before a projection is made
+	rulPublishMs = 5 * 60 * 1000
+	rulMilesTag  = "Tag_RUL_Miles"
+	rulDaysTag   = "Tag_RUL_Days"
+	msPerDay     = 24 * 60 * 60 * 1000
+)
+
+type lifeSample struct {
+	ts       uint64
+	miles    float64
+	lifetime float64
+	events   int
+}
+
+type rulState struct {
+	samples     []lifeSample
+	lastPublish uint64
+}
+
+type Range struct {
+	Estimate float64  `json:"estimate"`
+	Low      float64  `json:"low"`
+	High     *float64 `json:"high"`
+}
+
+type Projection struct {
+	Miles       *Range  `json:"miles"`
+	Days        *Range  `json:"days"`
+	MilesPerDay float64 `json:"milesPerDay"`
+	WearPerMile float64 `json:"wearPerMile"`
+	Events      int     `json:"events"`
+	Units       string  `json:"units"`
+}
+
+var (
+	rulMap      = make(map[vehicleKey]*rulState)
+	rulMapMutex = &sync.Mutex{}
+)
+
+func totalEvents(h VehicleHistory) int {
+	n := 0
+	for _, count := range h.Events {
+		n += count
+	}
+	return n
+}
+
+func trackRUL(t *Tenant, msg EdisonMessage) {
+	h := vehicleHistory(t, msg.ID)
+	lifetime := lifetimeModelFor(t, msg.ID).Remaining(h)
+
+	rulMapMutex.Lock()
+	r, found := rulMap[t.key(msg.ID)]
+	if !found {
+		r = &rulState{}
+		rulMap[t.key(msg.ID)] = r
+	}
+	if n := len(r.samples); n > 0 && msg.Timestamp < r.samples[n-1].ts+rulSampleMs {
+		rulMapMutex.Unlock()
+		return
+	}
+	r.samples = append(r.samples, lifeSample{msg.Timestamp, msg.Miles, lifetime.Value, totalEvents(h)})
+	for len(r.samples) > 1 && msg.Timestamp > r.samples[0].ts+rulWindowMs {
+		r.samples = r.samples[1:]
+	}
+	p := r.project(lifetime)
+	publish := p != nil && msg.Timestamp >= r.lastPublish+rulPublishMs
+	if publish {
+		r.lastPublish = msg.Timestamp
+	}
+	rulMapMutex.Unlock()
+
+	if publish && !replayingWAL() {
+		go storeRUL(t, msg.Timestamp, t.registry.apmId(msg.ID), p)
+	}
+}
+
+func (r *rulState) project(lifetime Lifetime) *Projection {
+	if len(r.samples) < 2 {
+		return nil
+	}
+	first, last := r.samples[0], r.samples[len(r.samples)-1]
+	span := last.ts - first.ts
+	miles := last.miles - first.miles
+	if span < rulMinSpanMs || miles <= 0 {
+		return nil
+	}
+
+	p := &Projection{
+		MilesPerDay: miles / (float64(span) / msPerDay),
+		WearPerMile: (first.lifetime - last.lifetime) / miles,
+		Events:      last.events - first.events,
+		Units:       lifetime.Units,
+	}
+	if p.WearPerMile <= 0 || lifetime.Value <= 0 {
+		return p
+	}
+
+	spread := 1.0
+	if p.Events > 0 {
+		spread = 1 / math.Sqrt(float64(p.Events))
+	}
+	p.Miles = projectRange(lifetime.Value/p.WearPerMile, spread)
+	p.Days = projectRange(p.Miles.Estimate/p.MilesPerDay, spread)
+	return p
+}
+
+// projectRange scales an estimate by the band of wear rates
+// rate*(1-spread) .. rate*(1+spread). A slower wear rate means longer life, so
+// the high end is unbounded once spread reaches 1.
+func projectRange(estimate float64, spread float64) *Range {
+	r := &Range{Estimate: estimate, Low: estimate / (1 + spread)}
+	if spread < 1 {
+		high := estimate / (1 - spread)
+		r.High = &high
+	}
+	return r
+}
+
+func projection(t *Tenant, carId string) *Projection {
+	lifetime := lifetimeFor(t, carId)
+	rulMapMutex.Lock()
+	defer rulMapMutex.Unlock()
+	r, found := rulMap[t.key(carId)]
+	if !found {
+		return nil
+	}
+	return r.project(lifetime)
+}
+
+func projectionJSON(t *Tenant, carId string) string {
+	p := projection(t, carId)
+	if p == nil {
+		return "null"
+	}
+	out, err := json.Marshal(p)
+	if err != nil {
+		fmt.Println("ERROR: could not marshal projection")
+		return "null"
+	}
+	return string(out)
+}
+
+func storeRUL(t *Tenant, ts uint64, apmId string, p *Projection) {
+	if p.Miles == nil || apmId == "" {
+		return
+	}
+	storeTags(t, ts, []tagValue{
+		{fmt.Sprintf("%s.%s", apmId, rulMilesTag), fmt.Sprintf("%.0f", p.Miles.Estimate)},
+		{fmt.Sprintf("%s.%s", apmId, rulDaysTag), fmt.Sprintf("%.1f", p.Days.Estimate)},
+	})
+}
+
+func clearRUL(t *Tenant) {
+	rulMapMutex.Lock()
+	for k := range rulMap {
+		if k.tenant == t.ID {
+			delete(rulMap, k)
+		}
+	}
+	rulMapMutex.Unlock()
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func wearState(lifetimes []float64, miles []float64, events []int, span uint64) *rulState {
+	r := &rulState{}
+	for i := range lifetimes {
+		ts := uint64(1000) + span*uint64(i)/uint64(len(lifetimes)-1)
+		r.samples = append(r.samples, lifeSample{ts, miles[i], lifetimes[i], events[i]})
+	}
+	return r
+}
+
+func TestProjectNeedsHistory(t *testing.T) {
+	lifetime := Lifetime{Value: 149000, Units: "points"}
+	if p := (&rulState{samples: []lifeSample{{1000, 0, 150000, 0}}}).project(lifetime); p != nil {
+		t.Errorf("one sample should not be projected, got %+v", p)
+	}
+	if p := wearState([]float64{150000, 149000}, []float64{0, 100}, []int{0, 4}, rulMinSpanMs-1).project(lifetime); p != nil {
+		t.Errorf("less than rulMinSpanMs of history should not be projected, got %+v", p)
+	}
+	if p := wearState([]float64{150000, 149000}, []float64{50, 50}, []int{0, 4}, msPerDay).project(lifetime); p != nil {
+		t.Errorf("a vehicle that has not moved should not be projected, got %+v", p)
+	}
+}
+
+func TestProjectWithoutWear(t *testing.T) {
+	p := wearState([]float64{150000, 150000}, []float64{0, 100}, []int{0, 0}, msPerDay).project(Lifetime{Value: 150000})
+	if p == nil || p.WearPerMile != 0 || p.MilesPerDay != 100 {
+		t.Fatalf("expected the rates without a range, got %+v", p)
+	}
+	if p.Miles != nil || p.Days != nil {
+		t.Fatalf("no wear should project no end of life, got %+v %+v", p.Miles, p.Days)
+	}
+	if p = wearState([]float64{100, -50}, []float64{0, 100}, []int{0, 3}, msPerDay).project(Lifetime{Value: -50}); p == nil || p.Miles != nil {
+		t.Fatalf("a used up lifetime should project no range, got %+v", p)
+	}
+}
+
+func TestProjectConfidenceBounds(t *testing.T) {
+	// 1000 points over 100 miles in a day from 4 events: a relative spread
+	// of 1/2 around 14900 miles.
+	r := wearState([]float64{150000, 149500, 149000}, []float64{0, 50, 100}, []int{0, 2, 4}, msPerDay)
+	p := r.project(Lifetime{Value: 149000, Units: "points"})
+	if p == nil || p.WearPerMile != 10 || p.MilesPerDay != 100 || p.Events != 4 || p.Units != "points" {
+		t.Fatalf("unexpected rates %+v", p)
+	}
+	checkRange(t, "miles", p.Miles, 14900, 14900/1.5, 29800)
+	checkRange(t, "days", p.Days, 149, 149/1.5, 298)
+
+	// With one event or none the spread is 1, so there is no upper bound.
+	for _, events := range []int{0, 1} {
+		r = wearState([]float64{150000, 149000}, []float64{0, 100}, []int{0, events}, msPerDay)
+		if p = r.project(Lifetime{Value: 149000}); p.Miles.High != nil || p.Miles.Low != 7450 {
+			t.Errorf("%d events: expected low 7450 and no high, got %+v", events, p.Miles)
+		}
+	}
+}
+
+func checkRange(t *testing.T, what string, r *Range, estimate, low, high float64) {
+	if r == nil || r.High == nil {
+		t.Fatalf("%s: expected a bounded range, got %+v", what, r)
+	}
+	if math.Abs(r.Estimate-estimate) > 1e-6 || math.Abs(r.Low-low) > 1e-6 || math.Abs(*r.High-high) > 1e-6 {
+		t.Fatalf("%s: got %v (%v..%v), want %v (%v..%v)", what, r.Estimate, r.Low, *r.High, estimate, low, high)
+	}
+}
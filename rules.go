@@ -0,0 +1,414 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+type Rule struct {
+	Name          string `json:"name"`
+	Event         string `json:"event"`
+	Expr          string `json:"expr"`
+	Value         string `json:"value"`
+	MinDurationMs uint64 `json:"minDurationMs"`
+	CooldownMs    uint64 `json:"cooldownMs"`
+	Severity      string `json:"severity"`
+	Tag           string `json:"tag"`
+	cond          exprNode
+	value         exprNode
+}
+
+type RuleConfig struct {
+	Rules      []*Rule                    `json:"rules"`
+	Severity   map[string][]SeverityBand  `json:"severity,omitempty"`
+	Filters    *FilterSettings            `json:"filters,omitempty"`
+	Anomaly    *AnomalyConfig             `json:"anomaly,omitempty"`
+	Scoring    *ScoringConfig             `json:"scoring,omitempty"`
+	Lifetime   *LifetimeSettings          `json:"lifetime,omitempty"`
+	Components map[string]ComponentConfig `json:"components,omitempty"`
+	Recovery   *RecoveryConfig            `json:"recovery,omitempty"`
+	Alerts     []AlertRule                `json:"alerts,omitempty"`
+	Fatigue    *FatigueConfig             `json:"fatigue,omitempty"`
+	Storage    *StorageConfig             `json:"storage,omitempty"`
+	Assets     *AssetConfig               `json:"assets,omitempty"`
+}
+
+type ruleState struct {
+	active      bool
+	activeSince uint64
+	lastFired   uint64
+	fired       bool
+}
+
+type deviceRuleState struct {
+	prev    EdisonMessage
+	hasPrev bool
+	rules   map[string]*ruleState
+}
+
+type firedRule struct {
+	rule  *Rule
+	value float64
+}
+
+// tenantRules are a tenant's rules file, compiled and with every section
+// filled in.
+type tenantRules struct {
+	rules      []*Rule
+	bands      map[string][]SeverityBand
+	pool       []string
+	filters    FilterSettings
+	anomaly    AnomalyConfig
+	scoring    ScoringConfig
+	lifetime   LifetimeSettings
+	components map[string]ComponentConfig
+	recovery   RecoveryConfig
+	alerts     []AlertRule
+	fatigue    FatigueConfig
+	storage    StorageConfig
+}
+
+var (
+	ruleSignals = []string{"x", "y", "z", "mag", "hmag", "jx", "jy", "jz", "vz", "speed"}
+
+	ruleStateMap   = make(map[vehicleKey]*deviceRuleState)
+	ruleStateMutex = &sync.Mutex{}
+	rulesFile      = os.Getenv("RULES_FILE")
+	defaultRules   = RuleConfig{Rules: []*Rule{
+		{
+			Name:     "hard_acceleration",
+			Event:    "hardAcc",
+			Expr:     fmt.Sprintf("x > %v || y > %v", accThreshold, accThreshold),
+			Value:    "max(x, y)",
+			Severity: "moderate",
+			Tag:      "Tag_Hard_Acceleration_1",
+		},
+		{
+			Name:     "hard_break",
+			Event:    "hardBreak",
+			Expr:     fmt.Sprintf("x < -%v || y < -%v", accThreshold, accThreshold),
+			Value:    "min(x, y)",
+			Severity: "moderate",
+			Tag:      "Tag_Hard_Breaks_1",
+		},
+		{
+			Name:       "bump",
+			Event:      "bump",
+			Expr:       "abs(vz) > 0.8",
+			Value:      "vz",
+			CooldownMs: 500,
+			Severity:   "moderate",
+			Tag:        "Tag_Bump_1",
+		},
+		{
+			Name:          "speeding",
+			Event:         "speeding",
+			Expr:          "speed > 70",
+			Value:         "speed",
+			MinDurationMs: 5000,
+			CooldownMs:    60000,
+			Severity:      "moderate",
+			Tag:           "Tag_Speeding_1",
+		},
+	}}
+)
+
+func readRuleConfig(path string) (RuleConfig, error) {
+	if path == "" {
+		return defaultRules, nil
+	}
+	var config RuleConfig
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(data, &config)
+	}
+	return config, err
+}
+
+func compileRules(config RuleConfig) (tenantRules, error) {
+	var out tenantRules
+	seen := make(map[string]bool)
+	for _, src := range config.Rules {
+		r := *src
+		if r.Name == "" || r.Event == "" || r.Tag == "" {
+			return out, fmt.Errorf("rule %q: name, event and tag are required", r.Name)
+		}
+		if seen[r.Name] {
+			return out, fmt.Errorf("rule %q: duplicate name", r.Name)
+		}
+		seen[r.Name] = true
+		if r.Severity == "" {
+			r.Severity = "moderate"
+		}
+		if r.Value == "" {
+			r.Value = "mag"
+		}
+		var err error
+		if r.cond, err = compileExpr(r.Expr, ruleSignals); err != nil {
+			return out, fmt.Errorf("rule %q: expr: %v", r.Name, err)
+		}
+		if r.value, err = compileExpr(r.Value, ruleSignals); err != nil {
+			return out, fmt.Errorf("rule %q: value: %v", r.Name, err)
+		}
+		out.rules = append(out.rules, &r)
+	}
+
+	var err error
+	if out.bands, err = prepareSeverityBands(config.Severity); err != nil {
+		return out, err
+	}
+	if out.pool, err = prepareAssetConfig(config.Assets); err != nil {
+		return out, err
+	}
+	if out.filters, err = prepareFilterSettings(config.Filters); err != nil {
+		return out, err
+	}
+	if out.anomaly, err = prepareAnomalyConfig(config.Anomaly); err != nil {
+		return out, err
+	}
+	if out.scoring, err = prepareScoringConfig(config.Scoring); err != nil {
+		return out, err
+	}
+	if out.lifetime, err = prepareLifetimeSettings(config.Lifetime); err != nil {
+		return out, err
+	}
+	if out.components, err = prepareComponents(config.Components); err != nil {
+		return out, err
+	}
+	if out.recovery, err = prepareRecoveryConfig(config.Recovery); err != nil {
+		return out, err
+	}
+	if out.alerts, err = prepareAlertRules(config.Alerts, out.components); err != nil {
+		return out, err
+	}
+	if out.fatigue, err = prepareFatigueConfig(config.Fatigue); err != nil {
+		return out, err
+	}
+	if out.storage, err = prepareStorageConfig(config.Storage); err != nil {
+		return out, err
+	}
+	return out, nil
+}
+
+// config turns the compiled rules back into the shape of a rules file.
+func (r tenantRules) config() RuleConfig {
+	return RuleConfig{
+		Rules:      r.rules,
+		Severity:   r.bands,
+		Filters:    &r.filters,
+		Anomaly:    &r.anomaly,
+		Scoring:    &r.scoring,
+		Lifetime:   &r.lifetime,
+		Components: r.components,
+		Recovery:   &r.recovery,
+		Alerts:     r.alerts,
+		Fatigue:    &r.fatigue,
+		Storage:    &r.storage,
+		Assets:     &AssetConfig{IDs: r.pool},
+	}
+}
+
+// loadTenantRules reads the tenant's own rules file, or RULES_FILE for a
+// tenant without one.
+func loadTenantRules(t *Tenant) (tenantRules, error) {
+	path := t.RulesFile
+	if path == "" {
+		path = rulesFile
+	}
+	config, err := readRuleConfig(path)
+	if err != nil {
+		return tenantRules{}, fmt.Errorf("tenant %s: %v", t.ID, err)
+	}
+	r, err := compileRules(config)
+	if err != nil {
+		return r, fmt.Errorf("tenant %s: %v", t.ID, err)
+	}
+	return r, nil
+}
+
+// loadRules reloads every tenant's rules and applies them only if every one of
+// them is valid.
+func loadRules() error {
+	next := make([]tenantRules, len(tenants))
+	for i, t := range tenants {
+		var err error
+		if next[i], err = loadTenantRules(t); err != nil {
+			return err
+		}
+	}
+	for i, t := range tenants {
+		t.setRules(next[i])
+		fmt.Printf("loaded %d detection rules for %s\n", len(next[i].rules), t.ID)
+	}
+	return nil
+}
+
+func watchRuleReloads() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := loadRules(); err != nil {
+			fmt.Println("ERROR: could not reload rules:", err)
+		}
+	}
+}
+
+func readingSignals(t *Tenant, msg EdisonMessage, prev EdisonMessage, hasPrev bool) map[string]float64 {
+	s := map[string]float64{
+		"x":    msg.X,
+		"y":    msg.Y,
+		"z":    msg.Z,
+		"mag":  math.Sqrt(msg.X*msg.X + msg.Y*msg.Y + msg.Z*msg.Z),
+		"hmag": math.Sqrt(msg.X*msg.X + msg.Y*msg.Y),
+	}
+	s["speed"], _ = speeds(t, msg.ID)
+	if g := gravityMagnitude(t, msg.ID); g > 0 {
+		s["vz"] = msg.Z - g
+	}
+	if hasPrev && msg.Timestamp > prev.Timestamp {
+		dt := float64(msg.Timestamp-prev.Timestamp) / 1000
+		s["jx"] = (msg.X - prev.X) / dt
+		s["jy"] = (msg.Y - prev.Y) / dt
+		s["jz"] = (msg.Z - prev.Z) / dt
+	}
+	return s
+}
+
+// evaluateRules runs every rule against the reading and returns the ones that
+// fire, honouring each rule's minimum duration and cooldown.
+func evaluateRules(t *Tenant, msg EdisonMessage) []firedRule {
+	current := t.currentRules().rules
+
+	ruleStateMutex.Lock()
+	defer ruleStateMutex.Unlock()
+
+	d, found := ruleStateMap[t.key(msg.ID)]
+	if !found {
+		d = &deviceRuleState{rules: make(map[string]*ruleState)}
+		ruleStateMap[t.key(msg.ID)] = d
+	}
+	signals := readingSignals(t, msg, d.prev, d.hasPrev)
+	if !d.hasPrev || msg.Timestamp > d.prev.Timestamp {
+		d.prev, d.hasPrev = msg, true
+	}
+
+	var fired []firedRule
+	for _, r := range current {
+		st, found := d.rules[r.Name]
+		if !found {
+			st = &ruleState{}
+			d.rules[r.Name] = st
+		}
+		if r.cond.eval(signals) == 0 {
+			st.active = false
+			continue
+		}
+		if !st.active {
+			st.active, st.activeSince = true, msg.Timestamp
+		}
+		if msg.Timestamp < st.activeSince+r.MinDurationMs {
+			continue
+		}
+		if st.fired && msg.Timestamp < st.lastFired+r.CooldownMs {
+			continue
+		}
+		st.fired = true
+		st.lastFired = msg.Timestamp
+		fired = append(fired, firedRule{rule: r, value: r.value.eval(signals)})
+	}
+	return fired
+}
+
+func clearRuleState(t *Tenant) {
+	ruleStateMutex.Lock()
+	for k := range ruleStateMap {
+		if k.tenant == t.ID {
+			delete(ruleStateMap, k)
+		}
+	}
+	ruleStateMutex.Unlock()
+}
+
+func listRules(w http.ResponseWriter, r *http.Request, t *Tenant) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	out, err := json.Marshal(t.currentRules().config())
+	if err != nil {
+		fmt.Println("ERROR: could not marshal rules")
+		w.WriteHeader(500)
+		return
+	}
+	io.WriteString(w, string(out))
+}
+
+// reloadRules reloads the calling tenant's rules only. SIGHUP reloads every
+// tenant's.
+func reloadRules(w http.ResponseWriter, r *http.Request, t *Tenant) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method != "POST" {
+		w.WriteHeader(405)
+		return
+	}
+	next, err := loadTenantRules(t)
+	if err != nil {
+		fmt.Println("ERROR: could not reload rules:", err)
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+		return
+	}
+	t.setRules(next)
+	fmt.Printf("loaded %d detection rules for %s\n", len(next.rules), t.ID)
+	io.WriteString(w, "OK")
+}
+
+// RuleTiming is a rule's duration and cooldown state as kept in a snapshot.
+type RuleTiming struct {
+	Active      bool   `json:"active"`
+	ActiveSince uint64 `json:"activeSince"`
+	LastFired   uint64 `json:"lastFired"`
+	Fired       bool   `json:"fired"`
+}
+
+type DeviceRuleState struct {
+	Prev    EdisonMessage         `json:"prev"`
+	HasPrev bool                  `json:"hasPrev"`
+	Rules   map[string]RuleTiming `json:"rules"`
+}
+
+func ruleStates(t *Tenant) map[string]DeviceRuleState {
+	ruleStateMutex.Lock()
+	defer ruleStateMutex.Unlock()
+	out := make(map[string]DeviceRuleState)
+	for k, d := range ruleStateMap {
+		if k.tenant != t.ID {
+			continue
+		}
+		s := DeviceRuleState{Prev: d.prev, HasPrev: d.hasPrev, Rules: make(map[string]RuleTiming)}
+		for name, st := range d.rules {
+			s.Rules[name] = RuleTiming{st.active, st.activeSince, st.lastFired, st.fired}
+		}
+		out[k.device] = s
+	}
+	return out
+}
+
+func restoreRuleState(t *Tenant, states map[string]DeviceRuleState) {
+	ruleStateMutex.Lock()
+	defer ruleStateMutex.Unlock()
+	for carId, s := range states {
+		d := &deviceRuleState{prev: s.Prev, hasPrev: s.HasPrev, rules: make(map[string]*ruleState)}
+		for name, st := range s.Rules {
+			d.rules[name] = &ruleState{st.Active, st.ActiveSince, st.LastFired, st.Fired}
+		}
+		ruleStateMap[t.key(carId)] = d
+	}
+}
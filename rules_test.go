@@ -0,0 +1,70 @@
+package main
+
+import "testing"
+
+func ruleTenant(t *testing.T, id string, rules ...*Rule) *Tenant {
+	compiled, err := compileRules(RuleConfig{Rules: rules})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenant := newTenant(&Tenant{ID: id})
+	tenant.setRules(compiled)
+	return tenant
+}
+
+func firedAt(tenant *Tenant, ts uint64, z float64) bool {
+	return len(evaluateRules(tenant, EdisonMessage{ID: "car1", Timestamp: ts, Z: z})) > 0
+}
+
+func TestEvaluateRulesDurationAndCooldown(t *testing.T) {
+	tenant := ruleTenant(t, "rules-duration", &Rule{Name: "bump", Event: "bump", Tag: "Tag_Bump", Expr: "z > 1", MinDurationMs: 100, CooldownMs: 1000})
+	defer clearRuleState(tenant)
+
+	if firedAt(tenant, 1000, 2) || firedAt(tenant, 1050, 2) {
+		t.Fatalf("rule fired before its minimum duration")
+	}
+	if !firedAt(tenant, 1100, 2) {
+		t.Fatalf("rule should fire once active for its minimum duration")
+	}
+	if firedAt(tenant, 1500, 2) {
+		t.Fatalf("rule fired inside its cooldown")
+	}
+	if !firedAt(tenant, 2100, 2) {
+		t.Fatalf("rule should fire again after its cooldown")
+	}
+
+	// Going inactive restarts the minimum duration, even from timestamp 0.
+	tenant = ruleTenant(t, "rules-zero", &Rule{Name: "bump", Event: "bump", Tag: "Tag_Bump", Expr: "z > 1", MinDurationMs: 100})
+	defer clearRuleState(tenant)
+	if firedAt(tenant, 0, 2) || firedAt(tenant, 50, 2) {
+		t.Fatalf("rule active since 0 fired before its minimum duration")
+	}
+	if !firedAt(tenant, 100, 2) {
+		t.Fatalf("rule active since 0 should fire at 100")
+	}
+}
+
+func TestEvaluateRulesOutOfOrder(t *testing.T) {
+	tenant := ruleTenant(t, "rules-order", &Rule{Name: "bump", Event: "bump", Tag: "Tag_Bump", Expr: "z > 1", MinDurationMs: 100, CooldownMs: 1000})
+	defer clearRuleState(tenant)
+
+	if firedAt(tenant, 5000, 2) {
+		t.Fatalf("rule fired before its minimum duration")
+	}
+	if firedAt(tenant, 4000, 2) {
+		t.Fatalf("an older reading must not count as time active")
+	}
+	if !firedAt(tenant, 5100, 2) {
+		t.Fatalf("rule should fire at 5100")
+	}
+	if firedAt(tenant, 3000, 2) {
+		t.Fatalf("an older reading must not escape the cooldown")
+	}
+
+	ruleStateMutex.Lock()
+	prev := ruleStateMap[tenant.key("car1")].prev.Timestamp
+	ruleStateMutex.Unlock()
+	if prev != 5100 {
+		t.Fatalf("previous reading should stay the newest, got %d", prev)
+	}
+}
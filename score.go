@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// Trip scores start at 100 and lose PointsPer100Miles for every weighted event
+// per 100 miles driven. An event's weight is its type weight times the weight
+// of the severity band it fell into (1 for event types without bands). The
+// vehicle score is the distance-weighted mean of its last RollingTrips trips.
+
+type ScoringConfig struct {
+	Weights           map[string]float64 `json:"weights"`
+	PointsPer100Miles float64            `json:"pointsPer100Miles"`
+	MinMiles          float64            `json:"minMiles"`
+	RollingTrips      int                `json:"rollingTrips"`
+	TripTag           string             `json:"tripTag"`
+	VehicleTag        string             `json:"vehicleTag"`
+}
+
+var (
+	defaultScoringConfig = ScoringConfig{
+		Weights: map[string]float64{
+			"hardAcc":   1,
+			"hardBreak": 1.5,
+			"speeding":  1,
+			"anomaly":   0.5,
+			"crash":     20,
+		},
+		PointsPer100Miles: 2,
+		MinMiles:          10,
+		RollingTrips:      10,
+		TripTag:           "Tag_Trip_Score",
+		VehicleTag:        "Tag_Driver_Score",
+	}
+)
+
+func prepareScoringConfig(config *ScoringConfig) (ScoringConfig, error) {
+	if config == nil {
+		return defaultScoringConfig, nil
+	}
+	c := *config
+	if c.PointsPer100Miles <= 0 {
+		return c, fmt.Errorf("scoring pointsPer100Miles must be positive")
+	}
+	if c.MinMiles <= 0 {
+		c.MinMiles = defaultScoringConfig.MinMiles
+	}
+	if c.RollingTrips < 1 {
+		c.RollingTrips = defaultScoringConfig.RollingTrips
+	}
+	if c.TripTag == "" {
+		c.TripTag = defaultScoringConfig.TripTag
+	}
+	if c.VehicleTag == "" {
+		c.VehicleTag = defaultScoringConfig.VehicleTag
+	}
+	return c, nil
+}
+
+func bandWeight(bands map[string][]SeverityBand, event string, band string) float64 {
+	for _, b := range bands[event] {
+		if b.Band == band && b.Weight > 0 {
+			return b.Weight
+		}
+	}
+	return 1
+}
+
+func tripScore(t *Trip, config ScoringConfig, severity map[string][]SeverityBand) float64 {
+	weighted := 0.0
+	for event, bands := range t.Severity {
+		for band, n := range bands {
+			weighted += float64(n) * config.Weights[event] * bandWeight(severity, event, band)
+		}
+	}
+	per100 := weighted / math.Max(t.Distance, config.MinMiles) * 100
+	return math.Max(0, 100-config.PointsPer100Miles*per100)
+}
+
+// rollingScore expects the trip mutex to be held.
+func rollingScore(t *tripState, config ScoringConfig, severity map[string][]SeverityBand) float64 {
+	if t == nil || len(t.trips) == 0 {
+		return 100
+	}
+	recent := t.trips
+	if len(recent) > config.RollingTrips {
+		recent = recent[len(recent)-config.RollingTrips:]
+	}
+	total, distance := 0.0, 0.0
+	for _, trip := range recent {
+		d := math.Max(trip.Distance, config.MinMiles)
+		total += tripScore(trip, config, severity) * d
+		distance += d
+	}
+	return total / distance
+}
+
+func vehicleScore(t *Tenant, carId string) float64 {
+	config := t.currentRules().scoring
+	severity := t.severity()
+	tripMapMutex.Lock()
+	defer tripMapMutex.Unlock()
+	return rollingScore(tripMap[t.key(carId)], config, severity)
+}
+
+func storeScores(t *Tenant, apmId string, trip Trip, vehicle float64) {
+	if apmId == "" {
+		return
+	}
+	config := t.currentRules().scoring
+	storeTags(t, trip.End, []tagValue{
+		{fmt.Sprintf("%s.%s", apmId, config.TripTag), fmt.Sprintf("%.1f", trip.Score)},
+		{fmt.Sprintf("%s.%s", apmId, config.VehicleTag), fmt.Sprintf("%.1f", vehicle)},
+	})
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+var testScoring = ScoringConfig{
+	Weights:           map[string]float64{"hardAcc": 1, "hardBreak": 1.5, "speeding": 1},
+	PointsPer100Miles: 2,
+	MinMiles:          10,
+	RollingTrips:      2,
+}
+
+func scoredTrip(distance float64, event, band string, n int) *Trip {
+	trip := &Trip{Distance: distance, Severity: map[string]map[string]int{}}
+	if n > 0 {
+		trip.Severity[event] = map[string]int{band: n}
+	}
+	return trip
+}
+
+func TestTripScorePer100Miles(t *testing.T) {
+	severity := map[string][]SeverityBand{"hardAcc": standardBands(accThreshold), "hardBreak": standardBands(accThreshold)}
+	cases := []struct {
+		trip *Trip
+		want float64
+	}{
+		{scoredTrip(50, "hardAcc", "moderate", 1), 96},
+		{scoredTrip(50, "hardAcc", "moderate", 3), 88},
+		{scoredTrip(100, "hardBreak", "severe", 1), 94},
+		{scoredTrip(100, "hardAcc", "extreme", 1), 92},
+		// Events without bands weigh their type weight alone.
+		{scoredTrip(100, "speeding", "moderate", 2), 96},
+		// Short trips count as MinMiles.
+		{scoredTrip(5, "hardAcc", "moderate", 1), 80},
+		{scoredTrip(0, "hardAcc", "moderate", 1), 80},
+		{scoredTrip(10, "hardAcc", "extreme", 20), 0},
+		{scoredTrip(30, "", "", 0), 100},
+	}
+	for _, c := range cases {
+		if got := tripScore(c.trip, testScoring, severity); math.Abs(got-c.want) > 1e-9 {
+			t.Errorf("trip of %v miles with %v scored %v, want %v", c.trip.Distance, c.trip.Severity, got, c.want)
+		}
+	}
+}
+
+func TestRollingScore(t *testing.T) {
+	if got := rollingScore(nil, testScoring, nil); got != 100 {
+		t.Fatalf("a vehicle without trips should score 100, got %v", got)
+	}
+	state := &tripState{trips: []*Trip{
+		scoredTrip(50, "hardAcc", "moderate", 10),
+		scoredTrip(5, "hardAcc", "moderate", 1),
+		scoredTrip(100, "", "", 0),
+	}}
+	// Only the last two trips count, the short one weighted as 10 miles.
+	want := (80*10 + 100*100) / 110.0
+	if got := rollingScore(state, testScoring, nil); math.Abs(got-want) > 1e-9 {
+		t.Fatalf("rolling score %v, want %v", got, want)
+	}
+}
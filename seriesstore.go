@@ -0,0 +1,335 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Series survive restarts in two parts. Sealed chunks, every chunk but a
+// series' last, go to a file per series under STATE_DIR/series when a snapshot
+// is saved: appended as they seal, or the file rewritten once retention has
+// dropped chunks from its front. The last chunk, still being appended to,
+// goes in the snapshot itself. A file is a header record holding the series
+// key followed by one record per chunk, each framed as
+//
+//	length uint32 | crc32c(payload) uint32 | payload
+//
+// Files are written before the snapshot that refers to them, so after a crash
+// a file may hold chunks the snapshot still has as open; those copies are
+// skipped on load, and samples no newer than a series' last are dropped when
+// the WAL is replayed.
+
+const (
+	seriesSuffix     = ".series"
+	seriesHeaderSize = 8
+)
+
+type seriesFileKey struct {
+	Tenant string `json:"tenant"`
+	Device string `json:"device"`
+	Metric string `json:"metric"`
+	Step   uint64 `json:"step,omitempty"`
+	Field  string `json:"field,omitempty"`
+}
+
+// OpenChunk is the last chunk of a series as kept in a snapshot.
+type OpenChunk struct {
+	Device string `json:"device"`
+	Metric string `json:"metric"`
+	Step   uint64 `json:"step,omitempty"`
+	Field  string `json:"field,omitempty"`
+	Chunk  []byte `json:"chunk"`
+}
+
+type openChunksByKey []OpenChunk
+
+func (o openChunksByKey) Len() int      { return len(o) }
+func (o openChunksByKey) Swap(i, j int) { o[i], o[j] = o[j], o[i] }
+func (o openChunksByKey) Less(i, j int) bool {
+	if o[i].Device != o[j].Device {
+		return o[i].Device < o[j].Device
+	}
+	if o[i].Metric != o[j].Metric {
+		return o[i].Metric < o[j].Metric
+	}
+	if o[i].Step != o[j].Step {
+		return o[i].Step < o[j].Step
+	}
+	return o[i].Field < o[j].Field
+}
+
+// seriesWrite is what a snapshot has to write for one series: the chunks
+// sealed since the last snapshot, or all of them when rewrite is set.
+type seriesWrite struct {
+	s       *series
+	key     seriesKey
+	chunks  [][]byte
+	rewrite bool
+	sealed  int
+}
+
+func seriesDir() string {
+	return filepath.Join(stateDir, "series")
+}
+
+func seriesFileName(key seriesKey) string {
+	return fmt.Sprintf("%x%s", sha1.Sum([]byte(fmt.Sprintf("%q %q %q %d %q", key.tenant, key.device, key.metric, key.step, key.field))), seriesSuffix)
+}
+
+// collectSeries gathers each tenant's open chunks and the sealed chunks not
+// yet on disk. The caller holds ingestMutex, so the open chunks agree with
+// the snapshot's WAL sequence.
+func collectSeries() (map[string][]OpenChunk, []seriesWrite) {
+	seriesMapMutex.RLock()
+	defer seriesMapMutex.RUnlock()
+	open := make(map[string][]OpenChunk)
+	var writes []seriesWrite
+	for key, s := range seriesMap {
+		s.mu.Lock()
+		n := len(s.chunks)
+		if n > 0 {
+			data, _ := s.chunks[n-1].MarshalBinary()
+			open[key.tenant] = append(open[key.tenant], OpenChunk{key.device, key.metric, key.step, key.field, data})
+		}
+		if sealed := n - 1; sealed > 0 {
+			w := seriesWrite{s: s, key: key, sealed: sealed, rewrite: s.rewrite || s.persisted == 0}
+			from := s.persisted
+			if w.rewrite {
+				from = 0
+			}
+			for _, c := range s.chunks[from:sealed] {
+				data, _ := c.MarshalBinary()
+				w.chunks = append(w.chunks, data)
+			}
+			writes = append(writes, w)
+		}
+		s.mu.Unlock()
+	}
+	for _, o := range open {
+		sort.Sort(openChunksByKey(o))
+	}
+	return open, writes
+}
+
+// writeSeries writes out what collectSeries gathered and removes the files of
+// series that no longer have sealed chunks.
+func writeSeries(writes []seriesWrite) error {
+	dir := seriesDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	live := make(map[string]bool)
+	for _, w := range writes {
+		name := seriesFileName(w.key)
+		live[name] = true
+		if len(w.chunks) == 0 && !w.rewrite {
+			continue
+		}
+		var err error
+		if w.rewrite {
+			err = rewriteSeriesFile(filepath.Join(dir, name), w.key, w.chunks)
+		} else {
+			err = appendSeriesFile(filepath.Join(dir, name), w.chunks)
+		}
+		if err != nil {
+			w.s.mu.Lock()
+			w.s.rewrite = true
+			w.s.mu.Unlock()
+			return err
+		}
+		w.s.mu.Lock()
+		w.s.persisted, w.s.rewrite = w.sealed, false
+		w.s.mu.Unlock()
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if !live[info.Name()] {
+			if err = os.Remove(filepath.Join(dir, info.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	if stateFsync {
+		return syncDir(dir)
+	}
+	return nil
+}
+
+func writeSeriesRecord(w io.Writer, payload []byte) error {
+	header := make([]byte, seriesHeaderSize)
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[4:8], crc32.Checksum(payload, walCRCTable))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+func writeSeriesRecords(f *os.File, chunks [][]byte) error {
+	for _, data := range chunks {
+		if err := writeSeriesRecord(f, data); err != nil {
+			return err
+		}
+	}
+	if stateFsync {
+		return f.Sync()
+	}
+	return nil
+}
+
+func rewriteSeriesFile(path string, key seriesKey, chunks [][]byte) error {
+	header, err := json.Marshal(seriesFileKey{key.tenant, key.device, key.metric, key.step, key.field})
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err = writeSeriesRecord(f, header); err == nil {
+		err = writeSeriesRecords(f, chunks)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func appendSeriesFile(path string, chunks [][]byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	err = writeSeriesRecords(f, chunks)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// readSeriesFile returns a file's key and every intact chunk. A bad record
+// ends the file; the chunks before it are still returned along with the error.
+func readSeriesFile(path string) (seriesKey, []*chunk, error) {
+	var key seriesKey
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return key, nil, err
+	}
+	var records [][]byte
+	for offset := 0; offset < len(data); {
+		if len(data)-offset < seriesHeaderSize {
+			err = fmt.Errorf("%s: short header at offset %d", path, offset)
+			break
+		}
+		size := int(binary.BigEndian.Uint32(data[offset : offset+4]))
+		end := offset + seriesHeaderSize + size
+		if size < 0 || end > len(data) {
+			err = fmt.Errorf("%s: short record at offset %d", path, offset)
+			break
+		}
+		payload := data[offset+seriesHeaderSize : end]
+		if crc32.Checksum(payload, walCRCTable) != binary.BigEndian.Uint32(data[offset+4:offset+8]) {
+			err = fmt.Errorf("%s: checksum mismatch at offset %d", path, offset)
+			break
+		}
+		records = append(records, payload)
+		offset = end
+	}
+	if len(records) == 0 {
+		if err == nil {
+			err = fmt.Errorf("%s: no header", path)
+		}
+		return key, nil, err
+	}
+
+	var fk seriesFileKey
+	if jsonErr := json.Unmarshal(records[0], &fk); jsonErr != nil {
+		return key, nil, fmt.Errorf("%s: bad header: %v", path, jsonErr)
+	}
+	key = seriesKey{vehicleKey{fk.Tenant, fk.Device}, fk.Metric, fk.Step, fk.Field}
+	var chunks []*chunk
+	for _, payload := range records[1:] {
+		c := &chunk{}
+		if chunkErr := c.UnmarshalBinary(payload); chunkErr != nil {
+			return key, chunks, fmt.Errorf("%s: %v", path, chunkErr)
+		}
+		chunks = append(chunks, c)
+	}
+	return key, chunks, err
+}
+
+// loadSeries reads back the sealed chunks of every series. A damaged file
+// keeps what could be read and is rewritten by the next snapshot.
+func loadSeries() error {
+	infos, err := ioutil.ReadDir(seriesDir())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	seriesMapMutex.Lock()
+	defer seriesMapMutex.Unlock()
+	loaded := 0
+	for _, info := range infos {
+		if !strings.HasSuffix(info.Name(), seriesSuffix) {
+			continue
+		}
+		key, chunks, err := readSeriesFile(filepath.Join(seriesDir(), info.Name()))
+		if err != nil {
+			fmt.Println("ERROR: could not read all of a series:", err)
+		}
+		if len(chunks) == 0 || tenantByID(key.tenant) == nil {
+			continue
+		}
+		seriesMap[key] = &series{chunks: chunks, persisted: len(chunks), rewrite: err != nil}
+		loaded++
+	}
+	if loaded > 0 {
+		fmt.Printf("loaded %d series\n", loaded)
+	}
+	return nil
+}
+
+// restoreOpenChunks puts each series' last chunk back, unless the series file
+// already holds it.
+func restoreOpenChunks(t *Tenant, open []OpenChunk) {
+	seriesMapMutex.Lock()
+	defer seriesMapMutex.Unlock()
+	for _, o := range open {
+		c := &chunk{}
+		if err := c.UnmarshalBinary(o.Chunk); err != nil {
+			fmt.Printf("ERROR: dropping open chunk of %s %s: %v\n", o.Device, o.Metric, err)
+			continue
+		}
+		key := seriesKey{t.key(o.Device), o.Metric, o.Step, o.Field}
+		s := seriesMap[key]
+		if s == nil {
+			s = &series{}
+			seriesMap[key] = s
+		}
+		if n := len(s.chunks); n > 0 && c.minTs <= s.chunks[n-1].maxTs {
+			continue
+		}
+		s.chunks = append(s.chunks, c)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// withSeriesStore points the state directory at a temporary one, with tenant
+// as the only tenant.
+func withSeriesStore(t *testing.T, tenant *Tenant) func() {
+	dir, err := ioutil.TempDir("", "series")
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedDir, savedTenants := stateDir, tenants
+	stateDir, tenants = dir, []*Tenant{tenant}
+	return func() {
+		clearSeries(tenant)
+		stateDir, tenants = savedDir, savedTenants
+		os.RemoveAll(dir)
+	}
+}
+
+func fillSeries(tenant *Tenant, from, n int) {
+	for i := from; i < from+n; i++ {
+		appendPoint(tenant.key("car1"), "miles", uint64(i*1000), float64(i))
+	}
+}
+
+func storedSeries(tenant *Tenant) []Point {
+	return queryRange(tenant.key("car1"), "miles", 0, ^uint64(0))
+}
+
+func writeSeriesSnapshot(t *testing.T) StateSnapshot {
+	s := takeSnapshot()
+	if err := writeSeries(s.writes); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func reloadSeries(t *testing.T, tenant *Tenant, s StateSnapshot) {
+	clearSeries(tenant)
+	if err := loadSeries(); err != nil {
+		t.Fatal(err)
+	}
+	restoreOpenChunks(tenant, s.Tenants[tenant.ID].Series)
+}
+
+func TestSeriesSurviveReload(t *testing.T) {
+	tenant := newTenant(&Tenant{ID: "series-reload"})
+	defer withSeriesStore(t, tenant)()
+
+	fillSeries(tenant, 1, 2*chunkPoints+10)
+	want := storedSeries(tenant)
+	s := writeSeriesSnapshot(t)
+	if open := s.Tenants[tenant.ID].Series; len(open) != 1 {
+		t.Fatalf("expected one open chunk in the snapshot, got %d", len(open))
+	}
+	reloadSeries(t, tenant, s)
+	if got := storedSeries(tenant); !reflect.DeepEqual(got, want) {
+		t.Fatalf("reloaded series has %d samples, want %d", len(got), len(want))
+	}
+
+	// Appending carries on from the reloaded chunks and only the newly
+	// sealed chunk is added to the file.
+	fillSeries(tenant, 2*chunkPoints+11, chunkPoints)
+	want = storedSeries(tenant)
+	s = writeSeriesSnapshot(t)
+	if w := s.writes[0]; w.rewrite || len(w.chunks) != 1 {
+		t.Fatalf("expected one chunk appended, got rewrite %v with %d chunks", w.rewrite, len(w.chunks))
+	}
+	reloadSeries(t, tenant, s)
+	if got := storedSeries(tenant); !reflect.DeepEqual(got, want) {
+		t.Fatalf("reloaded series has %d samples, want %d", len(got), len(want))
+	}
+}
+
+func TestSeriesSkipsOpenChunkAlreadyOnDisk(t *testing.T) {
+	tenant := newTenant(&Tenant{ID: "series-crash"})
+	defer withSeriesStore(t, tenant)()
+
+	// The snapshot is taken, then more samples seal its open chunk, which
+	// reaches the series file before a crash stops the next snapshot.
+	fillSeries(tenant, 1, chunkPoints+5)
+	old := writeSeriesSnapshot(t)
+	fillSeries(tenant, chunkPoints+6, chunkPoints)
+	want := storedSeries(tenant)
+	writeSeriesSnapshot(t)
+
+	reloadSeries(t, tenant, old)
+	fillSeries(tenant, chunkPoints+6, chunkPoints)
+	if got := storedSeries(tenant); !reflect.DeepEqual(got, want) {
+		t.Fatalf("reloaded series has %d samples, want %d", len(got), len(want))
+	}
+}
+
+func TestSeriesRewrittenAfterRetention(t *testing.T) {
+	tenant := newTenant(&Tenant{ID: "series-retention"})
+	defer withSeriesStore(t, tenant)()
+
+	fillSeries(tenant, 1, 3*chunkPoints+1)
+	writeSeriesSnapshot(t)
+
+	retention := storageConfigFor(tenant.ID).retentionFor("miles", 0)
+	enforceRetention(uint64((chunkPoints+1)*1000) + retention)
+	want := storedSeries(tenant)
+	if len(want) != 2*chunkPoints+1 {
+		t.Fatalf("expected retention to drop the first chunk, %d samples left", len(want))
+	}
+	s := writeSeriesSnapshot(t)
+	if w := s.writes[0]; !w.rewrite || len(w.chunks) != 2 {
+		t.Fatalf("expected the file rewritten with 2 chunks, got rewrite %v with %d", w.rewrite, len(w.chunks))
+	}
+	reloadSeries(t, tenant, s)
+	if got := storedSeries(tenant); !reflect.DeepEqual(got, want) {
+		t.Fatalf("reloaded series has %d samples, want %d", len(got), len(want))
+	}
+}
+
+func TestSeriesKeepsIntactPrefixOfDamagedFile(t *testing.T) {
+	tenant := newTenant(&Tenant{ID: "series-damaged"})
+	defer withSeriesStore(t, tenant)()
+
+	fillSeries(tenant, 1, 3*chunkPoints+1)
+	want := storedSeries(tenant)[:2*chunkPoints]
+	writeSeriesSnapshot(t)
+
+	path := filepath.Join(seriesDir(), seriesFileName(seriesKey{vehicleKey: tenant.key("car1"), metric: "miles"}))
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Truncate(path, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+	reloadSeries(t, tenant, StateSnapshot{})
+	if got := storedSeries(tenant); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the two intact chunks kept, got %d samples", len(got))
+	}
+	s := seriesFor(seriesKey{vehicleKey: tenant.key("car1"), metric: "miles"}, false)
+	if !s.rewrite {
+		t.Fatalf("a damaged file should be rewritten by the next snapshot")
+	}
+}
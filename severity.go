@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// SeverityBand classifies an event by the absolute value its rule reports.
+// Only events with bands configured count towards the lifetime penalty, each
+// weighted by the band it falls into.
+type SeverityBand struct {
+	Band      string  `json:"band"`
+	Min       float64 `json:"min"`
+	Weight    float64 `json:"weight"`
+	TagSuffix string  `json:"tagSuffix"`
+}
+
+type bandsByMin []SeverityBand
+
+func (b bandsByMin) Len() int           { return len(b) }
+func (b bandsByMin) Less(i, j int) bool { return b[i].Min < b[j].Min }
+func (b bandsByMin) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+var defaultBands = map[string][]SeverityBand{
+	"hardAcc":   standardBands(accThreshold),
+	"hardBreak": standardBands(accThreshold),
+}
+
+func standardBands(threshold float64) []SeverityBand {
+	return []SeverityBand{
+		{Band: "moderate", Min: threshold, Weight: 1},
+		{Band: "severe", Min: 2, Weight: 2, TagSuffix: "_Severe"},
+		{Band: "extreme", Min: 3, Weight: 4, TagSuffix: "_Extreme"},
+	}
+}
+
+func prepareSeverityBands(bands map[string][]SeverityBand) (map[string][]SeverityBand, error) {
+	if bands == nil {
+		bands = defaultBands
+	}
+	sorted := make(map[string][]SeverityBand)
+	for event, list := range bands {
+		if len(list) == 0 {
+			return nil, fmt.Errorf("severity bands for %q are empty", event)
+		}
+		list = append([]SeverityBand(nil), list...)
+		sort.Sort(bandsByMin(list))
+		for _, b := range list {
+			if b.Band == "" {
+				return nil, fmt.Errorf("severity band for %q has no name", event)
+			}
+		}
+		sorted[event] = list
+	}
+	return sorted, nil
+}
+
+// classify returns the band for an event value, falling back to the rule's own
+// severity (with no lifetime weight) when the event type has no bands.
+func classify(bands map[string][]SeverityBand, event string, value float64, fallback string) SeverityBand {
+	list, found := bands[event]
+	if !found {
+		return SeverityBand{Band: fallback}
+	}
+	band := list[0]
+	for _, b := range list {
+		if math.Abs(value) >= b.Min {
+			band = b
+		}
+	}
+	return band
+}
+
+func bandCountsJSON(counts map[string]map[string]int) string {
+	if counts == nil {
+		return "{}"
+	}
+	out, err := json.Marshal(counts)
+	if err != nil {
+		fmt.Println("ERROR: could not marshal severity counts")
+		return "{}"
+	}
+	return string(out)
+}
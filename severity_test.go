@@ -0,0 +1,56 @@
+package main
+
+import "testing"
+
+func TestClassifyBandEdges(t *testing.T) {
+	bands, err := prepareSeverityBands(map[string][]SeverityBand{
+		"hardBreak": {
+			{Band: "extreme", Min: 3, Weight: 4, TagSuffix: "_Extreme"},
+			{Band: "moderate", Min: 1, Weight: 1},
+			{Band: "severe", Min: 2, Weight: 2, TagSuffix: "_Severe"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		value  float64
+		band   string
+		weight float64
+	}{
+		{0.5, "moderate", 1},
+		{1, "moderate", 1},
+		{1.999, "moderate", 1},
+		{2, "severe", 2},
+		{2.5, "severe", 2},
+		{3, "extreme", 4},
+		{9, "extreme", 4},
+		// Braking reports negative values, banded by their size.
+		{-1, "moderate", 1},
+		{-2, "severe", 2},
+		{-2.999, "severe", 2},
+		{-3, "extreme", 4},
+	}
+	for _, c := range cases {
+		b := classify(bands, "hardBreak", c.value, "minor")
+		if b.Band != c.band || b.Weight != c.weight {
+			t.Errorf("classify(%v) = %s weight %v, want %s weight %v", c.value, b.Band, b.Weight, c.band, c.weight)
+		}
+	}
+	if b := classify(bands, "speeding", 100, "minor"); b.Band != "minor" || b.Weight != 0 {
+		t.Errorf("an event without bands should keep its rule's severity unweighted, got %+v", b)
+	}
+}
+
+func TestPrepareSeverityBandsRefusesBadBands(t *testing.T) {
+	if _, err := prepareSeverityBands(map[string][]SeverityBand{"hardAcc": {}}); err == nil {
+		t.Errorf("empty bands should be refused")
+	}
+	if _, err := prepareSeverityBands(map[string][]SeverityBand{"hardAcc": {{Min: 1}}}); err == nil {
+		t.Errorf("a band without a name should be refused")
+	}
+	bands, err := prepareSeverityBands(nil)
+	if err != nil || len(bands["hardAcc"]) != 3 || len(bands["hardBreak"]) != 3 {
+		t.Errorf("expected the default bands, got %v %v", bands, err)
+	}
+}
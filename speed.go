@@ -0,0 +1,143 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+)
+
+// Speed is derived from consecutive odometer readings. Readings closer together
+// than speedMinIntervalMs are accumulated, implausible speeds or jumps are
+// rejected, and the reported speed is the median of the last few estimates.
+
+const (
+	speedMinIntervalMs = 1000
+	speedMaxMph        = 200
+	speedMaxAccelMphPs = 15 // largest believable change in speed per second
+	speedMedianWindow  = 5
+	speedMaxRejects    = 3 // consecutive rejections before rebasing on the odometer
+)
+
+type speedState struct {
+	baseTs    uint64
+	baseMiles float64
+	primed    bool
+	recent    []float64
+	rejects   int
+	current   float64
+	max       float64
+}
+
+var (
+	speedMap      = make(map[vehicleKey]*speedState)
+	speedMapMutex = &sync.Mutex{}
+)
+
+func trackSpeed(t *Tenant, msg EdisonMessage) {
+	speedMapMutex.Lock()
+	defer speedMapMutex.Unlock()
+
+	s, found := speedMap[t.key(msg.ID)]
+	if !found {
+		s = &speedState{}
+		speedMap[t.key(msg.ID)] = s
+	}
+	s.observe(msg.Timestamp, msg.Miles)
+}
+
+func (s *speedState) observe(ts uint64, miles float64) {
+	if !s.primed || miles < s.baseMiles {
+		s.rebase(ts, miles)
+		return
+	}
+	if ts <= s.baseTs || ts-s.baseTs < speedMinIntervalMs {
+		return
+	}
+
+	dt := float64(ts-s.baseTs) / 1000
+	mph := (miles - s.baseMiles) / (dt / 3600)
+	if mph > speedMaxMph || (len(s.recent) > 0 && math.Abs(mph-s.current) > speedMaxAccelMphPs*dt) {
+		s.rejects++
+		if s.rejects >= speedMaxRejects {
+			s.rebase(ts, miles)
+		}
+		return
+	}
+
+	s.rejects = 0
+	s.baseTs, s.baseMiles = ts, miles
+	s.recent = append(s.recent, mph)
+	if len(s.recent) > speedMedianWindow {
+		s.recent = s.recent[1:]
+	}
+	s.current = median(s.recent)
+	s.max = math.Max(s.max, s.current)
+}
+
+func (s *speedState) rebase(ts uint64, miles float64) {
+	s.baseTs, s.baseMiles = ts, miles
+	s.primed = true
+	s.rejects = 0
+	s.recent = nil
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+// speeds returns the current and maximum speed in mph.
+func speeds(t *Tenant, id string) (float64, float64) {
+	speedMapMutex.Lock()
+	defer speedMapMutex.Unlock()
+	s, found := speedMap[t.key(id)]
+	if !found {
+		return 0, 0
+	}
+	return s.current, s.max
+}
+
+func clearSpeeds(t *Tenant) {
+	speedMapMutex.Lock()
+	for k := range speedMap {
+		if k.tenant == t.ID {
+			delete(speedMap, k)
+		}
+	}
+	speedMapMutex.Unlock()
+}
+
+type SpeedState struct {
+	BaseTs    uint64    `json:"baseTs"`
+	BaseMiles float64   `json:"baseMiles"`
+	Primed    bool      `json:"primed"`
+	Recent    []float64 `json:"recent"`
+	Rejects   int       `json:"rejects"`
+	Current   float64   `json:"current"`
+	Max       float64   `json:"max"`
+}
+
+func speedStates(t *Tenant) map[string]SpeedState {
+	speedMapMutex.Lock()
+	defer speedMapMutex.Unlock()
+	out := make(map[string]SpeedState)
+	for k, s := range speedMap {
+		if k.tenant == t.ID {
+			out[k.device] = SpeedState{s.baseTs, s.baseMiles, s.primed, append([]float64(nil), s.recent...), s.rejects, s.current, s.max}
+		}
+	}
+	return out
+}
+
+func restoreSpeeds(t *Tenant, states map[string]SpeedState) {
+	speedMapMutex.Lock()
+	defer speedMapMutex.Unlock()
+	for carId, s := range states {
+		speedMap[t.key(carId)] = &speedState{s.BaseTs, s.BaseMiles, s.Primed, s.Recent, s.Rejects, s.Current, s.Max}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// drive feeds observe a reading every stepMs at mph, starting from s's base.
+func drive(s *speedState, ts uint64, miles float64, stepMs uint64, mph float64, n int) (uint64, float64) {
+	for i := 0; i < n; i++ {
+		ts += stepMs
+		miles += mph * float64(stepMs) / 3600000
+		s.observe(ts, miles)
+	}
+	return ts, miles
+}
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-6
+}
+
+func TestSpeedSteady(t *testing.T) {
+	s := &speedState{}
+	s.observe(1000, 100)
+	if s.current != 0 || !s.primed {
+		t.Fatalf("the first reading should only prime the estimate: %+v", s)
+	}
+	drive(s, 1000, 100, 10000, 60, 8)
+	if !near(s.current, 60) || !near(s.max, 60) || len(s.recent) != speedMedianWindow {
+		t.Fatalf("expected 60 mph over a full window, got %+v", s)
+	}
+}
+
+func TestSpeedAccumulatesCloseReadings(t *testing.T) {
+	s := &speedState{}
+	s.observe(1000, 100)
+	s.observe(1400, 100.01)
+	s.observe(1800, 100.01)
+	if s.baseTs != 1000 || len(s.recent) != 0 {
+		t.Fatalf("readings within %dms should not make an estimate: %+v", speedMinIntervalMs, s)
+	}
+	s.observe(2000, 100+30.0/3600)
+	if !near(s.current, 30) || s.baseTs != 2000 {
+		t.Fatalf("expected 30 mph from the first reading a second on, got %+v", s)
+	}
+	s.observe(2000, 101)
+	s.observe(1500, 101)
+	if s.baseTs != 2000 || len(s.recent) != 1 {
+		t.Fatalf("repeated and older timestamps should be ignored: %+v", s)
+	}
+}
+
+func TestSpeedMedianSmoothsSpikes(t *testing.T) {
+	s := &speedState{}
+	s.observe(0, 100)
+	ts, miles := drive(s, 0, 100, 10000, 60, 2)
+	ts, miles = drive(s, ts, miles, 10000, 80, 1)
+	drive(s, ts, miles, 10000, 60, 1)
+	if !near(s.current, 60) || !near(s.max, 60) {
+		t.Fatalf("a single fast estimate should not move the median: %+v", s)
+	}
+}
+
+func TestSpeedRejectsJumps(t *testing.T) {
+	s := &speedState{}
+	s.observe(0, 100)
+	ts, miles := drive(s, 0, 100, 10000, 60, 3)
+
+	// Faster than any vehicle: rejected until it has happened
+	// speedMaxRejects times, then taken as the new base.
+	for i := 1; i < speedMaxRejects; i++ {
+		ts += 10000
+		s.observe(ts, miles+float64(i)*10)
+		if !near(s.current, 60) || s.rejects != i {
+			t.Fatalf("jump %d should be rejected: %+v", i, s)
+		}
+	}
+	ts += 10000
+	miles += float64(speedMaxRejects) * 10
+	s.observe(ts, miles)
+	if s.rejects != 0 || s.baseTs != ts || s.recent != nil {
+		t.Fatalf("expected a rebase after %d rejections: %+v", speedMaxRejects, s)
+	}
+	drive(s, ts, miles, 10000, 30, 1)
+	if !near(s.current, 30) || !near(s.max, 60) {
+		t.Fatalf("the estimate after a rebase should start afresh: %+v", s)
+	}
+}
+
+func TestSpeedRejectsSharpChanges(t *testing.T) {
+	s := &speedState{}
+	s.observe(0, 100)
+	ts, miles := drive(s, 0, 100, 1000, 60, 3)
+	// 60 to 90 mph within a second is more than speedMaxAccelMphPs.
+	drive(s, ts, miles, 1000, 90, 1)
+	if !near(s.current, 60) || s.rejects != 1 {
+		t.Fatalf("a change of 30 mph in a second should be rejected: %+v", s)
+	}
+}
+
+func TestSpeedRebasesOnOdometerReset(t *testing.T) {
+	s := &speedState{}
+	s.observe(0, 100)
+	ts, _ := drive(s, 0, 100, 10000, 60, 3)
+	s.observe(ts+10000, 5)
+	if s.baseMiles != 5 || s.recent != nil {
+		t.Fatalf("a lower odometer reading should rebase: %+v", s)
+	}
+	drive(s, ts+10000, 5, 10000, 20, 1)
+	if !near(s.current, 20) {
+		t.Fatalf("expected 20 mph after the reset, got %+v", s)
+	}
+}
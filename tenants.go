@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// Tenants are listed in TENANTS_FILE as a JSON array. A request belongs to the
+// tenant holding its X-API-Key header (or apiKey query parameter, for
+// websockets), or failing that the tenant serving its Host; anything else is
+// refused. Without TENANTS_FILE there is a single tenant, "default", built
+// from TOKEN, WEBHOOKS, RULES_FILE and ASSET_SERVICE_URL, and every request
+// belongs to it.
+//
+// Each tenant has its own vehicle registry and asset pool, detection rules and
+// every other section of its rules file, APM credentials, webhooks and
+// websocket clients. Per-device state kept elsewhere is keyed by tenant and
+// device, so two tenants can each have a device of the same ID.
+
+type Tenant struct {
+	ID              string   `json:"id"`
+	APIKeys         []string `json:"apiKeys,omitempty"`
+	Hosts           []string `json:"hosts,omitempty"`
+	RulesFile       string   `json:"rulesFile,omitempty"`
+	Token           string   `json:"token,omitempty"`
+	APMTenant       string   `json:"apmTenant,omitempty"`
+	Webhooks        []string `json:"webhooks,omitempty"`
+	AssetServiceURL string   `json:"assetServiceUrl,omitempty"`
+
+	registry *VehicleRegistry
+
+	rulesMutex sync.RWMutex
+	rules      tenantRules
+
+	conns      map[*websocket.Conn]bool
+	connsMutex sync.Mutex
+
+	catalog      AssetCatalog
+	catalogMutex sync.RWMutex
+}
+
+type vehicleKey struct {
+	tenant string
+	device string
+}
+
+var (
+	tenantsFile = os.Getenv("TENANTS_FILE")
+	tenants     []*Tenant
+)
+
+func newTenant(t *Tenant) *Tenant {
+	t.registry = newVehicleRegistry(defaultAssetIds)
+	t.rules, _ = compileRules(defaultRules)
+	t.conns = make(map[*websocket.Conn]bool)
+	t.catalog = AssetCatalog{Source: t.AssetServiceURL, Assets: []Asset{}}
+	return t
+}
+
+func loadTenants() ([]*Tenant, error) {
+	if tenantsFile == "" {
+		return []*Tenant{newTenant(&Tenant{
+			ID:              "default",
+			Token:           token,
+			APMTenant:       apmTenant,
+			Webhooks:        splitList(os.Getenv("WEBHOOKS")),
+			AssetServiceURL: os.Getenv("ASSET_SERVICE_URL"),
+		})}, nil
+	}
+
+	data, err := ioutil.ReadFile(tenantsFile)
+	if err != nil {
+		return nil, err
+	}
+	var list []*Tenant
+	if err = json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("no tenants in %s", tenantsFile)
+	}
+	ids, keys, hosts := make(map[string]bool), make(map[string]string), make(map[string]string)
+	for _, t := range list {
+		if t.ID == "" || ids[t.ID] {
+			return nil, fmt.Errorf("tenant %q: ids must be unique and not blank", t.ID)
+		}
+		ids[t.ID] = true
+		if len(t.APIKeys) == 0 && len(t.Hosts) == 0 {
+			return nil, fmt.Errorf("tenant %q: needs an API key or a host", t.ID)
+		}
+		for _, k := range t.APIKeys {
+			if other, taken := keys[k]; taken || k == "" {
+				return nil, fmt.Errorf("tenant %q: API key is blank or also used by %q", t.ID, other)
+			}
+			keys[k] = t.ID
+		}
+		for _, h := range t.Hosts {
+			if other, taken := hosts[h]; taken || h == "" {
+				return nil, fmt.Errorf("tenant %q: host %q is blank or also used by %q", t.ID, h, other)
+			}
+			hosts[h] = t.ID
+		}
+		newTenant(t)
+	}
+	return list, nil
+}
+
+func tenantByID(id string) *Tenant {
+	for _, t := range tenants {
+		if t.ID == id {
+			return t
+		}
+	}
+	return nil
+}
+
+// resolveTenant finds the tenant a request belongs to, or nil. A key that
+// matches no tenant is refused rather than falling back to the host.
+func resolveTenant(r *http.Request) *Tenant {
+	if tenantsFile == "" {
+		return tenants[0]
+	}
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		key = r.URL.Query().Get("apiKey")
+	}
+	if key != "" {
+		for _, t := range tenants {
+			for _, k := range t.APIKeys {
+				if k == key {
+					return t
+				}
+			}
+		}
+		return nil
+	}
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	for _, t := range tenants {
+		for _, h := range t.Hosts {
+			if h == host {
+				return t
+			}
+		}
+	}
+	return nil
+}
+
+func withTenant(handler func(http.ResponseWriter, *http.Request, *Tenant)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t := resolveTenant(r)
+		if t == nil {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.WriteHeader(401)
+			return
+		}
+		handler(w, r, t)
+	}
+}
+
+func (t *Tenant) key(device string) vehicleKey {
+	return vehicleKey{t.ID, device}
+}
+
+func (t *Tenant) currentRules() tenantRules {
+	t.rulesMutex.RLock()
+	defer t.rulesMutex.RUnlock()
+	return t.rules
+}
+
+func (t *Tenant) severity() map[string][]SeverityBand {
+	return t.currentRules().bands
+}
+
+// setRules applies the tenant's share of a rules reload. The pool is left to
+// the asset service once that has been synced.
+func (t *Tenant) setRules(r tenantRules) {
+	t.rulesMutex.Lock()
+	t.rules = r
+	t.rulesMutex.Unlock()
+	if !t.catalogSynced() {
+		t.registry.setAssets(r.pool)
+	}
+}
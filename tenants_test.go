@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// withTwoTenants serves acme (key ka, host a.local) and beta (key kb, host
+// b.local), neither with assets so nothing is posted to the APM service.
+// beta only counts hard accelerations above 5g.
+func withTwoTenants(t *testing.T) (*Tenant, *Tenant, *httptest.Server, func()) {
+	acme := newTenant(&Tenant{ID: "acme", APIKeys: []string{"ka"}, Hosts: []string{"a.local"}})
+	beta := newTenant(&Tenant{ID: "beta", APIKeys: []string{"kb"}, Hosts: []string{"b.local"}})
+	rules, err := compileRules(RuleConfig{Rules: []*Rule{{Name: "hard_acceleration", Event: "hardAcc", Expr: "x > 5", Value: "x", Severity: "moderate", Tag: "Tag_Hard_Acceleration_1"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	beta.setRules(rules)
+	for _, tenant := range []*Tenant{acme, beta} {
+		tenant.registry.setAssets(nil)
+	}
+
+	savedFile, savedTenants := tenantsFile, tenants
+	tenantsFile, tenants = "tenants.json", []*Tenant{acme, beta}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", withTenant(receive))
+	mux.HandleFunc("/listen", withTenant(listen))
+	mux.HandleFunc("/vehicles/", withTenant(vehicles))
+	mux.HandleFunc("/alerts", withTenant(listAlerts))
+	srv := httptest.NewServer(mux)
+	return acme, beta, srv, func() {
+		srv.Close()
+		resetTenant(acme)
+		resetTenant(beta)
+		tenantsFile, tenants = savedFile, savedTenants
+	}
+}
+
+func tenantRequest(t *testing.T, srv *httptest.Server, method, path, key, host, body string) (int, string) {
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "" {
+		req.Header.Set("X-API-Key", key)
+	}
+	if host != "" {
+		req.Host = host
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, string(data)
+}
+
+func postReading(t *testing.T, srv *httptest.Server, key string, ts uint64, x float64) {
+	body := fmt.Sprintf(`{"form": {"id": "car1", "ts": %d, "miles": 1, "x": %v}}`, ts, x)
+	if code, reply := tenantRequest(t, srv, "POST", "/", key, "", body); code != 202 {
+		t.Fatalf("posting to %s: %d %s", key, code, reply)
+	}
+}
+
+func TestResolveTenant(t *testing.T) {
+	acme, beta, _, done := withTwoTenants(t)
+	defer done()
+	cases := []struct {
+		key, query, host string
+		want             *Tenant
+	}{
+		{"ka", "", "", acme},
+		{"kb", "", "", beta},
+		{"", "ka", "", acme},
+		{"", "", "b.local", beta},
+		{"", "", "a.local:8080", acme},
+		{"ka", "", "b.local", acme},
+		{"wrong", "", "b.local", nil},
+		{"", "", "c.local", nil},
+		{"", "", "", nil},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/alerts", nil)
+		if c.key != "" {
+			r.Header.Set("X-API-Key", c.key)
+		}
+		if c.query != "" {
+			r.URL.RawQuery = "apiKey=" + c.query
+		}
+		r.Host = c.host
+		if got := resolveTenant(r); got != c.want {
+			t.Errorf("key %q, query %q, host %q: got %v, want %v", c.key, c.query, c.host, got, c.want)
+		}
+	}
+}
+
+func TestWithTenantRefusesUnknownKey(t *testing.T) {
+	_, _, srv, done := withTwoTenants(t)
+	defer done()
+	if code, _ := tenantRequest(t, srv, "GET", "/alerts", "wrong", "", ""); code != 401 {
+		t.Fatalf("an unknown key should get 401, got %d", code)
+	}
+	if code, _ := tenantRequest(t, srv, "GET", "/alerts", "", "nobody.local", ""); code != 401 {
+		t.Fatalf("an unknown host should get 401, got %d", code)
+	}
+	if code, _ := tenantRequest(t, srv, "GET", "/alerts", "", "b.local", ""); code != 200 {
+		t.Fatalf("a known host should be served, got %d", code)
+	}
+}
+
+func TestTenantsSharingDeviceIDStaySeparate(t *testing.T) {
+	acme, beta, srv, done := withTwoTenants(t)
+	defer done()
+	base := nowMs()/1000*1000 - 60000
+	for i := uint64(0); i < 3; i++ {
+		postReading(t, srv, "ka", base+i*1000, 2)
+	}
+	postReading(t, srv, "kb", base, 2)
+
+	// beta's rules do not count a 2g acceleration; acme's do.
+	a, _ := acme.registry.vehicle("car1")
+	b, _ := beta.registry.vehicle("car1")
+	if a.Events["hardAcc"] == 0 || b.Events["hardAcc"] != 0 {
+		t.Fatalf("expected only acme to count hard accelerations, got %v and %v", a.Events, b.Events)
+	}
+
+	for key, want := range map[string]int{"ka": 3, "kb": 1} {
+		code, body := tenantRequest(t, srv, "GET", fmt.Sprintf("/vehicles/car1/readings?metric=x&from=%d", base), key, "", "")
+		var res HistoryResult
+		if code != 200 || json.Unmarshal([]byte(body), &res) != nil {
+			t.Fatalf("%s readings: %d %s", key, code, body)
+		}
+		if len(res.Series["x"]) != want {
+			t.Fatalf("%s should see its own %d readings, got %+v", key, want, res.Series)
+		}
+	}
+
+	raiseAlert(acme, "car1", AlertRule{Name: "acme_only", Severity: "high"}, 1, "acme only", base)
+	for key, want := range map[string]int{"ka": 1, "kb": 0} {
+		var out []Alert
+		code, body := tenantRequest(t, srv, "GET", "/alerts?carId=car1", key, "", "")
+		if code != 200 || json.Unmarshal([]byte(body), &out) != nil || len(out) != want {
+			t.Fatalf("%s should see %d alerts, got %d %s", key, want, code, body)
+		}
+	}
+}
+
+func dialTenant(t *testing.T, srv *httptest.Server, tenant *Tenant, key string) *websocket.Conn {
+	c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/listen?apiKey="+key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The handler adds the connection just after the handshake.
+	for i := 0; i < 100; i++ {
+		tenant.connsMutex.Lock()
+		n := len(tenant.conns)
+		tenant.connsMutex.Unlock()
+		if n > 0 {
+			return c
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s websocket never registered", tenant.ID)
+	return nil
+}
+
+func TestBroadcastStaysWithinTenant(t *testing.T) {
+	acme, beta, srv, done := withTwoTenants(t)
+	defer done()
+	ca := dialTenant(t, srv, acme, "ka")
+	defer ca.Close()
+	cb := dialTenant(t, srv, beta, "kb")
+	defer cb.Close()
+
+	broadcast(acme, `{"carId":"car1","tenant":"acme"}`)
+	ca.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, msg, err := ca.ReadMessage(); err != nil || !strings.Contains(string(msg), `"acme"`) {
+		t.Fatalf("acme's client should get acme's broadcast: %q, %v", msg, err)
+	}
+	cb.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if _, msg, err := cb.ReadMessage(); err == nil {
+		t.Fatalf("beta's client got acme's broadcast: %q", msg)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// A trip starts when the odometer moves and ends when readings stop arriving
+// for tripGapMs or the odometer stays put for tripIdleMs. A vehicle that stops
+// reporting altogether has its trip closed by the wall clock, checked every
+// tripCheckEach.
+
+const (
+	tripGapMs     = 5 * 60 * 1000
+	tripIdleMs    = 5 * 60 * 1000
+	tripMinMove   = 0.001 // miles the odometer must advance to count as moving
+	tripsPerCar   = 500
+	tripCheckEach = time.Minute
+)
+
+type Trip struct {
+	ID         string                    `json:"id"`
+	Start      uint64                    `json:"start"`
+	End        uint64                    `json:"end"`
+	StartMiles float64                   `json:"startMiles"`
+	EndMiles   float64                   `json:"endMiles"`
+	Distance   float64                   `json:"distance"`
+	Events     map[string]int            `json:"events"`
+	Severity   map[string]map[string]int `json:"severity"`
+	Score      float64                   `json:"score"`
+	Active     bool                      `json:"active"`
+}
+
+type tripState struct {
+	trips      []*Trip
+	current    *Trip
+	lastTs     uint64
+	lastMiles  float64
+	lastMoveTs uint64
+	primed     bool
+}
+
+var (
+	tripMap      = make(map[vehicleKey]*tripState)
+	tripMapMutex = &sync.Mutex{}
+)
+
+func trackTrip(tenant *Tenant, msg EdisonMessage) {
+	config := tenant.currentRules().scoring
+	severity := tenant.severity()
+
+	tripMapMutex.Lock()
+	t, found := tripMap[tenant.key(msg.ID)]
+	if !found {
+		t = &tripState{}
+		tripMap[tenant.key(msg.ID)] = t
+	}
+	closed := t.observe(msg)
+	var trip Trip
+	var vehicle float64
+	if closed != nil {
+		closed.Score = tripScore(closed, config, severity)
+		trip = *closed
+		vehicle = rollingScore(t, config, severity)
+	}
+	tripMapMutex.Unlock()
+
+	if closed != nil && !replayingWAL() {
+		apmId := tenant.registry.apmId(msg.ID)
+		go storeScores(tenant, apmId, trip, vehicle)
+	}
+}
+
+// observe updates the current trip and returns the trip it closed, if any.
+func (t *tripState) observe(msg EdisonMessage) *Trip {
+	if !t.primed {
+		t.lastTs, t.lastMiles, t.primed = msg.Timestamp, msg.Miles, true
+		return nil
+	}
+	if msg.Timestamp < t.lastTs {
+		return nil
+	}
+
+	var closed *Trip
+	if t.current != nil {
+		if msg.Timestamp > t.lastTs+tripGapMs || msg.Timestamp > t.lastMoveTs+tripIdleMs {
+			closed = t.current
+			t.close()
+		}
+	}
+
+	if msg.Miles-t.lastMiles >= tripMinMove {
+		if t.current == nil {
+			t.open(msg.ID, t.lastTs, t.lastMiles)
+		}
+		t.lastMoveTs = msg.Timestamp
+	}
+
+	if t.current != nil && msg.Timestamp == t.lastMoveTs {
+		t.current.End = msg.Timestamp
+		t.current.EndMiles = msg.Miles
+		t.current.Distance = t.current.EndMiles - t.current.StartMiles
+	}
+	if msg.Miles >= t.lastMiles || msg.Timestamp > t.lastTs+tripGapMs {
+		t.lastMiles = msg.Miles
+	}
+	t.lastTs = msg.Timestamp
+	return closed
+}
+
+func (t *tripState) open(carId string, ts uint64, miles float64) {
+	t.current = &Trip{
+		ID:         fmt.Sprintf("%s-%d", carId, ts),
+		Start:      ts,
+		End:        ts,
+		StartMiles: miles,
+		EndMiles:   miles,
+		Events:     make(map[string]int),
+		Severity:   make(map[string]map[string]int),
+		Active:     true,
+	}
+	t.trips = append(t.trips, t.current)
+	if len(t.trips) > tripsPerCar {
+		t.trips = t.trips[1:]
+	}
+}
+
+func (t *tripState) close() {
+	t.current.Active = false
+	t.current = nil
+}
+
+type idleTrip struct {
+	carId   string
+	trip    Trip
+	vehicle float64
+}
+
+// closeIdleTrips closes the open trips of vehicles that have not reported for
+// tripGapMs before now, scoring them as trackTrip would.
+func closeIdleTrips(now uint64) {
+	for _, tenant := range tenants {
+		config := tenant.currentRules().scoring
+		severity := tenant.severity()
+
+		var closed []idleTrip
+		tripMapMutex.Lock()
+		for k, t := range tripMap {
+			if k.tenant != tenant.ID || t.current == nil || now <= t.lastTs+tripGapMs {
+				continue
+			}
+			trip := t.current
+			t.close()
+			trip.Score = tripScore(trip, config, severity)
+			closed = append(closed, idleTrip{k.device, *trip, rollingScore(t, config, severity)})
+		}
+		tripMapMutex.Unlock()
+
+		for _, c := range closed {
+			go storeScores(tenant, tenant.registry.apmId(c.carId), c.trip, c.vehicle)
+		}
+	}
+}
+
+func watchIdleTrips() {
+	ticker := time.NewTicker(tripCheckEach)
+	for range ticker.C {
+		closeIdleTrips(nowMs())
+	}
+}
+
+func countTripEvent(tenant *Tenant, carId string, event string, band string) {
+	tripMapMutex.Lock()
+	defer tripMapMutex.Unlock()
+	if t, found := tripMap[tenant.key(carId)]; found && t.current != nil {
+		t.current.Events[event] = t.current.Events[event] + 1
+		if t.current.Severity[event] == nil {
+			t.current.Severity[event] = make(map[string]int)
+		}
+		t.current.Severity[event][band] = t.current.Severity[event][band] + 1
+	}
+}
+
+func vehicleTrips(tenant *Tenant, carId string) []Trip {
+	config := tenant.currentRules().scoring
+	severity := tenant.severity()
+	tripMapMutex.Lock()
+	defer tripMapMutex.Unlock()
+
+	trips := []Trip{}
+	t, found := tripMap[tenant.key(carId)]
+	if !found {
+		return trips
+	}
+	for _, trip := range t.trips {
+		copied := copyTrip(trip)
+		copied.Score = tripScore(trip, config, severity)
+		trips = append(trips, copied)
+	}
+	return trips
+}
+
+func copyTrip(trip *Trip) Trip {
+	copied := *trip
+	copied.Events = make(map[string]int)
+	for event, n := range trip.Events {
+		copied.Events[event] = n
+	}
+	copied.Severity = make(map[string]map[string]int)
+	for event, bands := range trip.Severity {
+		copied.Severity[event] = make(map[string]int)
+		for band, n := range bands {
+			copied.Severity[event][band] = n
+		}
+	}
+	return copied
+}
+
+func clearTrips(tenant *Tenant) {
+	tripMapMutex.Lock()
+	for k := range tripMap {
+		if k.tenant == tenant.ID {
+			delete(tripMap, k)
+		}
+	}
+	tripMapMutex.Unlock()
+}
+
+type TripHistory struct {
+	Trips      []Trip  `json:"trips"`
+	LastTs     uint64  `json:"lastTs"`
+	LastMiles  float64 `json:"lastMiles"`
+	LastMoveTs uint64  `json:"lastMoveTs"`
+	Primed     bool    `json:"primed"`
+}
+
+func tripHistories(tenant *Tenant) map[string]TripHistory {
+	tripMapMutex.Lock()
+	defer tripMapMutex.Unlock()
+	out := make(map[string]TripHistory)
+	for k, t := range tripMap {
+		if k.tenant != tenant.ID {
+			continue
+		}
+		h := TripHistory{LastTs: t.lastTs, LastMiles: t.lastMiles, LastMoveTs: t.lastMoveTs, Primed: t.primed}
+		for _, trip := range t.trips {
+			h.Trips = append(h.Trips, copyTrip(trip))
+		}
+		out[k.device] = h
+	}
+	return out
+}
+
+// restoreTrips reopens the last trip if it was still active.
+func restoreTrips(tenant *Tenant, histories map[string]TripHistory) {
+	tripMapMutex.Lock()
+	defer tripMapMutex.Unlock()
+	for carId, h := range histories {
+		t := &tripState{lastTs: h.LastTs, lastMiles: h.LastMiles, lastMoveTs: h.LastMoveTs, primed: h.Primed}
+		for i := range h.Trips {
+			trip := h.Trips[i]
+			t.trips = append(t.trips, &trip)
+		}
+		if n := len(t.trips); n > 0 && t.trips[n-1].Active {
+			t.current = t.trips[n-1]
+		}
+		tripMap[tenant.key(carId)] = t
+	}
+}
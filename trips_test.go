@@ -0,0 +1,55 @@
+package main
+
+import "testing"
+
+func TestTripObserve(t *testing.T) {
+	s := &tripState{}
+	readings := []EdisonMessage{
+		{ID: "car1", Timestamp: 1000, Miles: 10},
+		{ID: "car1", Timestamp: 2000, Miles: 10.5},
+		{ID: "car1", Timestamp: 1500, Miles: 99},
+		{ID: "car1", Timestamp: 3000, Miles: 11},
+	}
+	for _, msg := range readings {
+		if closed := s.observe(msg); closed != nil {
+			t.Fatalf("no trip should close yet, closed %+v", closed)
+		}
+	}
+	if s.current == nil || s.current.Start != 1000 || s.current.End != 3000 || s.current.Distance != 1 {
+		t.Fatalf("unexpected trip %+v", s.current)
+	}
+
+	closed := s.observe(EdisonMessage{ID: "car1", Timestamp: 3000 + tripGapMs + 1, Miles: 12})
+	if closed == nil || closed.End != 3000 || closed.Active {
+		t.Fatalf("a gap should close the trip, got %+v", closed)
+	}
+	if s.current == nil || s.current.Start != 3000 {
+		t.Fatalf("moving after the gap should open a new trip from the last reading, got %+v", s.current)
+	}
+}
+
+func TestCloseIdleTrips(t *testing.T) {
+	tenant := newTenant(&Tenant{ID: "trips-idle"})
+	saved := tenants
+	tenants = append(append([]*Tenant(nil), saved...), tenant)
+	defer func() {
+		tenants = saved
+		clearTrips(tenant)
+	}()
+
+	trackTrip(tenant, EdisonMessage{ID: "car1", Timestamp: 1000, Miles: 10})
+	trackTrip(tenant, EdisonMessage{ID: "car1", Timestamp: 2000, Miles: 11})
+	if trips := vehicleTrips(tenant, "car1"); len(trips) != 1 || !trips[0].Active {
+		t.Fatalf("expected one active trip, got %+v", trips)
+	}
+
+	closeIdleTrips(2000 + tripGapMs)
+	if trips := vehicleTrips(tenant, "car1"); !trips[0].Active {
+		t.Fatalf("trip closed before its gap had passed")
+	}
+	closeIdleTrips(2000 + tripGapMs + 1)
+	trips := vehicleTrips(tenant, "car1")
+	if len(trips) != 1 || trips[0].Active || trips[0].End != 2000 {
+		t.Fatalf("idle trip should be closed, got %+v", trips)
+	}
+}
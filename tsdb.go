@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The router keeps its own history of raw readings (x, y, z and miles per
+// device) and of every detected event (as "event.<name>" series holding the
+// event's value). Each series is a list of Gorilla-compressed chunks, kept on
+// disk with the snapshots (see seriesstore.go); whole chunks are dropped once
+// they fall out of the series' retention.
+// Raw series have step 0; rollup series (see rollup.go) carry their tier's
+// step and the aggregate they hold in field.
+
+const (
+	chunkPoints        = 1024
+	retentionCheckEach = time.Minute
+	eventSeriesPrefix  = "event."
+)
+
+type StorageConfig struct {
+	DefaultRetentionMs uint64            `json:"defaultRetentionMs"`
+	RetentionMs        map[string]uint64 `json:"retentionMs,omitempty"`
+	Tiers              []RollupTier      `json:"tiers"`
+}
+
+type Point struct {
+	Ts uint64  `json:"ts"`
+	V  float64 `json:"v"`
+}
+
+type series struct {
+	mu        sync.Mutex
+	chunks    []*chunk
+	persisted int
+	rewrite   bool
+}
+
+type seriesKey struct {
+	vehicleKey
+	metric string
+	step   uint64
+	field  string
+}
+
+var (
+	day                  = uint64(24 * time.Hour / time.Millisecond)
+	defaultStorageConfig = StorageConfig{
+		DefaultRetentionMs: 3 * day,
+		RetentionMs:        map[string]uint64{"events": 365 * day},
+		Tiers:              defaultTiers,
+	}
+
+	seriesMap      = make(map[seriesKey]*series)
+	seriesMapMutex = &sync.RWMutex{}
+)
+
+func prepareStorageConfig(config *StorageConfig) (StorageConfig, error) {
+	if config == nil {
+		return defaultStorageConfig, nil
+	}
+	c := *config
+	if c.DefaultRetentionMs == 0 {
+		return c, fmt.Errorf("storage defaultRetentionMs must be positive")
+	}
+	for metric, ms := range c.RetentionMs {
+		if ms == 0 {
+			return c, fmt.Errorf("storage retention for %q must be positive", metric)
+		}
+	}
+	if c.Tiers == nil {
+		c.Tiers = defaultTiers
+	}
+	return c, validateTiers(c.Tiers)
+}
+
+// retentionFor looks the metric up by name, then as "events" for any event
+// series, then falls back to the default. Rollups keep their tier's retention.
+func (c StorageConfig) retentionFor(metric string, step uint64) uint64 {
+	for _, t := range c.Tiers {
+		if step > 0 && t.StepMs == step {
+			return t.RetentionMs
+		}
+	}
+	if ms, found := c.RetentionMs[metric]; found {
+		return ms
+	}
+	if strings.HasPrefix(metric, eventSeriesPrefix) {
+		if ms, found := c.RetentionMs["events"]; found {
+			return ms
+		}
+	}
+	return c.DefaultRetentionMs
+}
+
+func seriesFor(key seriesKey, create bool) *series {
+	seriesMapMutex.RLock()
+	s := seriesMap[key]
+	seriesMapMutex.RUnlock()
+	if s != nil || !create {
+		return s
+	}
+
+	seriesMapMutex.Lock()
+	defer seriesMapMutex.Unlock()
+	if s = seriesMap[key]; s == nil {
+		s = &series{}
+		seriesMap[key] = s
+	}
+	return s
+}
+
+func appendPoint(k vehicleKey, metric string, ts uint64, v float64) bool {
+	return appendSeries(seriesKey{vehicleKey: k, metric: metric}, ts, v)
+}
+
+// appendSeries adds a sample to a series. Samples older than the newest one
+// already stored are dropped, as chunks only encode forward deltas.
+func appendSeries(key seriesKey, ts uint64, v float64) bool {
+	s := seriesFor(key, true)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := len(s.chunks)
+	if n > 0 && ts <= s.chunks[n-1].maxTs {
+		return false
+	}
+	if n == 0 || s.chunks[n-1].count >= chunkPoints {
+		s.chunks = append(s.chunks, &chunk{})
+		n++
+	}
+	s.chunks[n-1].append(ts, v)
+	return true
+}
+
+func storeReading(t *Tenant, msg EdisonMessage) {
+	k := t.key(msg.ID)
+	appendPoint(k, "x", msg.Timestamp, msg.X)
+	appendPoint(k, "y", msg.Timestamp, msg.Y)
+	appendPoint(k, "z", msg.Timestamp, msg.Z)
+	appendPoint(k, "miles", msg.Timestamp, msg.Miles)
+}
+
+func storeEventPoint(t *Tenant, carId string, event string, ts uint64, v float64) {
+	appendPoint(t.key(carId), eventSeriesPrefix+event, ts, v)
+}
+
+func queryRange(k vehicleKey, metric string, from uint64, to uint64) []Point {
+	return querySeries(seriesKey{vehicleKey: k, metric: metric}, from, to)
+}
+
+// querySeries returns the samples of a series with from <= ts < to.
+func querySeries(key seriesKey, from uint64, to uint64) []Point {
+	s := seriesFor(key, false)
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out []Point
+	for _, c := range s.chunks {
+		if c.maxTs < from || c.minTs >= to {
+			continue
+		}
+		c.each(func(ts uint64, v float64) bool {
+			if ts >= to {
+				return false
+			}
+			if ts >= from {
+				out = append(out, Point{ts, v})
+			}
+			return true
+		})
+	}
+	return out
+}
+
+// deviceMetrics lists the metrics stored for a device with the given prefix.
+func deviceMetrics(k vehicleKey, prefix string) []string {
+	seriesMapMutex.RLock()
+	defer seriesMapMutex.RUnlock()
+	var out []string
+	for key := range seriesMap {
+		if key.vehicleKey == k && key.step == 0 && strings.HasPrefix(key.metric, prefix) {
+			out = append(out, key.metric)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// enforceRetention drops every chunk whose newest sample is older than its
+// series' retention, and series left with no chunks at all.
+func enforceRetention(now uint64) {
+	snapshotMutex.Lock()
+	defer snapshotMutex.Unlock()
+	seriesMapMutex.Lock()
+	defer seriesMapMutex.Unlock()
+	for key, s := range seriesMap {
+		retention := storageConfigFor(key.tenant).retentionFor(key.metric, key.step)
+		s.mu.Lock()
+		kept := s.chunks[:0]
+		for _, c := range s.chunks {
+			if now < retention || c.maxTs >= now-retention {
+				kept = append(kept, c)
+			}
+		}
+		for i := len(kept); i < len(s.chunks); i++ {
+			s.chunks[i] = nil
+		}
+		if len(kept) < len(s.chunks) {
+			s.rewrite = true
+		}
+		s.chunks = kept
+		empty := len(kept) == 0
+		s.mu.Unlock()
+		if empty {
+			delete(seriesMap, key)
+		}
+	}
+}
+
+// watchRetention rolls finished buckets up before dropping expired chunks, so
+// raw data is always summarised before it goes.
+func watchRetention() {
+	ticker := time.NewTicker(retentionCheckEach)
+	for range ticker.C {
+		now := nowMs()
+		compact(now)
+		enforceRetention(now)
+	}
+}
+
+func nowMs() uint64 {
+	return uint64(time.Now().UnixNano() / int64(time.Millisecond))
+}
+
+func clearSeries(t *Tenant) {
+	seriesMapMutex.Lock()
+	for k := range seriesMap {
+		if k.tenant == t.ID {
+			delete(seriesMap, k)
+		}
+	}
+	seriesMapMutex.Unlock()
+	clearCompaction(t)
+}
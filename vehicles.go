@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+type VehicleDetail struct {
+	CarID       string                    `json:"carId"`
+	ApmID       string                    `json:"apmId"`
+	StartTime   uint64                    `json:"startTime"`
+	Miles       int                       `json:"miles"`
+	Speed       float64                   `json:"speed"`
+	MaxSpeed    float64                   `json:"maxSpeed"`
+	HardAcc     int                       `json:"hardAcc"`
+	HardBreak   int                       `json:"hardBreak"`
+	Events      map[string]int            `json:"events"`
+	Severity    map[string]map[string]int `json:"severity"`
+	Score       float64                   `json:"score"`
+	Lifetime    Lifetime                  `json:"lifetime"`
+	Components  map[string]ComponentLife  `json:"components"`
+	Maintenance []MaintenanceRecord       `json:"maintenance"`
+	Fatigue     FatigueReport             `json:"fatigue"`
+	RUL         *Projection               `json:"rul"`
+	Calibration *Calibration              `json:"calibration,omitempty"`
+	Filter      FilterConfig              `json:"filter"`
+}
+
+// vehicles serves /vehicles/{id} and its trips, maintenance, readings and
+// events subresources, for the tenant's vehicles only.
+func vehicles(w http.ResponseWriter, r *http.Request, t *Tenant) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/vehicles/"), "/"), "/")
+	id := parts[0]
+
+	v, found := t.registry.vehicle(id)
+	if id == "" || !found {
+		w.WriteHeader(404)
+		return
+	}
+
+	switch {
+	case len(parts) == 1:
+		writeJSON(w, vehicleDetail(t, v))
+	case len(parts) == 2 && parts[1] == "trips":
+		writeJSON(w, vehicleTrips(t, id))
+	case len(parts) == 2 && parts[1] == "maintenance":
+		vehicleMaintenance(w, r, t, id)
+	case len(parts) == 2 && parts[1] == "readings":
+		vehicleReadings(w, r, t, v)
+	case len(parts) == 2 && parts[1] == "events":
+		vehicleEvents(w, r, t, v)
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+func vehicleDetail(t *Tenant, v Vehicle) VehicleDetail {
+	id := v.ID
+	d := VehicleDetail{
+		CarID:     id,
+		ApmID:     v.ApmID,
+		StartTime: v.StartTime,
+		Miles:     int(v.Miles),
+		HardAcc:   v.Events["hardAcc"],
+		HardBreak: v.Events["hardBreak"],
+		Events:    make(map[string]int),
+		Severity:  v.Severity,
+		Filter:    filterConfigFor(t, id),
+	}
+	for event, n := range v.Events {
+		if event != "hardAcc" && event != "hardBreak" {
+			d.Events[event] = n
+		}
+	}
+
+	calibMapMutex.Lock()
+	if c, found := calibMap[t.key(id)]; found {
+		copied := *c
+		copied.window = nil
+		d.Calibration = &copied
+	}
+	calibMapMutex.Unlock()
+
+	d.Speed, d.MaxSpeed = speeds(t, id)
+	d.Score = vehicleScore(t, id)
+	d.Lifetime = lifetimeOf(t, v)
+	d.RUL = projection(t, id)
+	d.Fatigue = fatigueReport(t, id)
+	d.Components = componentLives(t, id)
+	d.Maintenance = maintenanceHistory(t, id)
+	return d
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	out, err := json.Marshal(v)
+	if err != nil {
+		fmt.Println("ERROR: could not marshal response")
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	io.WriteString(w, string(out))
+}
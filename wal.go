@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Every accepted reading is appended to a write-ahead log under
+// STATE_DIR/wal before it is processed. Segments are named after the sequence
+// number of their first record and rotate at WAL_SEGMENT_BYTES. A record is
+//
+//	length uint32 | crc32c(seq+payload) uint32 | seq uint64 | payload
+//
+// with the payload being the reading as JSON, along with the ID of the tenant
+// that sent it (records without one belong to the first tenant). On startup
+// the records after the snapshot's walSeq are replayed; once a snapshot is
+// saved, segments holding only records it covers are deleted.
+//
+// A bad record that runs to the end of the newest segment is a write torn by
+// a crash; it is cut off and replay carries on. A bad record anywhere else
+// means the log is damaged and startup stops rather than lose what follows.
+
+const (
+	walHeaderSize = 16
+	walSuffix     = ".wal"
+	walMaxRecord  = 1 << 20
+)
+
+// walCorruption is a record readSegment could not read. tail is set when
+// nothing follows the record in its segment.
+type walCorruption struct {
+	path   string
+	offset int64
+	reason string
+	tail   bool
+}
+
+func (c *walCorruption) Error() string {
+	return fmt.Sprintf("%s: %s at offset %d", c.path, c.reason, c.offset)
+}
+
+type walRecord struct {
+	Tenant string `json:"tenant,omitempty"`
+	EdisonMessage
+}
+
+type walWriter struct {
+	mu      sync.Mutex
+	dir     string
+	file    *os.File
+	buf     *bufio.Writer
+	size    int64
+	seq     uint64
+	dirty   bool
+	maxSize int64
+}
+
+var (
+	walFsync     = fsyncMode()
+	walSegment   = envInt("WAL_SEGMENT_BYTES", 16<<20)
+	walCRCTable  = crc32.MakeTable(crc32.Castagnoli)
+	wal          *walWriter
+	replaying    int32
+	ingestMutex  = &sync.RWMutex{}
+	walSyncEvery = time.Second
+)
+
+// fsyncMode reads STATE_FSYNC: "always" syncs every WAL record, "interval"
+// (the default) syncs the WAL once a second, and "never" leaves it to the OS.
+// Snapshots are synced unless the mode is "never".
+func fsyncMode() string {
+	switch mode := os.Getenv("STATE_FSYNC"); mode {
+	case "always", "never":
+		return mode
+	case "", "interval":
+	default:
+		fmt.Printf("ERROR: bad STATE_FSYNC %q, using interval\n", mode)
+	}
+	return "interval"
+}
+
+func envInt(name string, fallback int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		fmt.Printf("ERROR: bad %s %q, using %d\n", name, v, fallback)
+		return fallback
+	}
+	return n
+}
+
+func walDir() string {
+	return filepath.Join(stateDir, "wal")
+}
+
+func replayingWAL() bool {
+	return atomic.LoadInt32(&replaying) == 1
+}
+
+func segmentName(seq uint64) string {
+	return fmt.Sprintf("%020d%s", seq, walSuffix)
+}
+
+// walSegments returns the segment files in dir ordered by first sequence.
+func walSegments(dir string) ([]string, []uint64, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var names []string
+	for _, info := range infos {
+		if strings.HasSuffix(info.Name(), walSuffix) {
+			names = append(names, info.Name())
+		}
+	}
+	sort.Strings(names)
+	firsts := make([]uint64, 0, len(names))
+	for _, name := range names {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, walSuffix), 10, 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("bad wal segment name %s", name)
+		}
+		firsts = append(firsts, seq)
+	}
+	return names, firsts, nil
+}
+
+// openWAL starts a fresh segment after the last sequence number in use, so a
+// torn record at the end of the previous segment is never appended to. Any
+// existing file of that name can only hold a torn record and is truncated.
+func openWAL(lastSeq uint64) error {
+	if stateDir == "" {
+		return nil
+	}
+	w := &walWriter{dir: walDir(), seq: lastSeq, maxSize: int64(walSegment)}
+	if err := os.MkdirAll(w.dir, 0755); err != nil {
+		return err
+	}
+	if err := w.rotate(); err != nil {
+		return err
+	}
+	wal = w
+	if walFsync == "interval" {
+		go w.syncPeriodically()
+	}
+	return nil
+}
+
+// rotate expects w.mu to be held, or w not to be shared yet.
+func (w *walWriter) rotate() error {
+	if w.file != nil {
+		if err := w.flush(true); err != nil {
+			return err
+		}
+		if err := w.file.Close(); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(filepath.Join(w.dir, segmentName(w.seq+1)), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w.file, w.buf, w.size = f, bufio.NewWriter(f), 0
+	if walFsync != "never" {
+		return syncDir(w.dir)
+	}
+	return nil
+}
+
+func (w *walWriter) flush(sync bool) error {
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	if sync && walFsync != "never" {
+		w.dirty = false
+		return w.file.Sync()
+	}
+	return nil
+}
+
+// appendWAL logs a reading and returns its sequence number.
+func appendWAL(t *Tenant, msg EdisonMessage) (uint64, error) {
+	if wal == nil {
+		return 0, nil
+	}
+	payload, err := json.Marshal(walRecord{t.ID, msg})
+	if err != nil {
+		return 0, err
+	}
+
+	w := wal
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.size >= w.maxSize {
+		if err = w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	w.seq++
+	header := make([]byte, walHeaderSize)
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint64(header[8:16], w.seq)
+	crc := crc32.Update(crc32.Checksum(header[8:16], walCRCTable), walCRCTable, payload)
+	binary.BigEndian.PutUint32(header[4:8], crc)
+	if _, err = w.buf.Write(header); err == nil {
+		_, err = w.buf.Write(payload)
+	}
+	if err != nil {
+		return w.seq, err
+	}
+	w.size += int64(walHeaderSize + len(payload))
+	w.dirty = true
+	return w.seq, w.flush(walFsync == "always")
+}
+
+func (w *walWriter) syncPeriodically() {
+	ticker := time.NewTicker(walSyncEvery)
+	for range ticker.C {
+		w.mu.Lock()
+		var err error
+		if w.dirty {
+			err = w.flush(true)
+		}
+		w.mu.Unlock()
+		if err != nil {
+			fmt.Println("ERROR: could not sync wal:", err)
+		}
+	}
+}
+
+func walSeq() uint64 {
+	if wal == nil {
+		return 0
+	}
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	return wal.seq
+}
+
+// truncateWAL deletes every segment whose records are all covered by a
+// snapshot taken at seq. The segment being written is always kept.
+func truncateWAL(seq uint64) error {
+	if wal == nil {
+		return nil
+	}
+	names, firsts, err := walSegments(wal.dir)
+	if err != nil {
+		return err
+	}
+	for i := 0; i+1 < len(names); i++ {
+		if firsts[i+1] > seq+1 {
+			break
+		}
+		if err = os.Remove(filepath.Join(wal.dir, names[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSegment calls fn for every intact record in a segment and stops at the
+// first short or corrupt one with a *walCorruption.
+func readSegment(path string, fn func(seq uint64, rec walRecord)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(f)
+	header := make([]byte, walHeaderSize)
+	var offset int64
+	bad := func(reason string, end int64) error {
+		return &walCorruption{path: path, offset: offset, reason: reason, tail: end >= info.Size()}
+	}
+	for {
+		if _, err = io.ReadFull(r, header); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return bad("short header", info.Size())
+		}
+		size := binary.BigEndian.Uint32(header[0:4])
+		end := offset + int64(walHeaderSize) + int64(size)
+		if size > walMaxRecord {
+			return bad("bad record length", end)
+		}
+		payload := make([]byte, size)
+		if _, err = io.ReadFull(r, payload); err != nil {
+			return bad("short record", info.Size())
+		}
+		crc := crc32.Update(crc32.Checksum(header[8:16], walCRCTable), walCRCTable, payload)
+		if crc != binary.BigEndian.Uint32(header[4:8]) {
+			return bad("checksum mismatch", end)
+		}
+		var rec walRecord
+		if err = json.Unmarshal(payload, &rec); err != nil {
+			return bad(fmt.Sprintf("bad record (%v)", err), end)
+		}
+		fn(binary.BigEndian.Uint64(header[8:16]), rec)
+		offset = end
+	}
+}
+
+// replayWAL re-processes every logged reading after seq and returns the last
+// sequence number seen, or an error for a damaged log. Nothing is sent to the
+// APM service or webhooks while replaying, as it was already sent the first
+// time round.
+func replayWAL(seq uint64) (uint64, error) {
+	if stateDir == "" {
+		return seq, nil
+	}
+	names, _, err := walSegments(walDir())
+	if err != nil {
+		return seq, err
+	}
+
+	atomic.StoreInt32(&replaying, 1)
+	defer atomic.StoreInt32(&replaying, 0)
+	last, replayed, skipped := seq, 0, 0
+	for i, name := range names {
+		path := filepath.Join(walDir(), name)
+		err = readSegment(path, func(n uint64, rec walRecord) {
+			if n > last {
+				last = n
+			}
+			if n <= seq {
+				return
+			}
+			t := tenants[0]
+			if rec.Tenant != "" {
+				t = tenantByID(rec.Tenant)
+			}
+			if t == nil {
+				skipped++
+				return
+			}
+			t.registry.observe(rec.EdisonMessage)
+			process(t, rec.EdisonMessage)
+			replayed++
+		})
+		if c, torn := err.(*walCorruption); torn && c.tail && i == len(names)-1 {
+			fmt.Println("ERROR: cutting torn record off the wal:", err)
+			err = os.Truncate(path, c.offset)
+		}
+		if err != nil {
+			return last, err
+		}
+	}
+	if replayed > 0 {
+		fmt.Printf("replayed %d readings from the wal\n", replayed)
+	}
+	if skipped > 0 {
+		fmt.Printf("ERROR: skipped %d wal readings from unknown tenants\n", skipped)
+	}
+	return last, nil
+}
+
+// ingest logs a reading and runs it through the pipeline, reporting
+// errAssetPoolExhausted for a vehicle still waiting for an asset. A reading
+// that cannot be logged is refused rather than processed. Snapshots take
+// ingestMutex for writing, so a snapshot never sees half a reading.
+func ingest(t *Tenant, msg EdisonMessage) error {
+	ingestMutex.RLock()
+	defer ingestMutex.RUnlock()
+	if _, err := appendWAL(t, msg); err != nil {
+		fmt.Println("ERROR: could not append to wal:", err)
+		return err
+	}
+	err := t.registry.observe(msg)
+	process(t, msg)
+	return err
+}
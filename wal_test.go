@@ -0,0 +1,193 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// withWAL points the state directory at a temporary one holding a fresh WAL,
+// with tenant as the only tenant.
+func withWAL(t *testing.T, tenant *Tenant, segmentBytes int64) func() {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedDir, savedTenants := stateDir, tenants
+	stateDir, tenants = dir, []*Tenant{tenant}
+	if err = openWAL(0); err != nil {
+		t.Fatal(err)
+	}
+	wal.maxSize = segmentBytes
+	return func() {
+		closeTestWAL()
+		resetTenant(tenant)
+		stateDir, tenants = savedDir, savedTenants
+		os.RemoveAll(dir)
+	}
+}
+
+func closeTestWAL() {
+	if wal != nil {
+		wal.mu.Lock()
+		wal.flush(true)
+		wal.file.Close()
+		wal.mu.Unlock()
+		wal = nil
+	}
+}
+
+func appendReadings(t *testing.T, tenant *Tenant, n int) {
+	for i := 1; i <= n; i++ {
+		if _, err := appendWAL(tenant, EdisonMessage{ID: "car1", Timestamp: uint64(i * 1000), Miles: float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	closeTestWAL()
+}
+
+func segmentPaths(t *testing.T) []string {
+	names, _, err := walSegments(walDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, name := range names {
+		paths = append(paths, filepath.Join(walDir(), name))
+	}
+	return paths
+}
+
+func corrupt(t *testing.T, path string, offset int64) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset < 0 {
+		offset += int64(len(data))
+	}
+	data[offset] ^= 0xff
+	if err = ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplayCutsTornTail(t *testing.T) {
+	tenant := newTenant(&Tenant{ID: "wal-torn"})
+	defer withWAL(t, tenant, 1<<20)()
+	appendReadings(t, tenant, 3)
+
+	paths := segmentPaths(t)
+	info, err := os.Stat(paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Truncate(paths[0], info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	last, err := replayWAL(0)
+	if err != nil || last != 2 {
+		t.Fatalf("replay of a torn tail: last %d, %v", last, err)
+	}
+	if v, _ := tenant.registry.vehicle("car1"); v.Miles != 2 {
+		t.Fatalf("expected the two intact readings replayed, miles %v", v.Miles)
+	}
+	if last, err = replayWAL(0); err != nil || last != 2 {
+		t.Fatalf("the torn record should have been cut off: last %d, %v", last, err)
+	}
+}
+
+func TestReplayTreatsBadLastRecordAsTorn(t *testing.T) {
+	tenant := newTenant(&Tenant{ID: "wal-lastcrc"})
+	defer withWAL(t, tenant, 1<<20)()
+	appendReadings(t, tenant, 3)
+	corrupt(t, segmentPaths(t)[0], -2)
+
+	if last, err := replayWAL(0); err != nil || last != 2 {
+		t.Fatalf("replay with a bad last record: last %d, %v", last, err)
+	}
+}
+
+func TestReplayStopsAtChecksumMismatch(t *testing.T) {
+	tenant := newTenant(&Tenant{ID: "wal-crc"})
+	defer withWAL(t, tenant, 1<<20)()
+	appendReadings(t, tenant, 3)
+	corrupt(t, segmentPaths(t)[0], walHeaderSize+2)
+
+	_, err := replayWAL(0)
+	c, ok := err.(*walCorruption)
+	if !ok || c.tail || c.offset != 0 {
+		t.Fatalf("expected a checksum mismatch in the first record, got %v", err)
+	}
+}
+
+func TestReplayStopsAtTornOlderSegment(t *testing.T) {
+	tenant := newTenant(&Tenant{ID: "wal-older"})
+	defer withWAL(t, tenant, 1)()
+	appendReadings(t, tenant, 3)
+
+	paths := segmentPaths(t)
+	if len(paths) < 3 {
+		t.Fatalf("expected a segment per record, got %v", paths)
+	}
+	info, err := os.Stat(paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Truncate(paths[0], info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = replayWAL(0); err == nil {
+		t.Fatalf("a torn record in an older segment should stop replay")
+	}
+}
+
+func TestReplayAfterSnapshot(t *testing.T) {
+	// Without assets nothing is posted to the APM service.
+	tenant := newTenant(&Tenant{ID: "wal-snapshot"})
+	tenant.registry.setAssets(nil)
+	defer withWAL(t, tenant, 1<<20)()
+
+	reading := func(i int) EdisonMessage {
+		return EdisonMessage{ID: "car1", Timestamp: uint64(i * 1000), Miles: float64(i), X: 2}
+	}
+	for i := 1; i <= 3; i++ {
+		if err := ingest(tenant, reading(i)); err != errAssetPoolExhausted {
+			t.Fatalf("expected the vehicle to wait for an asset, got %v", err)
+		}
+	}
+	if err := saveSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 4; i <= 5; i++ {
+		if err := ingest(tenant, reading(i)); err != errAssetPoolExhausted {
+			t.Fatalf("expected the vehicle to wait for an asset, got %v", err)
+		}
+	}
+	want, _ := tenant.registry.vehicle("car1")
+	if want.Events["hardAcc"] != 5 {
+		t.Fatalf("expected 5 hard accelerations, got %v", want.Events)
+	}
+	wantState := takeSnapshot().Tenants[tenant.ID]
+	closeTestWAL()
+
+	resetTenant(tenant)
+	seq, err := loadSnapshot()
+	if err != nil || seq != 3 {
+		t.Fatalf("snapshot should cover 3 records: %d, %v", seq, err)
+	}
+	last, err := replayWAL(seq)
+	if err != nil || last != 5 {
+		t.Fatalf("replay: last %d, %v", last, err)
+	}
+	got, _ := tenant.registry.vehicle("car1")
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("replayed vehicle differs\n got %+v\nwant %+v", got, want)
+	}
+	if gotState := takeSnapshot().Tenants[tenant.ID]; !reflect.DeepEqual(gotState, wantState) {
+		t.Fatalf("replayed state differs\n got %+v\nwant %+v", gotState, wantState)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var webhookClient = &http.Client{Timeout: 5 * time.Second}
+
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// notifyWebhooks posts the payload to every one of the tenant's targets
+// concurrently.
+func notifyWebhooks(t *Tenant, payload []byte) {
+	for _, target := range t.Webhooks {
+		go postWebhook(target, payload)
+	}
+}
+
+func postWebhook(target string, payload []byte) {
+	res, err := webhookClient.Post(target, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		fmt.Printf("ERROR: could not post to webhook %s: %v\n", target, err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode > 299 {
+		fmt.Printf("ERROR: bad status code %d from webhook %s\n", res.StatusCode, target)
+	}
+}